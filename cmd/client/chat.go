@@ -0,0 +1,447 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"terminal-encrypt-chat/envelope"
+	"terminal-encrypt-chat/message"
+	"terminal-encrypt-chat/tui"
+	"time"
+)
+
+const (
+	// maxSentSequences 是记录的已发送文字消息数，对方报告更早的消息解密失败时不再标记
+	maxSentSequences = 1000
+	// maxMessages 是记录的聊天消息数，更早的消息不能再编辑和删除，也不再更新状态
+	maxMessages = 1000
+)
+
+const deletedPlaceholder = "(消息已删除)"
+
+// chatView 显示聊天消息，正常运行时为 tuiView
+type chatView interface {
+	AppendMessage(id string, text []byte, status tui.Status)
+	AppendReply(id string, ref string, text []byte, status tui.Status)
+	SetMessageStatus(id string, status tui.Status)
+	EditMessage(id string, text []byte)
+	DeleteMessage(id string, placeholder []byte)
+	SetHint(hint string)
+}
+
+// tuiView 把聊天消息显示在终端界面中
+type tuiView struct{}
+
+func (tuiView) AppendMessage(id string, text []byte, status tui.Status) {
+	tui.AppendMessage(id, text, status)
+}
+
+func (tuiView) AppendReply(id string, ref string, text []byte, status tui.Status) {
+	tui.AppendReply(id, ref, text, status)
+}
+
+func (tuiView) SetMessageStatus(id string, status tui.Status) {
+	tui.SetMessageStatus(id, status)
+}
+
+func (tuiView) EditMessage(id string, text []byte) {
+	tui.EditMessage(id, text)
+}
+
+func (tuiView) DeleteMessage(id string, placeholder []byte) {
+	tui.DeleteMessage(id, placeholder)
+}
+
+func (tuiView) SetHint(hint string) {
+	tui.SetHint(hint)
+}
+
+// chatMessage 记录一条聊天消息是谁发送的和发送状态，每一方只能编辑和删除自己发送的消息。不保存消息内容
+type chatMessage struct {
+	own     bool
+	deleted bool
+	status  tui.Status
+}
+
+// chat 是一次会话中的聊天，按 envelope 的种类收发聊天文字、回执、输入状态和对消息的编辑。
+// caps 是双方都支持的功能，决定使用哪些种类的消息
+type chat struct {
+	sess  *session
+	caps  message.Capabilities
+	view  chatView
+	mutex *sync.Mutex
+
+	// unsupportedKinds 记录已经提示过的不支持的消息种类，每种只提示一次
+	unsupportedKinds map[envelope.Kind]bool
+	// sentSequences 和 sequenceOrder 记录最近 maxSentSequences 条已发送消息所在帧的序号，用于处理解密失败回执
+	sentSequences map[uint64]envelope.ID
+	sequenceOrder []uint64
+	// unread 是已显示但还没有发送已读回执的消息
+	unread []envelope.ID
+	// messages 和 messageOrder 记录最近的 maxMessages 条聊天消息
+	messages     map[envelope.ID]*chatMessage
+	messageOrder []envelope.ID
+
+	// now 返回当前时间，测试中可以替换为可控的时钟
+	now func() time.Time
+	// typing 表示已经告诉对方正在输入，typingSentAt 是最近一次发送输入状态的时间，
+	// typingEditedAt 是最近一次编辑输入框的时间，只在 typingLoop 中访问
+	typing         bool
+	typingSentAt   time.Time
+	typingEditedAt time.Time
+	// peerTypingUntil 是对方正在输入的提示到期的时间，没有显示提示时为零值
+	peerTypingUntil time.Time
+}
+
+// activeChat 是当前会话的聊天，握手成功后创建
+var activeChat *chat
+
+func newChat(sess *session, caps message.Capabilities, view chatView) *chat {
+	return &chat{
+		sess:             sess,
+		caps:             caps,
+		view:             view,
+		mutex:            &sync.Mutex{},
+		unsupportedKinds: make(map[envelope.Kind]bool),
+		sentSequences:    make(map[uint64]envelope.ID),
+		messages:         make(map[envelope.ID]*chatMessage),
+		now:              time.Now,
+	}
+}
+
+// useEnvelope 判断双方是否都支持 envelope 格式
+func (c *chat) useEnvelope() bool {
+	return c.caps&message.CapEnvelope != 0
+}
+
+// useEdit 判断对方是否支持编辑和删除消息
+func (c *chat) useEdit() bool {
+	return c.caps&message.CapEdit != 0
+}
+
+// useReceipts 判断是否收发回执，只有双方都开启回执时才使用
+func (c *chat) useReceipts() bool {
+	return c.caps&message.CapReceipts != 0
+}
+
+// payload 返回发送 e 时加密的明文。对方不支持 envelope 格式时只能发送文字，其他种类返回 nil
+func (c *chat) payload(e *envelope.Envelope) []byte {
+	if !c.useEnvelope() {
+		if e.Kind != envelope.KindText {
+			return nil
+		}
+		return e.Body
+	}
+	return e.Marshal()
+}
+
+// sendEnvelope 加密发送一条消息，返回所在帧的序号
+func (c *chat) sendEnvelope(e *envelope.Envelope) (uint64, error) {
+	data := c.payload(e)
+	if data == nil {
+		return 0, nil
+	}
+	return c.sess.Send(data)
+}
+
+// sendText 在消息区显示并发送聊天文字，使用回执时显示发送状态。
+// ref 不为零时是对这条消息的回复，对方不支持 envelope 格式时只发送文字。
+// 消息太长时返回 errMessageTooLarge，不显示也不发送
+func (c *chat) sendText(text []byte, ref envelope.ID) error {
+	e, err := envelope.New(envelope.KindText)
+	if err != nil {
+		return err
+	}
+	e.Body = text
+	if c.useEnvelope() {
+		e.Ref = ref
+	}
+
+	data := c.payload(e)
+	if err := c.sess.CheckSize(data); err != nil {
+		return err
+	}
+
+	status := tui.StatusNone
+	if c.useReceipts() {
+		status = tui.StatusSending
+	}
+	c.showMessage(e, withPrefix(sendMessagePrefix, text), status)
+
+	sequence, err := c.sess.Send(data)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.sentSequences[sequence] = e.ID
+	c.sequenceOrder = append(c.sequenceOrder, sequence)
+	if len(c.sequenceOrder) > maxSentSequences {
+		delete(c.sentSequences, c.sequenceOrder[0])
+		c.sequenceOrder = c.sequenceOrder[1:]
+	}
+	c.rememberMessage(e.ID, &chatMessage{own: true, status: status})
+	c.mutex.Unlock()
+	return nil
+}
+
+// rememberMessage 需要持有 mutex
+func (c *chat) rememberMessage(id envelope.ID, m *chatMessage) {
+	c.messages[id] = m
+	c.messageOrder = append(c.messageOrder, id)
+	if len(c.messageOrder) > maxMessages {
+		delete(c.messages, c.messageOrder[0])
+		c.messageOrder = c.messageOrder[1:]
+	}
+}
+
+// replyTarget 返回发送消息时选中的消息，没有选中时返回零值
+func replyTarget(selected string) envelope.ID {
+	id, err := envelope.ParseID(selected)
+	if err != nil {
+		return envelope.ID{}
+	}
+	return id
+}
+
+// ownMessage 返回要编辑或删除的消息: 选中的消息，没有选中时为最后一条自己发送且没有删除的消息
+func (c *chat) ownMessage(selected string) (envelope.ID, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if selected == "" {
+		for i := len(c.messageOrder) - 1; i >= 0; i-- {
+			if m := c.messages[c.messageOrder[i]]; m.own && !m.deleted {
+				return c.messageOrder[i], true
+			}
+		}
+		log.Warn("没有可以操作的消息")
+		return envelope.ID{}, false
+	}
+	id, err := envelope.ParseID(selected)
+	m := c.messages[id]
+	switch {
+	case err != nil || m == nil:
+		log.Warn("选中的消息太早了，不能再操作")
+	case !m.own:
+		log.Warn("只能编辑和删除自己发送的消息")
+	case m.deleted:
+		log.Warn("消息已经删除了")
+	default:
+		return id, true
+	}
+	return envelope.ID{}, false
+}
+
+// sendControl 发送对已发送消息的操作，对方不支持时不发送
+func (c *chat) sendControl(ref envelope.ID, state byte, body []byte) bool {
+	if !c.useEdit() {
+		log.Warn("对方的客户端不支持编辑和删除消息")
+		return false
+	}
+	e, err := envelope.New(envelope.KindControl)
+	if err == nil {
+		e.Ref = ref
+		e.State = state
+		e.Body = body
+		_, err = c.sendEnvelope(e)
+	}
+	if err != nil {
+		log.Warnf("加密消息失败: %v", err)
+		return false
+	}
+	return true
+}
+
+// editMessage 把选中的或最后一条自己发送的消息修改为 text
+func (c *chat) editMessage(text []byte, selected string) {
+	if len(text) == 0 {
+		log.Warn("用法: /edit <修改后的文字>")
+		return
+	}
+	id, ok := c.ownMessage(selected)
+	if !ok || !c.sendControl(id, envelope.ControlEdit, text) {
+		return
+	}
+	c.view.EditMessage(id.String(), withPrefix(sendMessagePrefix, text))
+}
+
+// deleteMessage 删除选中的或最后一条自己发送的消息
+func (c *chat) deleteMessage(selected string) {
+	id, ok := c.ownMessage(selected)
+	if !ok || !c.sendControl(id, envelope.ControlDelete, nil) {
+		return
+	}
+	c.mutex.Lock()
+	c.messages[id].deleted = true
+	c.mutex.Unlock()
+	c.view.DeleteMessage(id.String(), withPrefix(sendMessagePrefix, []byte(deletedPlaceholder)))
+}
+
+func (c *chat) sendReceipt(ref envelope.ID, state byte, sequence uint64) {
+	e, err := envelope.New(envelope.KindReceipt)
+	if err != nil {
+		log.Warnf("发送回执失败: %s", err)
+		return
+	}
+	e.Ref = ref
+	e.State = state
+	e.Offset = sequence
+	if _, err := c.sendEnvelope(e); err != nil {
+		log.Warnf("发送回执失败: %s", err)
+	}
+}
+
+// sendDecryptFailed 告诉对方序号为 sequence 的帧解密失败
+func (c *chat) sendDecryptFailed(sequence uint64) {
+	if c.useReceipts() {
+		c.sendReceipt(envelope.ID{}, envelope.ReceiptDecryptFailed, sequence)
+	}
+}
+
+// markRead 为已显示的消息发送已读回执
+func (c *chat) markRead() {
+	c.mutex.Lock()
+	ids := c.unread
+	c.unread = nil
+	c.mutex.Unlock()
+	for _, id := range ids {
+		c.sendReceipt(id, envelope.ReceiptRead, 0)
+	}
+}
+
+// readReceiptLoop 在用户输入时为已显示的消息发送已读回执
+func (c *chat) readReceiptLoop(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-tui.Activity():
+		}
+		c.markRead()
+	}
+}
+
+// handlePayload 按消息种类处理解密后的明文
+func (c *chat) handlePayload(data []byte) {
+	if !c.useEnvelope() {
+		c.view.AppendMessage("", withPrefix(receiveMessagePrefix, data), tui.StatusNone)
+		return
+	}
+	e, err := envelope.Unmarshal(data)
+	if err == envelope.ErrUnsupportedVersion {
+		c.warnUnsupported(0, "收到无法解析的新版本消息，对方的客户端版本可能较新，已忽略")
+		return
+	}
+	if err != nil {
+		log.Warnf("消息格式错误: %s", err)
+		return
+	}
+
+	switch e.Kind {
+	case envelope.KindText:
+		c.mutex.Lock()
+		c.rememberMessage(e.ID, &chatMessage{})
+		c.mutex.Unlock()
+		c.showMessage(e, withPrefix(receiveMessagePrefix, e.Body), tui.StatusNone)
+		c.peerStoppedTyping()
+		if c.useReceipts() {
+			c.sendReceipt(e.ID, envelope.ReceiptDelivered, 0)
+			c.mutex.Lock()
+			c.unread = append(c.unread, e.ID)
+			c.mutex.Unlock()
+		}
+	case envelope.KindNotice:
+		log.Infof("对方: %s", e.Body)
+	case envelope.KindReceipt:
+		c.handleReceipt(e)
+	case envelope.KindTyping:
+		c.handleTyping(e)
+	case envelope.KindControl:
+		c.handleControl(e)
+	case envelope.KindFileChunk:
+		log.Debugf("忽略 %s 消息 %s", e.Kind, e.ID)
+	default:
+		c.warnUnsupported(e.Kind, "收到不支持的消息类型，对方的客户端版本可能较新，已忽略")
+	}
+}
+
+// handleReceipt 更新自己发送的消息的状态。解密失败回执中的序号来自没有经过认证的帧头，
+// 只用于还在发送中的消息，不会覆盖已经送达或已读的状态
+func (c *chat) handleReceipt(e *envelope.Envelope) {
+	var status tui.Status
+	ref := e.Ref
+	c.mutex.Lock()
+	switch e.State {
+	case envelope.ReceiptDelivered:
+		status = tui.StatusDelivered
+	case envelope.ReceiptRead:
+		status = tui.StatusRead
+	case envelope.ReceiptDecryptFailed:
+		status = tui.StatusFailed
+		id, ok := c.sentSequences[e.Offset]
+		if !ok {
+			c.mutex.Unlock()
+			log.Warn("对方有一条消息解密失败")
+			return
+		}
+		ref = id
+	}
+	m := c.messages[ref]
+	ok := status != tui.StatusNone && m != nil && m.own && !m.deleted && m.status.Precedes(status)
+	if ok {
+		m.status = status
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		c.view.SetMessageStatus(ref.String(), status)
+	} else {
+		log.Debugf("忽略消息 %s 的回执 %d", ref, e.State)
+	}
+}
+
+// handleControl 处理对方对消息的编辑和删除，只接受对方自己发送的消息
+func (c *chat) handleControl(e *envelope.Envelope) {
+	c.mutex.Lock()
+	m := c.messages[e.Ref]
+	ok := m != nil && !m.own && !m.deleted
+	if ok && e.State == envelope.ControlDelete {
+		m.deleted = true
+	}
+	c.mutex.Unlock()
+	if !ok {
+		log.Debugf("忽略对消息 %s 的操作", e.Ref)
+		return
+	}
+
+	switch e.State {
+	case envelope.ControlEdit:
+		c.view.EditMessage(e.Ref.String(), withPrefix(receiveMessagePrefix, e.Body))
+	case envelope.ControlDelete:
+		c.view.DeleteMessage(e.Ref.String(), withPrefix(receiveMessagePrefix, []byte(deletedPlaceholder)))
+	}
+}
+
+func (c *chat) warnUnsupported(kind envelope.Kind, text string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.unsupportedKinds[kind] {
+		c.unsupportedKinds[kind] = true
+		log.Warn(text)
+	}
+}
+
+// showMessage 在消息区显示一条聊天消息，回复显示在引用的下方
+func (c *chat) showMessage(e *envelope.Envelope, text []byte, status tui.Status) {
+	if e.Ref.IsZero() {
+		c.view.AppendMessage(e.ID.String(), text, status)
+	} else {
+		c.view.AppendReply(e.ID.String(), e.Ref.String(), text, status)
+	}
+}
+
+func withPrefix(prefix []byte, data []byte) []byte {
+	t := make([]byte, len(prefix)+len(data))
+	copy(t[:len(prefix)], prefix)
+	copy(t[len(prefix):], data)
+	return t
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"terminal-encrypt-chat/envelope"
+	"terminal-encrypt-chat/message"
+	"terminal-encrypt-chat/tui"
+)
+
+// shownMessage 是 recordView 中显示的一条消息，statuses 是依次显示过的状态
+type shownMessage struct {
+	text     string
+	ref      string
+	statuses []tui.Status
+	edited   bool
+	deleted  bool
+}
+
+// recordView 是测试中的 chatView，记录显示的消息和提示
+type recordView struct {
+	mutex    sync.Mutex
+	messages map[string]*shownMessage
+	order    []string
+	hint     string
+}
+
+func newRecordView() *recordView {
+	return &recordView{messages: make(map[string]*shownMessage)}
+}
+
+func (v *recordView) AppendMessage(id string, text []byte, status tui.Status) {
+	v.AppendReply(id, "", text, status)
+}
+
+func (v *recordView) AppendReply(id string, ref string, text []byte, status tui.Status) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.messages[id] = &shownMessage{text: string(text), ref: ref, statuses: []tui.Status{status}}
+	v.order = append(v.order, id)
+}
+
+func (v *recordView) SetMessageStatus(id string, status tui.Status) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if m := v.messages[id]; m != nil {
+		m.statuses = append(m.statuses, status)
+	}
+}
+
+func (v *recordView) EditMessage(id string, text []byte) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if m := v.messages[id]; m != nil {
+		m.text = string(text)
+		m.edited = true
+	}
+}
+
+func (v *recordView) DeleteMessage(id string, placeholder []byte) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if m := v.messages[id]; m != nil {
+		m.text = string(placeholder)
+		m.deleted = true
+	}
+}
+
+func (v *recordView) SetHint(hint string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.hint = hint
+}
+
+// last 返回最后显示的一条消息的 id
+func (v *recordView) last(t *testing.T) string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if len(v.order) == 0 {
+		t.Fatal("No message shown")
+	}
+	return v.order[len(v.order)-1]
+}
+
+func (v *recordView) message(t *testing.T, id string) shownMessage {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	m := v.messages[id]
+	if m == nil {
+		t.Fatal("Message not shown: ", id)
+	}
+	return *m
+}
+
+// chatPeer 是测试中聊天的一方
+type chatPeer struct {
+	*sessionPeer
+	chat *chat
+	view *recordView
+}
+
+// newChatPair 在 newSessionPair 建立的会话上为双方建立聊天，caps 是双方都支持的功能
+func newChatPair(t *testing.T, caps message.Capabilities) (*chatPeer, *chatPeer) {
+	a, b := newSessionPair(t)
+	viewA, viewB := newRecordView(), newRecordView()
+	return &chatPeer{sessionPeer: a, chat: newChat(a.sess, caps, viewA), view: viewA},
+		&chatPeer{sessionPeer: b, chat: newChat(b.sess, caps, viewB), view: viewB}
+}
+
+func (p *chatPeer) sendText(t *testing.T, text string) string {
+	if err := p.chat.sendText([]byte(text), envelope.ID{}); err != nil {
+		t.Fatal("Fail to send: ", err)
+	}
+	return p.view.last(t)
+}
+
+// deliver 把对方发来的帧全部交给聊天处理
+func (p *chatPeer) deliver(t *testing.T) {
+	for len(p.conn.in) > 0 {
+		p.open(t, <-p.conn.in)
+	}
+}
+
+func (p *chatPeer) open(t *testing.T, m *message.Message) {
+	plaintext, err := p.sess.Open(m)
+	if err != nil {
+		t.Fatalf("%s fails to open frame: %s", p.conn.name, err)
+	}
+	if plaintext != nil {
+		p.chat.handlePayload(plaintext)
+	}
+}
+
+// receiveCorrupted 模拟 Receive 中解密失败的帧: 只为还没有收到过的序号发送解密失败回执
+func (p *chatPeer) receiveCorrupted(t *testing.T, m *message.Message) {
+	corrupted := message.NewMessage(m.MType, append([]byte{}, m.Content...))
+	corrupted.Content[len(corrupted.Content)-1] ^= 1
+	if _, err := p.sess.Open(corrupted); err == nil {
+		t.Fatal("Corrupted frame must not decrypt")
+	}
+	if sequence, ok := p.sess.UndeliveredSequence(corrupted); ok {
+		p.chat.sendDecryptFailed(sequence)
+	}
+}
+
+func expectStatuses(t *testing.T, p *chatPeer, id string, expected ...tui.Status) {
+	if got := p.view.message(t, id).statuses; fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("%s shows statuses %v, expected %v", p.conn.name, got, expected)
+	}
+}
+
+// TestChatReceipts 回执按消息 ID 更新发送状态，状态只会前进，解密失败只用于还在发送中的消息
+func TestChatReceipts(t *testing.T) {
+	const withReceipts = message.CapEnvelope | message.CapReceipts
+	cases := []struct {
+		name string
+		caps message.Capabilities
+		// run 由 a 发送消息，返回 a 的消息 id 和期望依次显示的状态
+		run func(t *testing.T, a, b *chatPeer) (string, []tui.Status)
+	}{
+		{"delivered_then_read", withReceipts, func(t *testing.T, a, b *chatPeer) (string, []tui.Status) {
+			id := a.sendText(t, "hello")
+			b.deliver(t)
+			a.deliver(t)
+			b.chat.markRead()
+			a.deliver(t)
+			return id, []tui.Status{tui.StatusSending, tui.StatusDelivered, tui.StatusRead}
+		}},
+		{"receipts_keyed_by_id", withReceipts, func(t *testing.T, a, b *chatPeer) (string, []tui.Status) {
+			first := a.sendText(t, "first")
+			firstFrame := <-b.conn.in
+			second := a.sendText(t, "second")
+			b.deliver(t)
+			a.deliver(t)
+			b.chat.markRead()
+			a.deliver(t)
+			// 第一条消息迟到，只有它的状态改变
+			b.open(t, firstFrame)
+			a.deliver(t)
+			expectStatuses(t, a, second, tui.StatusSending, tui.StatusDelivered, tui.StatusRead)
+			return first, []tui.Status{tui.StatusSending, tui.StatusDelivered}
+		}},
+		{"late_delivered_after_read", withReceipts, func(t *testing.T, a, b *chatPeer) (string, []tui.Status) {
+			id := a.sendText(t, "hello")
+			b.deliver(t)
+			b.chat.markRead()
+			delivered, read := <-a.conn.in, <-a.conn.in
+			a.open(t, read)
+			a.open(t, delivered)
+			return id, []tui.Status{tui.StatusSending, tui.StatusRead}
+		}},
+		{"decrypt_failed_while_sending", withReceipts, func(t *testing.T, a, b *chatPeer) (string, []tui.Status) {
+			id := a.sendText(t, "hello")
+			b.receiveCorrupted(t, <-b.conn.in)
+			a.deliver(t)
+			return id, []tui.Status{tui.StatusSending, tui.StatusFailed}
+		}},
+		{"delivered_after_forged_failure", withReceipts, func(t *testing.T, a, b *chatPeer) (string, []tui.Status) {
+			id := a.sendText(t, "hello")
+			frame := <-b.conn.in
+			// 服务器伪造了同一序号的帧，之后真正的帧到达
+			b.receiveCorrupted(t, frame)
+			b.open(t, frame)
+			a.deliver(t)
+			return id, []tui.Status{tui.StatusSending, tui.StatusFailed, tui.StatusDelivered}
+		}},
+		{"failure_never_downgrades", withReceipts, func(t *testing.T, a, b *chatPeer) (string, []tui.Status) {
+			id := a.sendText(t, "hello")
+			frame := <-b.conn.in
+			b.open(t, frame)
+			a.deliver(t)
+			// 已经收到的序号不再发送解密失败回执
+			b.receiveCorrupted(t, frame)
+			if len(a.conn.in) != 0 {
+				t.Fatal("Failure receipt must not be sent for a delivered sequence")
+			}
+			b.chat.markRead()
+			a.deliver(t)
+			// 即使收到了对已读消息的解密失败回执也不会改变状态
+			b.chat.sendDecryptFailed(0)
+			a.deliver(t)
+			return id, []tui.Status{tui.StatusSending, tui.StatusDelivered, tui.StatusRead}
+		}},
+		{"failure_below_high_water_mark", withReceipts, func(t *testing.T, a, b *chatPeer) (string, []tui.Status) {
+			id := a.sendText(t, "lost")
+			lost := <-b.conn.in
+			a.sendText(t, "next")
+			b.deliver(t)
+			a.deliver(t)
+			b.receiveCorrupted(t, lost)
+			if len(a.conn.in) != 0 {
+				t.Fatal("Failure receipt must not be sent for a sequence below the high-water mark")
+			}
+			return id, []tui.Status{tui.StatusSending}
+		}},
+		{"receipts_disabled", message.CapEnvelope, func(t *testing.T, a, b *chatPeer) (string, []tui.Status) {
+			id := a.sendText(t, "hello")
+			frame := <-b.conn.in
+			b.receiveCorrupted(t, frame)
+			b.open(t, frame)
+			b.chat.markRead()
+			if len(a.conn.in) != 0 {
+				t.Fatal("Receipts must not be sent when disabled")
+			}
+			return id, []tui.Status{tui.StatusNone}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := newChatPair(t, c.caps)
+			id, expected := c.run(t, a, b)
+			expectStatuses(t, a, id, expected...)
+		})
+	}
+}
+
+// TestChatEditDelete 每一方只能编辑和删除自己发送的消息，对方的操作只对对方自己发送的消息生效
+func TestChatEditDelete(t *testing.T) {
+	const withEdit = message.CapEnvelope | message.CapEdit
+	sent := func(text string) string { return string(sendMessagePrefix) + text }
+	received := func(text string) string { return string(receiveMessagePrefix) + text }
+	cases := []struct {
+		name string
+		caps message.Capabilities
+		// run 由 a 发送一条 "hello"，返回这条消息在 a 和 b 中期望的显示
+		run func(t *testing.T, a, b *chatPeer, id string) (shownMessage, shownMessage)
+	}{
+		{"edit_own", withEdit, func(t *testing.T, a, b *chatPeer, id string) (shownMessage, shownMessage) {
+			a.chat.editMessage([]byte("changed"), "")
+			b.deliver(t)
+			return shownMessage{text: sent("changed"), edited: true}, shownMessage{text: received("changed"), edited: true}
+		}},
+		{"edit_selected", withEdit, func(t *testing.T, a, b *chatPeer, id string) (shownMessage, shownMessage) {
+			later := a.sendText(t, "later")
+			b.deliver(t)
+			a.chat.editMessage([]byte("changed"), id)
+			b.deliver(t)
+			if m := b.view.message(t, later); m.edited || m.text != received("later") {
+				t.Fatal("Only the selected message must be edited")
+			}
+			return shownMessage{text: sent("changed"), edited: true}, shownMessage{text: received("changed"), edited: true}
+		}},
+		{"delete_own", withEdit, func(t *testing.T, a, b *chatPeer, id string) (shownMessage, shownMessage) {
+			a.chat.deleteMessage("")
+			b.deliver(t)
+			// 删除后不能再编辑或删除
+			a.chat.editMessage([]byte("again"), id)
+			a.chat.deleteMessage("")
+			if len(b.conn.in) != 0 {
+				t.Fatal("Deleted message must not be edited or deleted again")
+			}
+			return shownMessage{text: sent(deletedPlaceholder), deleted: true}, shownMessage{text: received(deletedPlaceholder), deleted: true}
+		}},
+		{"peer_edits_nonexistent", withEdit, func(t *testing.T, a, b *chatPeer, id string) (shownMessage, shownMessage) {
+			other, _ := envelope.New(envelope.KindText)
+			b.chat.sendControl(other.ID, envelope.ControlEdit, []byte("forged"))
+			b.chat.sendControl(other.ID, envelope.ControlDelete, nil)
+			a.deliver(t)
+			return shownMessage{text: sent("hello")}, shownMessage{text: received("hello")}
+		}},
+		{"peer_edits_my_message", withEdit, func(t *testing.T, a, b *chatPeer, id string) (shownMessage, shownMessage) {
+			// b 自己的客户端拒绝操作对方的消息
+			b.chat.editMessage([]byte("forged"), id)
+			if len(a.conn.in) != 0 {
+				t.Fatal("Client must refuse to edit the peer's message")
+			}
+			// 修改过的客户端直接发送，a 也必须拒绝
+			parsed, _ := envelope.ParseID(id)
+			b.chat.sendControl(parsed, envelope.ControlEdit, []byte("forged"))
+			b.chat.sendControl(parsed, envelope.ControlDelete, nil)
+			a.deliver(t)
+			return shownMessage{text: sent("hello")}, shownMessage{text: received("hello")}
+		}},
+		{"edit_unsupported", message.CapEnvelope, func(t *testing.T, a, b *chatPeer, id string) (shownMessage, shownMessage) {
+			a.chat.editMessage([]byte("changed"), "")
+			a.chat.deleteMessage("")
+			if len(b.conn.in) != 0 {
+				t.Fatal("Edit must not be sent when the peer does not support it")
+			}
+			return shownMessage{text: sent("hello")}, shownMessage{text: received("hello")}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := newChatPair(t, c.caps)
+			id := a.sendText(t, "hello")
+			b.deliver(t)
+			expectedA, expectedB := c.run(t, a, b, id)
+			for _, v := range []struct {
+				name     string
+				got      shownMessage
+				expected shownMessage
+			}{{"A", a.view.message(t, id), expectedA}, {"B", b.view.message(t, id), expectedB}} {
+				if v.got.text != v.expected.text || v.got.edited != v.expected.edited || v.got.deleted != v.expected.deleted {
+					t.Fatalf("%s shows %q (edited %v, deleted %v), expected %q (edited %v, deleted %v)", v.name,
+						v.got.text, v.got.edited, v.got.deleted, v.expected.text, v.expected.edited, v.expected.deleted)
+				}
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"strings"
 	"terminal-encrypt-chat/crypto"
 	"terminal-encrypt-chat/message"
 	"terminal-encrypt-chat/transfer"
@@ -12,12 +15,41 @@ import (
 	"time"
 )
 
+// capabilities 是本客户端支持的功能，可选的功能由 localCapabilities 根据参数加上
+const capabilities = message.CapKeyConfirmation | message.CapPadding | message.CapNoise | message.CapPAKE | message.CapEnvelope | message.CapEdit
+
+// localCapabilities 返回握手包中声明的功能
+func localCapabilities() message.Capabilities {
+	caps := capabilities
+	if receipts {
+		caps |= message.CapReceipts
+	}
+	if typing {
+		caps |= message.CapTyping
+	}
+	return caps
+}
+
 var (
 	id                   string
 	address              string
+	alias                string
+	dataDir              string
+	dataDirSet           bool
+	noisePattern         string
+	usePassphrase        bool
+	receipts             bool
+	typing               bool
+	cipherSuites         []*crypto.CipherSuite
+	keyExchanges         []*crypto.KeyExchange
+	padding              *crypto.Padding
+	identity             *crypto.Identity
 	conn                 *transfer.Transfer
-	secret               []byte
-	tuiInputCh           = make(chan []byte)
+	sess                 *session
+	protocolVersion      byte
+	peerCapabilities     message.Capabilities
+	closed               = make(chan struct{})
+	tuiInputCh           = make(chan tui.Input)
 	tuiOutputCh          = make(chan []byte)
 	sendMessagePrefix    = []byte("> ")
 	receiveMessagePrefix = []byte("- ")
@@ -47,8 +79,33 @@ func main() {
 	// 解析命令行参数
 	flag.StringVar(&id, "i", "", "聊天 ID")
 	flag.StringVar(&address, "h", "", "服务器地址 ip:port")
+	flag.StringVar(&alias, "a", "", "联系人别名，用于记录对方身份，默认使用聊天 ID")
+	flag.StringVar(&dataDir, "d", defaultDataDir(), "身份密钥等数据的保存目录，指定时 keystore 也保存在这个目录中，默认保存在系统配置目录中")
+	flag.StringVar(&noisePattern, "n", "", "使用 Noise 协议握手，可选 xx 或 ik，双方需要使用相同的握手方式")
+	flag.BoolVar(&usePassphrase, "p", false, "使用与对方约定的口令认证密钥交换(PAKE)，连接前会提示输入口令。口令映射不是常数时间实现，只在自己控制的机器上使用")
+	suites := flag.String("c", "", "允许使用的加密算法，多个用逗号分隔，默认全部: "+cipherSuiteNames(crypto.CipherSuites()))
+	kexes := flag.String("k", "", "允许使用的密钥交换算法，多个用逗号分隔，可选 "+keyExchangeNames(crypto.KeyExchanges())+"，默认 "+keyExchangeNames(crypto.DefaultKeyExchanges())+"。X448 不是常数时间实现，只在这里指定时使用。Noise 握手只支持 X25519")
+	flag.BoolVar(&receipts, "receipts", true, "发送送达和已读回执，关闭后也不会看到对方的回执")
+	flag.BoolVar(&typing, "typing", true, "发送正在输入的状态，关闭后也不会看到对方的输入状态")
+	paddingName := flag.String("pad", crypto.PaddingPadme.Name, "消息填充方案，用于向服务器隐藏消息长度，可选 "+paddingNames(crypto.Paddings()))
 	flag.Parse()
-	if id == "" || address == "" {
+	flag.Visit(func(f *flag.Flag) {
+		dataDirSet = dataDirSet || f.Name == "d"
+	})
+	if id == "" || address == "" || (noisePattern != "" && noisePattern != "xx" && noisePattern != "ik") {
+		flag.Usage()
+		return
+	}
+	var ok bool
+	if cipherSuites, ok = parseCipherSuites(*suites); !ok {
+		flag.Usage()
+		return
+	}
+	if padding, ok = crypto.PaddingByName(*paddingName); !ok {
+		flag.Usage()
+		return
+	}
+	if keyExchanges, ok = parseKeyExchanges(*kexes); !ok || (noisePattern != "" && !containsKeyExchange(keyExchanges, crypto.X25519)) {
 		flag.Usage()
 		return
 	}
@@ -77,7 +134,93 @@ func main() {
 	tui.Start()
 }
 
+// parseCipherSuites 解析 -c 参数，为空时使用全部算法
+func parseCipherSuites(names string) ([]*crypto.CipherSuite, bool) {
+	if names == "" {
+		return crypto.CipherSuites(), true
+	}
+	var suites []*crypto.CipherSuite
+	for _, name := range strings.Split(names, ",") {
+		s, ok := crypto.CipherSuiteByName(strings.TrimSpace(name))
+		if !ok {
+			return nil, false
+		}
+		suites = append(suites, s)
+	}
+	return suites, true
+}
+
+func cipherSuiteNames(suites []*crypto.CipherSuite) string {
+	names := make([]string, len(suites))
+	for i, s := range suites {
+		names[i] = s.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// parseKeyExchanges 解析 -k 参数，为空时使用默认算法
+func parseKeyExchanges(names string) ([]*crypto.KeyExchange, bool) {
+	if names == "" {
+		return crypto.DefaultKeyExchanges(), true
+	}
+	var kexes []*crypto.KeyExchange
+	for _, name := range strings.Split(names, ",") {
+		k, ok := crypto.KeyExchangeByName(strings.TrimSpace(name))
+		if !ok {
+			return nil, false
+		}
+		kexes = append(kexes, k)
+	}
+	return kexes, true
+}
+
+func keyExchangeNames(kexes []*crypto.KeyExchange) string {
+	names := make([]string, len(kexes))
+	for i, k := range kexes {
+		names[i] = k.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func paddingNames(paddings []*crypto.Padding) string {
+	names := make([]string, len(paddings))
+	for i, p := range paddings {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func containsKeyExchange(kexes []*crypto.KeyExchange, kex *crypto.KeyExchange) bool {
+	for _, k := range kexes {
+		if k == kex {
+			return true
+		}
+	}
+	return false
+}
+
 func Connect() {
+	var err error
+
+	if err := unlockKeystore(); err != nil {
+		log.Errorf("解锁 keystore 失败: %s", err)
+		return
+	}
+
+	// 加载身份密钥
+	identity, err = loadIdentity(dataDir)
+	if err != nil {
+		log.Errorf("加载身份密钥错误: %s", err)
+		return
+	}
+	log.Infof("本机身份指纹: %s", formatFingerprint(crypto.Fingerprint(identity.PublicKey)))
+
+	var passphrase []byte
+	if usePassphrase {
+		passphrase = readHiddenInput("请输入与对方约定的口令 (输入的内容不会显示):")
+		tui.StopInput()
+	}
+
 	// 开始连接服务器
 	log.Info("正在连接服务器...")
 	tcp, err := net.DialTimeout("tcp", address, 30*time.Second)
@@ -95,111 +238,155 @@ func Connect() {
 	conn = transfer.NewTransfer(tcp)
 	go func() {
 		conn.WaitClose()
+		close(closed)
 		tui.StopInput()
+		if err := conn.Err(); err != nil {
+			log.Errorf("收到不合法的数据: %s，已和服务器断开连接", transfer.FrameErrorText(err))
+			return
+		}
 		log.Info("已和服务器断开连接")
 	}()
 
 	// 发送握手包
-	conn.Send(message.NewMessage(message.MTypeHandShake, cid[:]))
+	localHandshake := message.NewHandshake(cid, localCapabilities())
+	conn.Send(localHandshake.Message())
 
 	log.Info("等待对方连接...")
 
-	// 接收握手包
+	// 接收服务器转发的对方握手包
 	hsMessage := conn.Receive()
+	if hsMessage.MType == message.MTypeClose {
+		log.Errorf("握手失败: %s", closeError(hsMessage))
+		conn.Close()
+		return
+	}
 	if hsMessage.MType != message.MTypeHandShake {
 		log.Errorf("握手失败: 未知的握手包 %v", hsMessage)
 		return
 	}
-
-	log.Info("对方已连接")
-
-	log.Info("正在协商密钥...")
-
-	ecdh := crypto.NewCurve25519ECDH()
-	privateKey, publicKey, err := ecdh.GenerateKey()
-	publicKeyData := ecdh.Marshal(publicKey)
-
-	log.Infof("向对方发送公钥: %x", publicKeyData)
-	// 发送公钥
-	conn.Send(message.NewMessage(message.MTypeSecret, publicKeyData))
-
-	// 接收公钥
-	pkMessage := conn.Receive()
-	if pkMessage.MType != message.MTypeSecret {
-		log.Errorf("协商密钥失败: 未知消息%v", pkMessage)
+	remoteHandshake, err := message.ParseHandshake(hsMessage.Content)
+	if err != nil {
+		log.Error("握手失败: 对方的握手包格式错误")
+		conn.Close()
 		return
 	}
 
-	// 解码公钥
-	receivePublicKey, ok := ecdh.Unmarshal(pkMessage.Content)
-	if !ok {
-		log.Errorf("协商密钥失败，解码对方公钥错误: %s", err)
-		log.Debugf("接收到对方公钥数据: %x", pkMessage.Content)
+	log.Info("对方已连接")
+
+	protocolVersion, peerCapabilities, err = message.Negotiate(localHandshake, remoteHandshake)
+	if err != nil {
+		reason := versionError(localHandshake, remoteHandshake, err)
+		log.Errorf("握手失败: %s", reason)
+		conn.SendAndClose(message.NewMessage(message.MTypeClose, []byte(reason)))
 		return
 	}
+	log.Debugf("协议版本: %d，双方都支持的功能: %s", protocolVersion, peerCapabilities)
 
-	log.Infof("接收到对方公钥: %x", pkMessage.Content)
+	log.Info("正在协商密钥...")
 
-	// 生成密钥
-	secret, err = ecdh.GenerateSharedSecret(privateKey, receivePublicKey)
+	result, err := negotiate(conn, identity, localHandshake, remoteHandshake, noisePattern, passphrase, cipherSuites, keyExchanges, rand.Reader)
+	zero(passphrase)
 	if err != nil {
-		log.Errorf("协商密钥失败，生成对称加密密钥错误: %s", err)
+		log.Errorf("协商密钥失败: %s", err)
+		conn.Close()
 		return
 	}
 
-	log.Infof("协商密钥已成功: %x", secret)
-	log.Infof("与对方的密钥一致时才能确认加密过程安全")
+	peerFingerprint := crypto.Fingerprint(result.peerIdentity)
+	log.Infof("对方身份指纹: %s", formatFingerprint(peerFingerprint))
+	if err := checkPeer(peerFingerprint, result.peerStaticKey); err != nil {
+		log.Errorf("验证对方身份失败: %s", err)
+		conn.Close()
+		return
+	}
+	restoreSession(peerFingerprint)
+	sess = newSession(conn, cid, result, padding)
+	activeChat = newChat(sess, peerCapabilities, tuiView{})
+	go sess.rekeyLoop(closed)
+	safetyNumber = crypto.SafetyNumber(result.transcript)
+
+	log.Info("协商密钥已成功，双方已确认密钥一致")
+	log.Infof("本次会话的安全码: %s", safetyNumber)
+	log.Info("与对方核对安全码一致后输入 /verify <对方的安全码> 标记会话已验证")
+	log.Infof("加密算法: %s", result.suite.Name)
+	log.Infof("密钥交换: %s", result.kex.Name)
+	updateStatus()
 
 	// 开始互相传输数据
 	tui.StartInput()
 
 	go func() {
 		for {
-			for i := range tuiInputCh {
-				t := make([]byte, len(sendMessagePrefix)+len(i))
-				copy(t[:len(sendMessagePrefix)], sendMessagePrefix)
-				copy(t[len(sendMessagePrefix):], i)
-				tuiOutputCh <- t
-				Send(i)
+			for input := range tuiInputCh {
+				i := input.Text
+				if isCommand(i) {
+					handleCommand(i, input.Selected)
+					continue
+				}
+				if len(i) > 1 && i[0] == '/' {
+					i = i[1:]
+				}
+				Send(i, input.Selected)
 			}
 		}
 	}()
 
+	go activeChat.readReceiptLoop(closed)
+	go activeChat.typingLoop(closed)
+
 	go func() {
 		for {
 			data := Receive()
 			if data != nil {
-				t := make([]byte, len(receiveMessagePrefix)+len(data))
-				copy(t[:len(receiveMessagePrefix)], receiveMessagePrefix)
-				copy(t[len(receiveMessagePrefix):], data)
-				tuiOutputCh <- t
+				activeChat.handlePayload(data)
 			}
 		}
 	}()
 }
 
-func Send(data []byte) {
-	content, err := crypto.Encrypt(data, secret)
-	if err != nil {
+// versionError 返回协议版本不兼容的原因，这段文字也会发送给对方
+func versionError(local *message.Handshake, remote *message.Handshake, err error) string {
+	if err == message.ErrMissingCapabilities {
+		missing := message.RequiredCapabilities &^ (local.Capabilities & remote.Capabilities)
+		return fmt.Sprintf("客户端不兼容，缺少必需的功能: %s，请双方都升级到最新版本", missing)
+	}
+	older := local.Version
+	if remote.Version < older {
+		older = remote.Version
+	}
+	return fmt.Sprintf("客户端协议版本不兼容 (v%d 与 v%d)，使用 v%d 的一方需要升级客户端", local.Version, remote.Version, older)
+}
+
+// Send 发送聊天文字，selected 是发送时选中的消息，不为空时作为对它的回复发送
+func Send(data []byte, selected string) {
+	err := activeChat.sendText(data, replyTarget(selected))
+	if err == errMessageTooLarge {
+		log.Warn(err)
+	} else if err != nil {
 		log.Warnf("加密消息失败: %v", err)
-		return
 	}
-	conn.Send(message.NewMessage(message.MTypeData, content))
 }
 
 func Receive() []byte {
 	m := conn.Receive()
 	if m.MType == message.MTypeClose {
 		conn.Close()
-		log.Info("对方已关闭连接")
+		log.Info(closeError(m))
 		return nil
 	}
-	if m.MType != message.MTypeData {
+	if m.MType != message.MTypeData && m.MType != message.MTypeSecret {
+		return nil
+	}
+	content, err := sess.Open(m)
+	if err == errReplay {
+		log.Warn(err)
 		return nil
 	}
-	content, err := crypto.Decrypt(m.Content, secret)
 	if err != nil {
 		log.Warnf("解密消息失败: %v", err)
+		if sequence, ok := sess.UndeliveredSequence(m); ok && m.MType == message.MTypeData {
+			activeChat.sendDecryptFailed(sequence)
+		}
 		return nil
 	}
 
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"terminal-encrypt-chat/crypto"
+	"terminal-encrypt-chat/qr"
+	"terminal-encrypt-chat/tui"
+)
+
+var (
+	safetyNumber string
+	verified     bool
+	// peerSession 是与对方的会话状态，验证安全码后保存到 keystore
+	peerSession *sessionState
+)
+
+// isCommand 判断输入是否为命令，以 "//" 开头的输入作为普通消息发送
+func isCommand(input []byte) bool {
+	return len(input) > 0 && input[0] == '/' && !(len(input) > 1 && input[1] == '/')
+}
+
+// handleCommand 执行命令，selected 是输入命令时选中的消息 id
+func handleCommand(input []byte, selected string) {
+	fields := strings.Fields(string(input))
+	if len(fields) == 0 {
+		return
+	}
+
+	switch fields[0] {
+	case "/help":
+		log.Info("/verify            显示本次会话的安全码")
+		log.Info("/verify <安全码>   与对方的安全码比对，一致时标记会话已验证")
+		log.Info("/edit <文字>       修改选中的或最后一条自己发送的消息，使用上下方向键选中消息")
+		log.Info("/delete            删除选中的或最后一条自己发送的消息")
+		log.Info("/rekey             立即更新会话密钥")
+		log.Info("/qr                以二维码显示本机身份指纹和本次会话的安全码，可用手机扫描核对")
+		log.Info("/passwd            修改 keystore 口令，没有 keystore 时创建一个并导入身份密钥和 known_peers")
+		log.Info("/wipe              销毁 keystore")
+	case "/verify":
+		verify(strings.Join(fields[1:], " "))
+	case "/edit":
+		activeChat.editMessage(bytes.TrimSpace(input[len("/edit"):]), selected)
+	case "/delete":
+		activeChat.deleteMessage(selected)
+	case "/rekey":
+		sess.Rekey()
+	case "/qr":
+		showQR()
+	case "/passwd":
+		changePassphrase()
+	case "/wipe":
+		wipeKeystore()
+	default:
+		log.Warnf("未知命令: %s，输入 /help 查看可用命令", fields[0])
+	}
+}
+
+func verify(code string) {
+	if code == "" {
+		if verified {
+			log.Info("本次会话已验证")
+		}
+		log.Infof("本次会话的安全码: %s", safetyNumber)
+		log.Info("请通过电话等方式与对方核对，然后输入 /verify <对方的安全码>")
+		return
+	}
+
+	if !crypto.SafetyNumberEqual(code, safetyNumber) {
+		log.Errorf("安全码不一致，会话可能正被中间人攻击!")
+		return
+	}
+
+	verified = true
+	peerSession.Verified = true
+	saveSessionState(peerSession)
+	updateStatus()
+	log.Info("安全码一致，会话已验证")
+}
+
+// updateStatus 在分隔线上显示会话是否已验证和使用的加密算法、密钥交换算法
+func updateStatus() {
+	status := "未验证"
+	if verified {
+		status = "已验证"
+	}
+	tui.SetStatus(status + " | " + sess.suite.Name + " | " + sess.kex.Name)
+}
+
+// showQR 把本机身份指纹和安全码编码成二维码显示在消息区
+func showQR() {
+	text := "fingerprint: " + crypto.Fingerprint(identity.PublicKey) + "\nsafety number: " + safetyNumber
+	code, err := qr.Encode([]byte(text), qr.M)
+	if err != nil {
+		log.Errorf("生成二维码失败: %s", err)
+		return
+	}
+	tui.ShowBlock(code.HalfBlocks())
+	log.Info("二维码包含本机身份指纹和本次会话的安全码，窗口太小时二维码显示不全，请放大窗口")
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ed25519"
+	"io"
+	"terminal-encrypt-chat/crypto"
+	"terminal-encrypt-chat/message"
+)
+
+const (
+	handshakeSigned = 1
+	handshakeNoise  = 2
+
+	// helloPAKE 表示使用口令认证
+	helloPAKE = 1
+
+	helloNonceSize = 32
+)
+
+// handshakeConn 是握手和会话使用的连接，Send 在帧超过长度限制时返回错误，不会断开连接。
+// 握手中的帧都很短，不检查 Send 的错误
+type handshakeConn interface {
+	Send(*message.Message) error
+	Receive() *message.Message
+}
+
+// keyExchange 是通过 MTypeSecret 发送的公钥包:
+// 身份公钥(32) + 签名(64) + 密钥交换算法编号(1) + 临时公钥，
+// 临时公钥的长度由算法决定，签名覆盖算法编号和临时公钥
+type keyExchange struct {
+	identity  ed25519.PublicKey
+	signature []byte
+	kex       byte
+	publicKey []byte
+}
+
+func (k *keyExchange) Marshal() []byte {
+	buf := make([]byte, 0, ed25519.PublicKeySize+ed25519.SignatureSize+1+len(k.publicKey))
+	buf = append(buf, k.identity...)
+	buf = append(buf, k.signature...)
+	return append(buf, k.signedData()...)
+}
+
+// signedData 是签名覆盖的内容: 算法编号 + 临时公钥
+func (k *keyExchange) signedData() []byte {
+	return append([]byte{k.kex}, k.publicKey...)
+}
+
+func unmarshalKeyExchange(data []byte) (*keyExchange, error) {
+	if len(data) <= ed25519.PublicKeySize+ed25519.SignatureSize+1 {
+		return nil, errors.New("公钥包长度错误")
+	}
+	return &keyExchange{
+		identity:  ed25519.PublicKey(data[:ed25519.PublicKeySize]),
+		signature: data[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize],
+		kex:       data[ed25519.PublicKeySize+ed25519.SignatureSize],
+		publicKey: data[ed25519.PublicKeySize+ed25519.SignatureSize+1:],
+	}, nil
+}
+
+type handshakeResult struct {
+	peerIdentity ed25519.PublicKey
+	// peerStaticKey 是对方的 Noise 静态公钥，只在 Noise 握手后存在
+	peerStaticKey []byte
+	kex           *crypto.KeyExchange
+	ecdh          crypto.ECDH
+	suite         *crypto.CipherSuite
+	keys          *crypto.SessionKeys
+	ratchet       *crypto.Ratchet
+	transcript    []byte
+}
+
+// hello 在握手前互相发送: 握手方式(1) + 选项(1) + 随机数(32) + 支持的加密算法数(1) + 加密算法编号 +
+// 支持的密钥交换算法数(1) + 密钥交换算法编号 + 协议版本(1) + 能力位图(4)，
+// 用于确认双方使用同一种握手方式和协商算法，随机数用于决定 Noise 握手的发起方。
+// 协议版本和能力位图与握手包中的相同，hello 混入会话密钥，服务器修改握手包降级协议时密钥确认会失败
+type hello struct {
+	mode    byte
+	flags   byte
+	nonce   []byte
+	suites  []byte
+	kexes   []byte
+	version byte
+	caps    message.Capabilities
+	raw     []byte
+}
+
+func newHello(rand io.Reader, mode byte, flags byte, suites []*crypto.CipherSuite, kexes []*crypto.KeyExchange, hs *message.Handshake) (*hello, error) {
+	h := &hello{mode: mode, flags: flags, nonce: make([]byte, helloNonceSize), version: hs.Version, caps: hs.Capabilities}
+	if _, err := io.ReadFull(rand, h.nonce); err != nil {
+		return nil, err
+	}
+	for _, s := range suites {
+		h.suites = append(h.suites, s.ID)
+	}
+	for _, k := range kexes {
+		h.kexes = append(h.kexes, k.ID)
+	}
+
+	h.raw = append([]byte{mode, flags}, h.nonce...)
+	h.raw = append(h.raw, byte(len(h.suites)))
+	h.raw = append(h.raw, h.suites...)
+	h.raw = append(h.raw, byte(len(h.kexes)))
+	h.raw = append(h.raw, h.kexes...)
+	var caps [4]byte
+	binary.BigEndian.PutUint32(caps[:], uint32(h.caps))
+	h.raw = append(h.raw, h.version)
+	h.raw = append(h.raw, caps[:]...)
+	return h, nil
+}
+
+func unmarshalHello(data []byte) (*hello, error) {
+	offset := 2 + helloNonceSize
+	if len(data) < offset+1 || len(data) < offset+1+int(data[offset])+1 {
+		return nil, errors.New("hello 长度错误")
+	}
+	nSuites := int(data[offset])
+	kexOffset := offset + 1 + nSuites
+	versionOffset := kexOffset + 1 + int(data[kexOffset])
+	if len(data) != versionOffset+5 {
+		return nil, errors.New("hello 长度错误")
+	}
+	return &hello{
+		mode:    data[0],
+		flags:   data[1],
+		nonce:   data[2:offset],
+		suites:  data[offset+1 : kexOffset],
+		kexes:   data[kexOffset+1 : versionOffset],
+		version: data[versionOffset],
+		caps:    message.Capabilities(binary.BigEndian.Uint32(data[versionOffset+1:])),
+		raw:     data,
+	}, nil
+}
+
+// handshakeContext 是交换 hello 后双方协商好的参数
+type handshakeContext struct {
+	chatID []byte
+	local  *hello
+	remote *hello
+	suite  *crypto.CipherSuite
+	kex    *crypto.KeyExchange
+	// rand 是握手中生成临时密钥使用的随机数来源
+	rand io.Reader
+	// psk 是 PAKE 得到的共享密钥，没有使用口令时为 nil
+	psk []byte
+}
+
+// binding 是聊天 ID 和双方 hello 的记录，混入会话密钥的推导，
+// 协商过程被篡改时双方会得到不同的密钥
+func (c *handshakeContext) binding() []byte {
+	return handshakeTranscript(c.chatID, c.local.raw, c.remote.raw)
+}
+
+// exchangeHello 互相发送 hello，确认双方使用同一种握手方式并协商加密算法和密钥交换算法，
+// remoteHandshake 是服务器转发的对方握手包
+func exchangeHello(conn handshakeConn, chatID []byte, local *hello, remoteHandshake *message.Handshake) (*handshakeContext, error) {
+	conn.Send(message.NewMessage(message.MTypeSecret, local.raw))
+
+	m := conn.Receive()
+	if m.MType == message.MTypeClose {
+		return nil, closeError(m)
+	}
+	if m.MType != message.MTypeSecret {
+		return nil, fmt.Errorf("未知消息 %v", m)
+	}
+	remote, err := unmarshalHello(m.Content)
+	if err != nil {
+		return nil, err
+	}
+	if remote.version != remoteHandshake.Version || remote.caps != remoteHandshake.Capabilities {
+		return nil, errors.New("对方 hello 中的协议版本与握手包不一致，连接可能被篡改")
+	}
+	if remote.mode != local.mode {
+		if local.mode == handshakeNoise {
+			return nil, errors.New("对方没有使用 Noise 握手，双方需要使用相同的 -n 参数")
+		}
+		return nil, errors.New("对方使用了 Noise 握手，双方需要使用相同的 -n 参数")
+	}
+	if remote.flags&helloPAKE != local.flags&helloPAKE {
+		if local.flags&helloPAKE != 0 {
+			return nil, errors.New("对方没有使用口令认证，双方都需要使用 -p 参数")
+		}
+		return nil, errors.New("对方使用了口令认证，双方都需要使用 -p 参数")
+	}
+	if bytes.Equal(local.nonce, remote.nonce) {
+		return nil, errors.New("收到的是本机自己的 hello，连接可能被篡改")
+	}
+
+	suite, err := crypto.NegotiateCipherSuite(local.suites, remote.suites)
+	if err != nil {
+		return nil, errors.New("没有双方都支持的加密算法，请检查双方的 -c 参数")
+	}
+	kex, err := crypto.NegotiateKeyExchange(local.kexes, remote.kexes)
+	if err != nil {
+		return nil, errors.New("没有双方都支持的密钥交换算法，请检查双方的 -k 参数")
+	}
+	return &handshakeContext{chatID: chatID, local: local, remote: remote, suite: suite, kex: kex}, nil
+}
+
+// negotiate 交换 hello 后按 pattern 选择握手方式，pattern 为空时使用签名的临时公钥交换。
+// Noise 握手只支持 X25519，调用方需要保证 kexes 中包含 X25519。
+// 提供口令时先做 PAKE，得到的密钥混入会话密钥。
+// localHandshake 和 remoteHandshake 是双方通过服务器交换的握手包，调用方已经用 message.Negotiate 检查过版本。
+// 随机数都从 rand 读取，正常运行时为 crypto/rand.Reader
+func negotiate(conn handshakeConn, identity *crypto.Identity, localHandshake *message.Handshake, remoteHandshake *message.Handshake, pattern string, passphrase []byte, suites []*crypto.CipherSuite, kexes []*crypto.KeyExchange, rand io.Reader) (*handshakeResult, error) {
+	chatID := localHandshake.ChatID
+	mode := byte(handshakeSigned)
+	if pattern != "" {
+		if remoteHandshake.Capabilities&message.CapNoise == 0 {
+			return nil, errors.New("对方客户端不支持 Noise 握手，请去掉 -n 参数")
+		}
+		mode = handshakeNoise
+		kexes = []*crypto.KeyExchange{crypto.X25519}
+	}
+	var flags byte
+	if passphrase != nil {
+		if remoteHandshake.Capabilities&message.CapPAKE == 0 {
+			return nil, errors.New("对方客户端不支持口令认证，请去掉 -p 参数")
+		}
+		flags |= helloPAKE
+	}
+	local, err := newHello(rand, mode, flags, suites, kexes, localHandshake)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := exchangeHello(conn, chatID, local, remoteHandshake)
+	if err != nil {
+		return nil, err
+	}
+	ctx.rand = rand
+
+	if passphrase != nil {
+		if ctx.psk, err = pake(conn, ctx, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	var result *handshakeResult
+	if mode == handshakeNoise {
+		result, err = noiseHandshake(conn, identity, pattern, ctx)
+	} else {
+		result, err = handshake(conn, identity, ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := confirmKeys(conn, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// confirmKeys 互相发送对握手记录的密钥确认 MAC，双方都验证通过才算建立会话，
+// 避免密钥不一致时要等到第一条消息解密失败才发现
+func confirmKeys(conn handshakeConn, result *handshakeResult) error {
+	conn.Send(message.NewMessage(message.MTypeSecret, result.keys.KeyConfirmation(result.transcript)))
+
+	m := conn.Receive()
+	if m.MType != message.MTypeSecret {
+		// 对方确认失败后会断开连接
+		return errors.New("对方密钥确认失败，双方的会话密钥不一致")
+	}
+	switch result.keys.VerifyKeyConfirmation(result.transcript, m.Content) {
+	case nil:
+		return nil
+	case crypto.ErrKeyMismatch:
+		return errors.New("密钥确认失败，双方的会话密钥不一致，连接可能被篡改")
+	case crypto.ErrTranscriptMismatch:
+		return errors.New("密钥确认失败，双方的握手记录不一致，握手消息可能被篡改")
+	}
+	return errors.New("密钥确认消息格式错误")
+}
+
+// closeError 把握手过程中收到的 MTypeClose 转换成错误，内容是对方或服务器给出的原因
+func closeError(m *message.Message) error {
+	if len(m.Content) == 0 {
+		return errors.New("对方已关闭连接")
+	}
+	return fmt.Errorf("对方已关闭连接: %s", m.Content)
+}
+
+// publicKeyError 把 ECDH 对公钥的校验错误转换成提示，对方发送小阶点说明有人在篡改连接
+func publicKeyError(err error) error {
+	switch err {
+	case crypto.ErrInvalidPublicKey:
+		return errors.New("对方公钥格式错误")
+	case crypto.ErrLowOrderPoint, crypto.ErrZeroSharedSecret:
+		return errors.New("对方发送了小阶点公钥，共享密钥将是可预测的固定值，连接可能被篡改")
+	}
+	return fmt.Errorf("生成对称加密密钥错误: %s", err)
+}
+
+// handshakeTranscript 按固定顺序拼接双方的公钥包，保证双方得到相同的握手记录
+func handshakeTranscript(chatID []byte, local []byte, remote []byte) []byte {
+	if bytes.Compare(local, remote) > 0 {
+		local, remote = remote, local
+	}
+	var transcript []byte
+	for _, part := range [][]byte{chatID, local, remote} {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(part)))
+		transcript = append(transcript, length[:]...)
+		transcript = append(transcript, part...)
+	}
+	return transcript
+}
+
+// handshake 交换经身份密钥签名的临时公钥，验证对方签名后才生成共享密钥
+func handshake(conn handshakeConn, identity *crypto.Identity, ctx *handshakeContext) (*handshakeResult, error) {
+	chatID := ctx.chatID
+	ecdh := ctx.kex.NewECDH(ctx.rand)
+	privateKey, publicKey, err := ecdh.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("生成临时密钥错误: %s", err)
+	}
+	publicKeyData := ecdh.Marshal(publicKey)
+
+	local := &keyExchange{
+		identity:  identity.PublicKey,
+		kex:       ctx.kex.ID,
+		publicKey: publicKeyData,
+	}
+	local.signature = identity.SignKeyExchange(chatID, local.signedData())
+	localData := local.Marshal()
+	conn.Send(message.NewMessage(message.MTypeSecret, localData))
+
+	m := conn.Receive()
+	if m.MType != message.MTypeSecret {
+		return nil, fmt.Errorf("未知消息 %v", m)
+	}
+	remote, err := unmarshalKeyExchange(m.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(remote.publicKey, publicKeyData) {
+		return nil, errors.New("收到的是本机自己的公钥，连接可能被篡改")
+	}
+	if !crypto.VerifyKeyExchange(remote.identity, chatID, remote.signedData(), remote.signature) {
+		return nil, errors.New("对方公钥签名验证失败，连接可能被篡改")
+	}
+	if remote.kex != ctx.kex.ID {
+		return nil, errors.New("对方使用的密钥交换算法与协商结果不一致，连接可能被篡改")
+	}
+
+	remotePublicKey, err := ecdh.Unmarshal(remote.publicKey)
+	if err != nil {
+		return nil, publicKeyError(err)
+	}
+
+	secret, err := ecdh.GenerateSharedSecret(privateKey, remotePublicKey)
+	if err != nil {
+		return nil, publicKeyError(err)
+	}
+
+	keys, err := crypto.DeriveSessionKeysWithPSK(secret, ctx.psk, publicKeyData, remote.publicKey, ctx.binding())
+	if err != nil {
+		return nil, fmt.Errorf("推导会话密钥错误: %s", err)
+	}
+
+	ratchet, err := crypto.NewRatchet(ecdh, ctx.suite, keys, privateKey, publicKey, remotePublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("初始化 Double Ratchet 错误: %s", err)
+	}
+
+	return &handshakeResult{
+		peerIdentity: remote.identity,
+		kex:          ctx.kex,
+		ecdh:         ecdh,
+		suite:        ctx.suite,
+		keys:         keys,
+		ratchet:      ratchet,
+		transcript:   handshakeTranscript(ctx.binding(), localData, m.Content),
+	}, nil
+}
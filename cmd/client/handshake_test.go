@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"terminal-encrypt-chat/crypto"
+	"terminal-encrypt-chat/message"
+)
+
+var update = flag.Bool("update", false, "重新生成 testdata 中的握手记录")
+
+// lockstepConn 是内存中的 handshakeConn。双方轮流运行，一方只在等待消息时把执行权交给另一方，
+// 这样双方从共用的随机数来源读取随机数的顺序是固定的，握手过程可以完全复现
+type lockstepConn struct {
+	name string
+	in   chan *message.Message
+	peer *lockstepConn
+	turn chan struct{}
+	// finished 表示这一方已经结束握手，对方再等待消息时会收到 MTypeClose
+	finished bool
+	// log 是双方共用的消息记录，只有持有执行权的一方会写入
+	log *bytes.Buffer
+}
+
+func newLockstepPair() (*lockstepConn, *lockstepConn) {
+	log := &bytes.Buffer{}
+	a := &lockstepConn{name: "A", in: make(chan *message.Message, 16), turn: make(chan struct{}, 1), log: log}
+	b := &lockstepConn{name: "B", in: make(chan *message.Message, 16), turn: make(chan struct{}, 1), log: log}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *lockstepConn) Send(m *message.Message) error {
+	fmt.Fprintf(c.log, "%s -> %s %c %s\n", c.name, c.peer.name, m.MType, hex.EncodeToString(m.Content))
+	c.peer.in <- message.NewMessage(m.MType, append([]byte{}, m.Content...))
+	return nil
+}
+
+func (c *lockstepConn) Receive() *message.Message {
+	for len(c.in) == 0 {
+		if c.peer.finished {
+			return message.NewMessage(message.MTypeClose, []byte("对方已断开"))
+		}
+		c.yield()
+	}
+	return <-c.in
+}
+
+// yield 把执行权交给对方，等对方交回后继续
+func (c *lockstepConn) yield() {
+	c.peer.turn <- struct{}{}
+	<-c.turn
+}
+
+type negotiateParams struct {
+	pattern    string
+	passphrase []byte
+	suites     []*crypto.CipherSuite
+	kexes      []*crypto.KeyExchange
+	// tamperedCaps 不为 0 时，A 收到的对方握手包中的能力位图被替换，模拟服务器降级协议
+	tamperedCaps message.Capabilities
+}
+
+// runHandshake 用固定的身份密钥和随机数来源运行一次完整的握手，返回线上的消息记录和双方的结果
+func runHandshake(t *testing.T, params negotiateParams) (string, *handshakeResult, *handshakeResult) {
+	wire, results, errs := runNegotiate(t, params)
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal("Handshake failed: ", err)
+		}
+	}
+	return wire, results[0], results[1]
+}
+
+func runNegotiate(t *testing.T, params negotiateParams) (string, []*handshakeResult, []error) {
+	rand := crypto.NewDeterministicRand([]byte("handshake golden test"))
+	chatID := []byte("golden")
+	handshake := message.NewHandshake(chatID, capabilities)
+	remoteHandshakes := []*message.Handshake{handshake, handshake}
+	if params.tamperedCaps != 0 {
+		remoteHandshakes[0] = message.NewHandshake(chatID, params.tamperedCaps)
+	}
+	connA, connB := newLockstepPair()
+	results := make([]*handshakeResult, 2)
+	errs := make([]error, 2)
+	done := make(chan struct{}, 2)
+	run := func(i int, conn *lockstepConn, seed byte) {
+		<-conn.turn
+		identity, err := crypto.UnmarshalIdentity(bytes.Repeat([]byte{seed}, 32))
+		if err == nil {
+			results[i], errs[i] = negotiate(conn, identity, handshake, remoteHandshakes[i], params.pattern, params.passphrase, params.suites, params.kexes, rand)
+		} else {
+			errs[i] = err
+		}
+		// 结束后把执行权交给对方，让对方读完剩下的消息
+		conn.finished = true
+		conn.peer.turn <- struct{}{}
+		done <- struct{}{}
+	}
+	go run(0, connA, 'A')
+	go run(1, connB, 'B')
+	connA.turn <- struct{}{}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Handshake did not finish")
+		}
+	}
+	return connA.log.String(), results, errs
+}
+
+func TestNegotiateGolden(t *testing.T) {
+	cases := []struct {
+		name   string
+		params negotiateParams
+	}{
+		{"signed", negotiateParams{suites: crypto.CipherSuites(), kexes: crypto.KeyExchanges()}},
+		{"signed_p256_aes", negotiateParams{
+			suites: []*crypto.CipherSuite{crypto.AES256GCM},
+			kexes:  []*crypto.KeyExchange{crypto.P256},
+		}},
+		{"signed_x448_pake", negotiateParams{
+			passphrase: []byte("correct horse battery staple"),
+			suites:     crypto.CipherSuites(),
+			kexes:      []*crypto.KeyExchange{crypto.X448},
+		}},
+		{"noise_xx", negotiateParams{pattern: "xx", suites: crypto.CipherSuites(), kexes: crypto.KeyExchanges()}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wire, a, b := runHandshake(t, c.params)
+			safetyA, safetyB := crypto.SafetyNumber(a.transcript), crypto.SafetyNumber(b.transcript)
+			if safetyA != safetyB {
+				t.Fatal("Safety numbers mismatch")
+			}
+			got := fmt.Sprintf("%ssuite: %s\nkex: %s\nsafety number: %s\n", wire, a.suite.Name, a.kex.Name, safetyA)
+
+			again, _, _ := runHandshake(t, c.params)
+			if again != wire {
+				t.Fatal("Handshake is not reproducible with the same random source")
+			}
+
+			path := filepath.Join("testdata", "handshake_"+c.name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(expected) {
+				t.Fatalf("Handshake differs from %s, run go test -update if the change is intended:\n%s", path, got)
+			}
+		})
+	}
+}
+
+// TestNegotiateDowngrade 模拟服务器修改转发的握手包，去掉对方支持的功能
+func TestNegotiateDowngrade(t *testing.T) {
+	_, _, errs := runNegotiate(t, negotiateParams{
+		suites:       crypto.CipherSuites(),
+		kexes:        crypto.KeyExchanges(),
+		tamperedCaps: message.RequiredCapabilities,
+	})
+	if errs[0] == nil || errs[1] == nil {
+		t.Fatal("Tampered handshake must be detected by both sides")
+	}
+	if !strings.Contains(errs[0].Error(), "协议版本") {
+		t.Fatal("Unexpected error: ", errs[0])
+	}
+}
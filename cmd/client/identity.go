@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"terminal-encrypt-chat/crypto"
+)
+
+const identityFile = "identity"
+
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".terminal-encrypt-chat"
+	}
+	return filepath.Join(home, ".terminal-encrypt-chat")
+}
+
+// loadIdentity 读取本机身份密钥，不存在时生成一个新的并保存。
+// 使用 keystore 时身份密钥保存在 keystore 中
+func loadIdentity(dir string) (*crypto.Identity, error) {
+	if store != nil {
+		return loadKeystoreIdentity()
+	}
+
+	path := filepath.Join(dir, identityFile)
+	seed, err := ioutil.ReadFile(path)
+	if err == nil {
+		return crypto.UnmarshalIdentity(seed)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	identity, err := crypto.GenerateIdentity(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, identity.Marshal(), 0600); err != nil {
+		return nil, err
+	}
+	log.Infof("已生成新的身份密钥: %s", path)
+	return identity, nil
+}
+
+func loadKeystoreIdentity() (*crypto.Identity, error) {
+	if seed := store.Identity(); seed != nil {
+		defer zero(seed)
+		return crypto.UnmarshalIdentity(seed)
+	}
+	identity, err := crypto.GenerateIdentity(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.SetIdentity(identity.Marshal()); err != nil {
+		return nil, err
+	}
+	log.Info("已生成新的身份密钥并保存到 keystore")
+	return identity, nil
+}
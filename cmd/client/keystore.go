@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"terminal-encrypt-chat/keystore"
+	"terminal-encrypt-chat/knownpeers"
+	"terminal-encrypt-chat/tui"
+)
+
+const (
+	keystoreFile = "keystore"
+	// configDirName 是系统配置目录中保存 keystore 的子目录
+	configDirName = "terminal-encrypt-chat"
+
+	// keystoreUnlockAttempts 是启动时输入口令的次数
+	keystoreUnlockAttempts = 3
+)
+
+// store 是解锁后的 keystore，没有使用 keystore 时为 nil，身份密钥和 known_peers 以明文文件保存
+var store *keystore.Keystore
+
+// keystorePath 返回 keystore 的路径，默认在系统配置目录(如 ~/.config/terminal-encrypt-chat)中。
+// 使用 -d 指定数据目录时放在数据目录中，不同的 -d 可以使用互相独立的身份；
+// 旧版本保存在默认数据目录中的 keystore 仍然使用原来的位置
+func keystorePath() string {
+	legacy := filepath.Join(dataDir, keystoreFile)
+	if dataDirSet {
+		return legacy
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return legacy
+	}
+	path := filepath.Join(dir, configDirName, keystoreFile)
+	if !keystore.Exists(path) && keystore.Exists(legacy) {
+		return legacy
+	}
+	return path
+}
+
+// readHiddenInput 提示并读取一行不回显的输入，读取后输入框保持隐藏，由调用方决定之后的输入状态
+func readHiddenInput(prompt string) []byte {
+	log.Info(prompt)
+	tui.StartHiddenInput()
+	return (<-tuiInputCh).Text
+}
+
+// unlockKeystore 在启动时解锁 keystore，不存在时直接返回
+func unlockKeystore() error {
+	path := keystorePath()
+	if !keystore.Exists(path) {
+		return nil
+	}
+	if err := keystore.CheckPermissions(path); err != nil {
+		return keystoreError(path, err)
+	}
+	defer tui.StopInput()
+	for i := 0; i < keystoreUnlockAttempts; i++ {
+		passphrase := readHiddenInput("请输入 keystore 口令 (输入的内容不会显示):")
+		s, err := keystore.Open(path, passphrase)
+		zero(passphrase)
+		switch err {
+		case nil:
+			store = s
+			log.Info("keystore 已解锁")
+			return nil
+		case keystore.ErrWrongPassphrase:
+			log.Warn("口令错误")
+			continue
+		}
+		return keystoreError(path, err)
+	}
+	return errors.New("口令错误次数过多")
+}
+
+// keystoreError 把权限错误转换成带修复方法的提示
+func keystoreError(path string, err error) error {
+	if err == keystore.ErrPermissions {
+		return errors.New(path + " 的权限过于开放，其他用户可以读取，请执行 chmod 600 " + path)
+	}
+	return err
+}
+
+// openKnownPeers 打开 known_peers，使用 keystore 时记录保存在 keystore 中
+func openKnownPeers() (*knownpeers.Store, error) {
+	if store != nil {
+		return knownpeers.Load(store.KnownPeers(), store.SetKnownPeers)
+	}
+	return knownpeers.Open(filepath.Join(dataDir, knownPeersFile))
+}
+
+// changePassphrase 修改 keystore 口令，还没有 keystore 时新建一个，
+// 并把明文保存的身份密钥和 known_peers 导入后删除明文文件
+func changePassphrase() {
+	defer tui.StartInput()
+	passphrase := readHiddenInput("请输入新的 keystore 口令 (输入的内容不会显示):")
+	defer zero(passphrase)
+	confirm := readHiddenInput("请再次输入新的口令:")
+	defer zero(confirm)
+	if len(passphrase) == 0 {
+		log.Warn("口令不能为空")
+		return
+	}
+	if !bytes.Equal(passphrase, confirm) {
+		log.Warn("两次输入的口令不一致")
+		return
+	}
+
+	if store != nil {
+		if err := store.ChangePassphrase(passphrase); err != nil {
+			log.Errorf("修改 keystore 口令失败: %s", err)
+			return
+		}
+		log.Info("keystore 口令已修改")
+		return
+	}
+
+	if err := createKeystore(passphrase); err != nil {
+		log.Errorf("创建 keystore 失败: %s", err)
+		return
+	}
+	log.Infof("已创建 keystore: %s，身份密钥和 known_peers 已导入，下次启动时需要输入口令", keystorePath())
+}
+
+func createKeystore(passphrase []byte) error {
+	s, err := keystore.Create(keystorePath(), passphrase)
+	if err != nil {
+		return err
+	}
+	if err := s.SetIdentity(identity.Marshal()); err != nil {
+		s.Wipe()
+		return err
+	}
+	peersPath := filepath.Join(dataDir, knownPeersFile)
+	peers, err := ioutil.ReadFile(peersPath)
+	if err != nil && !os.IsNotExist(err) {
+		s.Wipe()
+		return err
+	}
+	if err := s.SetKnownPeers(peers); err != nil {
+		s.Wipe()
+		return err
+	}
+
+	store = s
+	for _, path := range []string{filepath.Join(dataDir, identityFile), peersPath} {
+		if err := keystore.WipeFile(path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("删除 %s 失败: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// wipeKeystore 确认后销毁 keystore，之后再启动时会生成新的身份密钥
+func wipeKeystore() {
+	if store == nil {
+		log.Warn("没有使用 keystore，可以使用 /passwd 创建")
+		return
+	}
+	log.Warn("将销毁 keystore 中的身份密钥、known_peers 和保存的会话状态，且无法恢复，输入 yes 确认")
+	answer := <-tuiInputCh
+	if strings.TrimSpace(string(answer.Text)) != "yes" {
+		log.Info("已取消")
+		return
+	}
+	if err := store.Wipe(); err != nil {
+		log.Errorf("销毁 keystore 失败: %s", err)
+		return
+	}
+	store = nil
+	log.Warn("keystore 已销毁，当前会话结束后身份密钥将不再保留，下次启动时会生成新的身份密钥")
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
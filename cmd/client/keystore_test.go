@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"terminal-encrypt-chat/keystore"
+	"testing"
+)
+
+func TestKeystorePath(t *testing.T) {
+	root, err := ioutil.TempDir("", "keystore-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	oldConfig, oldDataDir, oldDataDirSet := os.Getenv("XDG_CONFIG_HOME"), dataDir, dataDirSet
+	defer func() {
+		os.Setenv("XDG_CONFIG_HOME", oldConfig)
+		dataDir, dataDirSet = oldDataDir, oldDataDirSet
+	}()
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "config"))
+	dataDir = filepath.Join(root, "data")
+
+	// 默认保存在系统配置目录中
+	dataDirSet = false
+	expected := filepath.Join(root, "config", configDirName, keystoreFile)
+	if path := keystorePath(); path != expected {
+		t.Fatalf("Expected %s, got %s", expected, path)
+	}
+
+	// 指定 -d 时保存在数据目录中
+	dataDirSet = true
+	legacy := filepath.Join(dataDir, keystoreFile)
+	if path := keystorePath(); path != legacy {
+		t.Fatalf("Expected %s with -d, got %s", legacy, path)
+	}
+
+	// 旧版本保存在默认数据目录中的 keystore 继续使用
+	dataDirSet = false
+	os.MkdirAll(dataDir, 0700)
+	ioutil.WriteFile(legacy, []byte("{}"), 0600)
+	if path := keystorePath(); path != legacy {
+		t.Fatalf("Expected existing keystore %s, got %s", legacy, path)
+	}
+}
+
+const (
+	fingerprintA = "e3e66a0a40d1ce4ba009e79e1b4884782799cda723fb48093d333d51281e0c28"
+	fingerprintB = "57657478203083155175e3e66a0a40d1ce4ba009e79e1b4884782799cda723fb"
+)
+
+// TestSessionState 核对过安全码后，同一身份密钥的对方再次连接时会话直接标记为已验证
+func TestSessionState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := keystore.Create(filepath.Join(dir, keystoreFile), []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore, oldID, oldAlias, oldVerified := store, id, alias, verified
+	defer func() {
+		store, id, alias, verified = oldStore, oldID, oldAlias, oldVerified
+	}()
+	store, id, alias = s, "room", ""
+
+	verified = false
+	restoreSession(fingerprintA)
+	if verified {
+		t.Fatal("New peer must not be verified")
+	}
+	peerSession.Verified = true
+	saveSessionState(peerSession)
+
+	verified = false
+	restoreSession(fingerprintA)
+	if !verified {
+		t.Fatal("Peer verified in an earlier session must be verified")
+	}
+
+	// 对方更换身份密钥后之前的核对不再有效
+	verified = false
+	restoreSession(fingerprintB)
+	if verified || peerSession.Fingerprint != fingerprintB {
+		t.Fatal("Changed fingerprint must reset the verification")
+	}
+	verified = false
+	restoreSession(fingerprintA)
+	if verified {
+		t.Fatal("Verification must not come back after the fingerprint changed")
+	}
+
+	// 以别名保存的状态与聊天 ID 互相独立
+	alias = "alice"
+	if _, ok := store.Session("room"); !ok {
+		t.Fatal("Session state must be saved under the chat ID")
+	}
+	if _, ok := store.Session("alice"); ok {
+		t.Fatal("Alias must not share the session state of the chat ID")
+	}
+}
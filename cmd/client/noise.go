@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+	"terminal-encrypt-chat/crypto"
+	"terminal-encrypt-chat/crypto/noise"
+	"terminal-encrypt-chat/message"
+)
+
+// Noise 握手第一条消息前附加的模式标记，响应方据此选择握手模式
+const (
+	noisePatternXX = 1
+	noisePatternIK = 2
+)
+
+var noiseHash = noise.BLAKE2s
+
+// noisePayload 是在 Noise 握手中加密发送的身份信息:
+// 身份公钥(32) + 身份密钥对静态公钥的签名(64)
+func noisePayload(identity *crypto.Identity, chatID []byte, staticKey []byte) []byte {
+	payload := make([]byte, 0, ed25519.PublicKeySize+ed25519.SignatureSize)
+	payload = append(payload, identity.PublicKey...)
+	return append(payload, identity.SignNoiseStaticKey(chatID, staticKey)...)
+}
+
+func verifyNoisePayload(payload []byte, chatID []byte, staticKey []byte) (ed25519.PublicKey, error) {
+	if len(payload) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, errors.New("身份信息长度错误")
+	}
+	peer := ed25519.PublicKey(payload[:ed25519.PublicKeySize])
+	if !crypto.VerifyNoiseStaticKey(peer, chatID, staticKey, payload[ed25519.PublicKeySize:]) {
+		return nil, errors.New("对方静态公钥签名验证失败，连接可能被篡改")
+	}
+	return peer, nil
+}
+
+// noiseHandshake 使用 Noise XX 或 IK 模式握手。hello 中随机数较大的一方为发起方，
+// 双方的 hello 作为 prologue 混入握手哈希。发起方选择 IK 时需要已经记录对方的静态公钥，
+// 否则退回 XX。身份公钥和签名只在加密后的握手消息中发送，不会暴露给服务器。
+//
+// 握手完成后由双方的传输密钥推导会话密钥，并用双方的临时密钥初始化 Double Ratchet，
+// 握手哈希作为计算安全码的握手记录。
+func noiseHandshake(conn handshakeConn, identity *crypto.Identity, pattern string, ctx *handshakeContext) (*handshakeResult, error) {
+	chatID := ctx.chatID
+	static, err := noise.GenerateKeypair(bytes.NewReader(identity.NoiseStaticKey()))
+	if err != nil {
+		return nil, fmt.Errorf("生成静态密钥错误: %s", err)
+	}
+	config := noise.Config{
+		Pattern:       noise.XX,
+		Hash:          noiseHash,
+		Initiator:     bytes.Compare(ctx.local.nonce, ctx.remote.nonce) > 0,
+		Prologue:      ctx.binding(),
+		StaticKeypair: static,
+		Random:        ctx.rand,
+	}
+
+	var first []byte
+	if config.Initiator {
+		if pattern == "ik" {
+			if peerStatic, ok := knownStaticKey(); ok {
+				config.Pattern = noise.IK
+				config.PeerStatic = peerStatic
+			} else {
+				log.Info("没有记录对方的静态公钥，改用 XX 模式握手")
+			}
+		}
+	} else {
+		// 响应方根据第一条消息的模式标记选择握手模式
+		m := conn.Receive()
+		if m.MType != message.MTypeSecret || len(m.Content) < 1 {
+			return nil, fmt.Errorf("未知消息 %v", m)
+		}
+		switch m.Content[0] {
+		case noisePatternXX:
+		case noisePatternIK:
+			config.Pattern = noise.IK
+		default:
+			return nil, fmt.Errorf("未知的 Noise 握手模式 %d", m.Content[0])
+		}
+		first = m.Content[1:]
+	}
+
+	hs, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, err
+	}
+	protocol := "Noise_" + config.Pattern.Name + "_25519_ChaChaPoly_" + noiseHash.Name
+	log.Infof("使用 %s 握手", protocol)
+
+	payload := noisePayload(identity, chatID, static.Public)
+	var peer ed25519.PublicKey
+	var c1, c2 *noise.CipherState
+	for i := 0; i < config.Pattern.Len(); i++ {
+		if (i%2 == 0) == config.Initiator {
+			// 身份信息放在本方最后一条握手消息中，此时消息已经加密并认证了对方
+			var p []byte
+			if i+2 >= config.Pattern.Len() {
+				p = payload
+			}
+			var out []byte
+			if i == 0 {
+				out = []byte{noisePatternXX}
+				if config.Pattern == noise.IK {
+					out[0] = noisePatternIK
+				}
+			}
+			out, c1, c2, err = hs.WriteMessage(out, p)
+			if err != nil {
+				return nil, err
+			}
+			conn.Send(message.NewMessage(message.MTypeSecret, out))
+			continue
+		}
+
+		data := first
+		if i > 0 {
+			m := conn.Receive()
+			if m.MType != message.MTypeSecret {
+				if config.Pattern == noise.IK {
+					return nil, errors.New("对方无法完成 IK 握手，对方的身份可能已改变，可以使用 -n=xx 重新连接")
+				}
+				return nil, fmt.Errorf("未知消息 %v", m)
+			}
+			data = m.Content
+		}
+		var p []byte
+		p, c1, c2, err = hs.ReadMessage(nil, data)
+		if err == noise.ErrInvalidDH {
+			return nil, publicKeyError(crypto.ErrZeroSharedSecret)
+		}
+		if err != nil && i == 0 && config.Pattern == noise.IK {
+			return nil, errors.New("对方记录的本机静态公钥不正确，本机的身份可能已改变，可以使用 -n=xx 重新连接")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s 握手失败: %s", protocol, err)
+		}
+		if len(p) > 0 {
+			if peer, err = verifyNoisePayload(p, chatID, hs.PeerStatic()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if peer == nil || c1 == nil || c2 == nil {
+		return nil, errors.New("对方没有发送身份信息")
+	}
+
+	ecdh := crypto.X25519.NewECDH(ctx.rand)
+	localEphemeral := hs.LocalEphemeral()
+	privateKey, _ := crypto.UnmarshalCurve25519PrivateKey(localEphemeral.Private)
+	publicKey, err := ecdh.Unmarshal(localEphemeral.Public)
+	if err != nil {
+		return nil, err
+	}
+	remotePublicKey, err := ecdh.Unmarshal(hs.PeerEphemeral())
+	if err != nil {
+		return nil, publicKeyError(err)
+	}
+
+	secret := append(c1.UnsafeKey(), c2.UnsafeKey()...)
+	keys, err := crypto.DeriveSessionKeysWithPSK(secret, ctx.psk, localEphemeral.Public, hs.PeerEphemeral(), ctx.binding())
+	if err != nil {
+		return nil, fmt.Errorf("推导会话密钥错误: %s", err)
+	}
+
+	ratchet, err := crypto.NewRatchet(ecdh, ctx.suite, keys, privateKey, publicKey, remotePublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("初始化 Double Ratchet 错误: %s", err)
+	}
+
+	return &handshakeResult{
+		peerIdentity:  peer,
+		peerStaticKey: hs.PeerStatic(),
+		kex:           crypto.X25519,
+		ecdh:          ecdh,
+		suite:         ctx.suite,
+		keys:          keys,
+		ratchet:       ratchet,
+		transcript:    hs.ChannelBinding(),
+	}, nil
+}
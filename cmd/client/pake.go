@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"terminal-encrypt-chat/crypto"
+	"terminal-encrypt-chat/message"
+)
+
+var errPassphraseMismatch = errors.New("口令不一致 (passphrase mismatch)，请与对方确认口令后重新连接")
+
+// pake 用双方约定的口令做 CPace，双方的 hello 作为会话标识，保证每次会话的生成元都不同。
+// 交换密钥确认码确认双方口令一致后，返回的共享密钥混入之后握手得到的会话密钥，
+// 不知道口令的中间人即使替换了握手中的公钥也无法得到会话密钥
+func pake(conn handshakeConn, ctx *handshakeContext, passphrase []byte) ([]byte, error) {
+	c, err := crypto.NewCPace(ctx.rand, passphrase, ctx.chatID, ctx.binding())
+	if err != nil {
+		return nil, fmt.Errorf("口令认证错误: %s", err)
+	}
+	conn.Send(message.NewMessage(message.MTypeSecret, c.Message()))
+
+	m := conn.Receive()
+	if m.MType != message.MTypeSecret {
+		return nil, fmt.Errorf("未知消息 %v", m)
+	}
+	peerMessage := m.Content
+	isk, err := c.Finish(peerMessage)
+	if err != nil {
+		return nil, errors.New("对方的口令认证消息无效，连接可能被篡改")
+	}
+	conn.Send(message.NewMessage(message.MTypeSecret, c.Confirmation(isk)))
+
+	m = conn.Receive()
+	if m.MType != message.MTypeSecret {
+		// 对方确认失败后会断开连接
+		return nil, errPassphraseMismatch
+	}
+	if err := c.VerifyConfirmation(isk, peerMessage, m.Content); err != nil {
+		return nil, errPassphraseMismatch
+	}
+	return isk, nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	gocrypto "crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"terminal-encrypt-chat/crypto"
+	"terminal-encrypt-chat/message"
+	"time"
+)
+
+const (
+	rekeyInit = 1
+	rekeyAck  = 2
+
+	// 收发消息数或时间达到阈值时自动更新密钥
+	rekeyMessages = 1000
+	rekeyInterval = 30 * time.Minute
+
+	sizeEpoch    = 4
+	sizeSequence = 8
+	sizeHeader   = sizeEpoch + sizeSequence
+)
+
+var (
+	errReplay = errors.New("收到重复或过期的消息，可能是重放攻击，已丢弃")
+	// errMessageTooLarge 表示加密后的帧超过长度限制，没有发送，不占用序号
+	errMessageTooLarge = errors.New("消息太长，超过了数据帧的长度限制，没有发送")
+)
+
+type pendingRekey struct {
+	privateKey gocrypto.PrivateKey
+	publicKey  gocrypto.PublicKey
+}
+
+// session 是握手成功后的加密会话。
+//
+// 每个 MTypeData 和 MTypeSecret 帧的内容为: 密钥版本(4) + 序号(8) + Double Ratchet 密文，
+// 帧类型、密钥版本和序号作为附加数据认证。序号在每个方向上单调递增且不随密钥更新重置，
+// 接收方据此发现重放、丢失和乱序的消息。
+// 任意一方可以通过 MTypeSecret 发起密钥更新(rekey): 发起方在当前版本下发送新的临时公钥，
+// 响应方回复自己的临时公钥后立即切换到新版本，发起方收到回复后切换。
+// 切换后保留上一版本的 Ratchet，直到收到对方新版本的帧，保证途中的消息不会丢失。
+type session struct {
+	mutex  *sync.Mutex
+	conn   handshakeConn
+	kex    *crypto.KeyExchange
+	ecdh   crypto.ECDH
+	suite  *crypto.CipherSuite
+	chatID []byte
+	// padding 是发送消息时使用的填充方案，接收时无论对方使用哪种方案都可以去掉填充
+	padding *crypto.Padding
+
+	epoch    uint32
+	keys     *crypto.SessionKeys
+	current  *crypto.Ratchet
+	previous *crypto.Ratchet
+	pending  *pendingRekey
+
+	sendSequence uint64
+	window       crypto.ReplayWindow
+
+	messages  int
+	rekeyedAt time.Time
+}
+
+func newSession(conn handshakeConn, chatID []byte, result *handshakeResult, padding *crypto.Padding) *session {
+	return &session{
+		mutex:     &sync.Mutex{},
+		conn:      conn,
+		kex:       result.kex,
+		ecdh:      result.ecdh,
+		suite:     result.suite,
+		chatID:    chatID,
+		padding:   padding,
+		keys:      result.keys,
+		current:   result.ratchet,
+		rekeyedAt: time.Now(),
+	}
+}
+
+// frameAD 把帧类型、密钥版本和序号作为附加数据，防止密文被挪到其他类型的帧或被重排
+func frameAD(mtype byte, header []byte) []byte {
+	return append([]byte{mtype}, header...)
+}
+
+func (s *session) seal(mtype byte, data []byte) (*message.Message, error) {
+	header := make([]byte, sizeHeader)
+	binary.BigEndian.PutUint32(header, s.epoch)
+	binary.BigEndian.PutUint64(header[sizeEpoch:], s.sendSequence)
+	content, err := s.current.Encrypt(data, frameAD(mtype, header))
+	if err != nil {
+		return nil, err
+	}
+	s.sendSequence++
+	return message.NewMessage(mtype, append(header, content...)), nil
+}
+
+// Send 加密发送一条消息，返回这一帧的序号，对方解密失败时用序号指出是哪一帧
+func (s *session) Send(data []byte) (uint64, error) {
+	sequence, _, err := s.send(data, false)
+	return sequence, err
+}
+
+// idleConn 是可以判断发送队列是否为空的连接
+type idleConn interface {
+	Idle() bool
+}
+
+// SendIfIdle 只在发送队列为空时加密发送，用于输入状态这类丢弃也没有关系的消息，
+// 队列不空时不加密也不占用序号，返回 false
+func (s *session) SendIfIdle(data []byte) (bool, error) {
+	_, sent, err := s.send(data, true)
+	return sent, err
+}
+
+// limitedConn 是有帧长度限制的连接，其他连接使用 message.DefaultLimits
+type limitedConn interface {
+	Limits() message.Limits
+}
+
+// CheckSize 判断 data 加密后能否在一个数据帧中发送，不能时返回 errMessageTooLarge
+func (s *session) CheckSize(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.checkSize(s.padding.Size(len(data)))
+}
+
+// checkSize 需要持有 mutex，padded 是填充后的明文长度
+func (s *session) checkSize(padded int) error {
+	limits := message.DefaultLimits
+	if c, ok := s.conn.(limitedConn); ok {
+		limits = c.Limits()
+	}
+	if uint64(sizeHeader+s.current.Overhead()+padded) > limits.Data {
+		return errMessageTooLarge
+	}
+	return nil
+}
+
+func (s *session) send(data []byte, ifIdle bool) (uint64, bool, error) {
+	s.mutex.Lock()
+	if c, ok := s.conn.(idleConn); ok && ifIdle && !c.Idle() {
+		s.mutex.Unlock()
+		return 0, false, nil
+	}
+	padded := s.padding.Pad(data)
+	if err := s.checkSize(len(padded)); err != nil {
+		s.mutex.Unlock()
+		return 0, false, err
+	}
+	sequence := s.sendSequence
+	m, err := s.seal(message.MTypeData, padded)
+	if err == nil {
+		err = s.conn.Send(m)
+	}
+	if err == nil {
+		s.messages++
+	}
+	due := s.rekeyDue()
+	s.mutex.Unlock()
+
+	if due {
+		s.Rekey()
+	}
+	return sequence, err == nil, err
+}
+
+// Open 解密对方发来的帧，MTypeSecret 帧在内部处理，返回的明文为 nil
+func (s *session) Open(m *message.Message) ([]byte, error) {
+	s.mutex.Lock()
+	plaintext, err := s.open(m)
+	due := err == nil && s.rekeyDue()
+	s.mutex.Unlock()
+
+	if due {
+		s.Rekey()
+	}
+	return plaintext, err
+}
+
+// frameSequence 返回帧头中的序号，帧头没有经过认证，只能用于提示
+func frameSequence(m *message.Message) (uint64, bool) {
+	if len(m.Content) < sizeHeader {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(m.Content[sizeEpoch:sizeHeader]), true
+}
+
+// UndeliveredSequence 返回解密失败的帧的序号，只有序号大于所有已收到的帧时才返回 true。
+// 帧头没有经过认证，序号不大于已收到的帧时一定是伪造或重放的帧，不能让对方把已经送达的消息标记为解密失败
+func (s *session) UndeliveredSequence(m *message.Message) (uint64, bool) {
+	sequence, ok := frameSequence(m)
+	if !ok {
+		return 0, false
+	}
+	s.mutex.Lock()
+	status, _ := s.window.Check(sequence)
+	s.mutex.Unlock()
+	return sequence, status == crypto.SequenceInOrder || status == crypto.SequenceGap
+}
+
+func (s *session) open(m *message.Message) ([]byte, error) {
+	if len(m.Content) < sizeHeader {
+		return nil, errors.New("消息长度错误")
+	}
+	header, content := m.Content[:sizeHeader], m.Content[sizeHeader:]
+	epoch := binary.BigEndian.Uint32(header)
+	sequence := binary.BigEndian.Uint64(header[sizeEpoch:])
+
+	status, lost := s.window.Check(sequence)
+	if status == crypto.SequenceReplay {
+		return nil, errReplay
+	}
+
+	var ratchet *crypto.Ratchet
+	switch {
+	case epoch == s.epoch:
+		ratchet = s.current
+	case epoch+1 == s.epoch && s.previous != nil:
+		ratchet = s.previous
+	default:
+		return nil, fmt.Errorf("未知的密钥版本 %d", epoch)
+	}
+
+	plaintext, err := ratchet.Decrypt(content, frameAD(m.MType, header))
+	if err == crypto.ErrDuplicateMessage {
+		return nil, errReplay
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.window.Accept(sequence)
+	switch status {
+	case crypto.SequenceGap:
+		log.Warnf("有 %d 条消息没有收到，可能被服务器丢弃", lost)
+	case crypto.SequenceLate:
+		log.Warnf("收到一条迟到的消息，消息顺序可能被打乱")
+	}
+	if epoch == s.epoch {
+		// 对方已经切换到当前版本，不会再有旧版本的消息
+		s.previous = nil
+	}
+
+	if m.MType == message.MTypeSecret {
+		return nil, s.handleRekey(plaintext)
+	}
+	s.messages++
+	return crypto.Unpad(plaintext)
+}
+
+func (s *session) rekeyDue() bool {
+	return s.pending == nil && (s.messages >= rekeyMessages || time.Since(s.rekeyedAt) >= rekeyInterval)
+}
+
+// rekeyLoop 在没有消息往来时也按时间更新密钥，done 关闭时退出
+func (s *session) rekeyLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			due := s.rekeyDue()
+			s.mutex.Unlock()
+			if due {
+				s.Rekey()
+			}
+		}
+	}
+}
+
+// Rekey 发起一次密钥更新
+func (s *session) Rekey() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pending != nil {
+		log.Info("正在更新密钥...")
+		return
+	}
+
+	privateKey, publicKey, err := s.ecdh.GenerateKey()
+	if err != nil {
+		log.Warnf("更新密钥失败: %s", err)
+		return
+	}
+	pending := &pendingRekey{privateKey: privateKey, publicKey: publicKey}
+	m, err := s.seal(message.MTypeSecret, append([]byte{rekeyInit}, s.ecdh.Marshal(publicKey)...))
+	if err != nil {
+		log.Warnf("更新密钥失败: %s", err)
+		return
+	}
+	s.conn.Send(m)
+	s.pending = pending
+	log.Debug("已发起密钥更新")
+}
+
+func (s *session) handleRekey(data []byte) error {
+	if len(data) < 1 {
+		return errors.New("密钥更新消息长度错误")
+	}
+
+	switch data[0] {
+	case rekeyInit:
+		if s.pending != nil && s.keys.Initiator {
+			// 双方同时发起时以 Initiator 一方为准，等待对方的回复
+			return nil
+		}
+		s.pending = nil
+
+		privateKey, publicKey, err := s.ecdh.GenerateKey()
+		if err != nil {
+			return err
+		}
+		publicKeyData := s.ecdh.Marshal(publicKey)
+		keys, ratchet, err := s.nextKeys(privateKey, publicKey, data[1:])
+		if err != nil {
+			return err
+		}
+
+		m, err := s.seal(message.MTypeSecret, append([]byte{rekeyAck}, publicKeyData...))
+		if err != nil {
+			return err
+		}
+		s.conn.Send(m)
+		s.switchKeys(keys, ratchet)
+	case rekeyAck:
+		if s.pending == nil {
+			return errors.New("收到意外的密钥更新回复")
+		}
+		keys, ratchet, err := s.nextKeys(s.pending.privateKey, s.pending.publicKey, data[1:])
+		if err != nil {
+			return err
+		}
+		s.switchKeys(keys, ratchet)
+	default:
+		return fmt.Errorf("未知的密钥更新消息 %d", data[0])
+	}
+	return nil
+}
+
+func (s *session) nextKeys(privateKey gocrypto.PrivateKey, publicKey gocrypto.PublicKey, remotePublicKeyData []byte) (*crypto.SessionKeys, *crypto.Ratchet, error) {
+	remotePublicKey, err := s.ecdh.Unmarshal(remotePublicKeyData)
+	if err != nil {
+		return nil, nil, publicKeyError(err)
+	}
+	secret, err := s.ecdh.GenerateSharedSecret(privateKey, remotePublicKey)
+	if err != nil {
+		return nil, nil, publicKeyError(err)
+	}
+	keys, err := s.keys.Next(secret, s.ecdh.Marshal(publicKey), remotePublicKeyData, s.chatID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ratchet, err := crypto.NewRatchet(s.ecdh, s.suite, keys, privateKey, publicKey, remotePublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, ratchet, nil
+}
+
+func (s *session) switchKeys(keys *crypto.SessionKeys, ratchet *crypto.Ratchet) {
+	s.previous = s.current
+	s.current = ratchet
+	s.keys = keys
+	s.epoch++
+	s.pending = nil
+	s.messages = 0
+	s.rekeyedAt = time.Now()
+	log.Infof("密钥已更新 (第 %d 次)", s.epoch)
+}
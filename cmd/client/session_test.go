@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"terminal-encrypt-chat/crypto"
+	"terminal-encrypt-chat/message"
+)
+
+// sessionPeer 是测试中的一方，conn.in 中是对方发来还没有处理的帧
+type sessionPeer struct {
+	sess     *session
+	conn     *lockstepConn
+	received []string
+}
+
+// newSessionPair 握手后为双方建立会话。会话只使用 lockstepConn 的 Send，帧由测试从 in 中取出后交给 Open，
+// 这样可以控制每一帧到达的时机
+func newSessionPair(t *testing.T) (*sessionPeer, *sessionPeer) {
+	_, a, b := runHandshake(t, negotiateParams{suites: crypto.CipherSuites(), kexes: crypto.KeyExchanges()})
+	connA, connB := newLockstepPair()
+	chatID := []byte("golden")
+	return &sessionPeer{sess: newSession(connA, chatID, a, crypto.PaddingPadme), conn: connA},
+		&sessionPeer{sess: newSession(connB, chatID, b, crypto.PaddingPadme), conn: connB}
+}
+
+func (p *sessionPeer) send(t *testing.T, text string) {
+	if _, err := p.sess.Send([]byte(text)); err != nil {
+		t.Fatal("Fail to send: ", err)
+	}
+}
+
+// deliver 处理对方发来的 n 帧，n 小于 0 时处理所有已到达的帧，包括处理过程中对方新发来的帧
+func (p *sessionPeer) deliver(t *testing.T, n int) {
+	for ; n != 0 && len(p.conn.in) > 0; n-- {
+		m := <-p.conn.in
+		plaintext, err := p.sess.Open(m)
+		if err != nil {
+			t.Fatalf("%s fails to open frame %c at epoch %d: %s", p.conn.name, m.MType, p.sess.epoch, err)
+		}
+		if plaintext != nil {
+			p.received = append(p.received, string(plaintext))
+		}
+	}
+}
+
+func expectReceived(t *testing.T, p *sessionPeer, expected ...string) {
+	if fmt.Sprint(p.received) != fmt.Sprint(expected) {
+		t.Fatalf("%s received %q, expected %q", p.conn.name, p.received, expected)
+	}
+}
+
+// TestSessionSimultaneousRekey 双方同时发起密钥更新，途中一直有消息在传输，所有消息都必须能解密
+func TestSessionSimultaneousRekey(t *testing.T) {
+	a, b := newSessionPair(t)
+	if a.sess.keys.Initiator == b.sess.keys.Initiator {
+		t.Fatal("Exactly one side must be the initiator")
+	}
+
+	a.send(t, "a1")
+	b.send(t, "b1")
+	a.sess.Rekey()
+	b.sess.Rekey()
+	a.send(t, "a2")
+	b.send(t, "b2")
+
+	// 双方各收到 1 条消息和对方的密钥更新请求，只有不是 Initiator 的一方响应并切换到新版本
+	a.deliver(t, 2)
+	b.deliver(t, 2)
+	initiator, responder := a, b
+	if b.sess.keys.Initiator {
+		initiator, responder = b, a
+	}
+	if initiator.sess.epoch != 0 || responder.sess.epoch != 1 || initiator.sess.pending == nil {
+		t.Fatalf("Unexpected epochs after crossing rekeys: initiator %d, responder %d", initiator.sess.epoch, responder.sess.epoch)
+	}
+
+	// 响应方用新版本发送，发起方还在用旧版本发送
+	a.send(t, "a3")
+	b.send(t, "b3")
+	a.deliver(t, -1)
+	b.deliver(t, -1)
+	a.deliver(t, -1)
+
+	a.send(t, "a4")
+	b.send(t, "b4")
+	a.deliver(t, -1)
+	b.deliver(t, -1)
+
+	expectReceived(t, a, "b1", "b2", "b3", "b4")
+	expectReceived(t, b, "a1", "a2", "a3", "a4")
+	for _, p := range []*sessionPeer{a, b} {
+		if p.sess.epoch != 1 || p.sess.pending != nil {
+			t.Fatalf("%s must end on epoch 1 without pending rekey, got epoch %d", p.conn.name, p.sess.epoch)
+		}
+		if p.sess.previous != nil {
+			t.Fatalf("%s must drop the previous ratchet after receiving a frame of the new epoch", p.conn.name)
+		}
+	}
+
+	// 再更新一次，确认状态机回到了可以继续更新的状态
+	b.sess.Rekey()
+	b.send(t, "b5")
+	a.deliver(t, -1)
+	a.send(t, "a5")
+	b.deliver(t, -1)
+	expectReceived(t, a, "b1", "b2", "b3", "b4", "b5")
+	expectReceived(t, b, "a1", "a2", "a3", "a4", "a5")
+	if a.sess.epoch != 2 || b.sess.epoch != 2 {
+		t.Fatalf("Both sides must be on epoch 2, got %d and %d", a.sess.epoch, b.sess.epoch)
+	}
+}
+
+// TestSessionReplayAndReorder 重放、丢弃和打乱已加密的帧，以及篡改作为附加数据的帧类型、密钥版本和序号
+func TestSessionReplayAndReorder(t *testing.T) {
+	a, b := newSessionPair(t)
+	frames := make([]*message.Message, 5)
+	for i := range frames {
+		a.send(t, fmt.Sprint("a", i))
+		frames[i] = <-b.conn.in
+	}
+	open := func(m *message.Message) (string, error) {
+		plaintext, err := b.sess.Open(m)
+		return string(plaintext), err
+	}
+	expectOpen := func(m *message.Message, expected string) {
+		if got, err := open(m); err != nil || got != expected {
+			t.Fatalf("Expected %q, got %q: %v", expected, got, err)
+		}
+	}
+	expectReplay := func(m *message.Message) {
+		if _, err := open(m); err != errReplay {
+			t.Fatal("Replayed frame must be rejected with errReplay, got: ", err)
+		}
+	}
+	// tampered 返回修改过的帧的副本
+	tampered := func(m *message.Message, mtype byte, modify func(header []byte)) *message.Message {
+		content := append([]byte{}, m.Content...)
+		modify(content[:sizeHeader])
+		return message.NewMessage(mtype, content)
+	}
+	keep := func([]byte) {}
+
+	expectOpen(frames[0], "a0")
+	expectReplay(frames[0])
+
+	// 丢弃 a1，a2 先到达，之后 a1 迟到
+	expectOpen(frames[2], "a2")
+	expectOpen(frames[1], "a1")
+	expectReplay(frames[1])
+	expectReplay(frames[2])
+
+	// 篡改的帧必须在认证时被拒绝，不能消耗 Ratchet 的密钥或进入重放窗口，之后原来的帧仍然可以解密。
+	// 把 MTypeData 的密文挪到 MTypeSecret 帧中
+	if _, err := open(tampered(frames[3], message.MTypeSecret, keep)); err == nil || err == errReplay {
+		t.Fatal("Frame type must be authenticated, got: ", err)
+	}
+	expectOpen(frames[3], "a3")
+	expectReplay(frames[3])
+	// 修改密钥版本
+	if _, err := open(tampered(frames[4], message.MTypeData, func(h []byte) { binary.BigEndian.PutUint32(h, 1) })); err == nil {
+		t.Fatal("Unknown epoch must be rejected")
+	}
+	// 修改序号
+	if _, err := open(tampered(frames[4], message.MTypeData, func(h []byte) { binary.BigEndian.PutUint64(h[sizeEpoch:], 100) })); err == nil || err == errReplay {
+		t.Fatal("Sequence must be authenticated, got: ", err)
+	}
+	expectOpen(frames[4], "a4")
+	if sequence, ok := frameSequence(frames[4]); !ok || sequence != 4 {
+		t.Fatal("Unexpected frame sequence: ", sequence)
+	}
+}
+
+// limitedLockstepConn 是有帧长度限制的 lockstepConn
+type limitedLockstepConn struct {
+	*lockstepConn
+	limits message.Limits
+}
+
+func (c limitedLockstepConn) Limits() message.Limits {
+	return c.limits
+}
+
+// TestSessionMessageTooLarge 加密后超过数据帧长度限制的消息在加密前被拒绝，不占用序号
+func TestSessionMessageTooLarge(t *testing.T) {
+	a, b := newSessionPair(t)
+	limits := message.Limits{Control: 1024, Data: 256}
+	a.sess.conn = limitedLockstepConn{a.conn, limits}
+
+	// padmé 把 200 字节填充到 208 字节，加上帧头和 Double Ratchet 的开销超过 256 字节
+	for _, data := range [][]byte{make([]byte, 200), make([]byte, 4096)} {
+		if err := a.sess.CheckSize(data); err != errMessageTooLarge {
+			t.Fatal("CheckSize must refuse an oversized message, got: ", err)
+		}
+		if _, err := a.sess.Send(data); err != errMessageTooLarge {
+			t.Fatal("Send must refuse an oversized message, got: ", err)
+		}
+	}
+	if len(b.conn.in) != 0 {
+		t.Fatal("Oversized message must not be sent")
+	}
+
+	a.send(t, "short")
+	m := <-b.conn.in
+	if uint64(len(m.Content)) > limits.Data {
+		t.Fatal("Frame exceeds the limit: ", len(m.Content))
+	}
+	if sequence, ok := frameSequence(m); !ok || sequence != 0 {
+		t.Fatal("Refused message must not consume a sequence, got: ", sequence)
+	}
+	plaintext, err := b.sess.Open(m)
+	if err != nil || string(plaintext) != "short" {
+		t.Fatal("Fail to open the message after a refused one: ", err)
+	}
+}
+
+// busyConn 是可以控制发送队列是否为空的 lockstepConn
+type busyConn struct {
+	*lockstepConn
+	busy *bool
+}
+
+func (c busyConn) Idle() bool {
+	return !*c.busy
+}
+
+// TestSessionSendIfIdle 发送队列不空时 SendIfIdle 不加密也不占用序号
+func TestSessionSendIfIdle(t *testing.T) {
+	a, b := newSessionPair(t)
+	busy := true
+	a.sess.conn = busyConn{a.conn, &busy}
+
+	if sent, err := a.sess.SendIfIdle([]byte("typing")); sent || err != nil {
+		t.Fatal("SendIfIdle must skip a busy queue, got: ", sent, err)
+	}
+	if len(b.conn.in) != 0 || a.sess.sendSequence != 0 || a.sess.messages != 0 {
+		t.Fatal("Skipped message must not be encrypted or consume a sequence")
+	}
+
+	// 队列忙时普通消息照常发送
+	a.send(t, "a0")
+	busy = false
+	if sent, err := a.sess.SendIfIdle([]byte("a1")); !sent || err != nil {
+		t.Fatal("SendIfIdle must send when the queue is idle, got: ", sent, err)
+	}
+	frames := []*message.Message{<-b.conn.in, <-b.conn.in}
+	for i, m := range frames {
+		if sequence, ok := frameSequence(m); !ok || sequence != uint64(i) {
+			t.Fatalf("Frame %d has sequence %d", i, sequence)
+		}
+		b.conn.in <- m
+	}
+	b.deliver(t, -1)
+	expectReceived(t, b, "a0", "a1")
+}
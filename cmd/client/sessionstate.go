@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// sessionState 是使用 keystore 时按 peerKey 保存的会话状态，记录对方身份是否已经核对过安全码。
+// 会话密钥和 Ratchet 不保存，每次连接都重新握手，keystore 泄露也无法解密之前的消息
+type sessionState struct {
+	// Fingerprint 是核对安全码时对方的身份指纹，对方更换身份密钥后之前的核对不再有效
+	Fingerprint string    `json:"fingerprint"`
+	Verified    bool      `json:"verified"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// loadSessionState 读取保存的会话状态，没有保存或对方身份指纹已改变时返回新的状态
+func loadSessionState(fingerprint string) *sessionState {
+	state := &sessionState{Fingerprint: fingerprint}
+	if store == nil {
+		return state
+	}
+	data, ok := store.Session(peerKey())
+	if !ok {
+		return state
+	}
+	defer zero(data)
+	var saved sessionState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Warnf("读取保存的会话状态失败: %s", err)
+		return state
+	}
+	if saved.Fingerprint != fingerprint {
+		return state
+	}
+	return &saved
+}
+
+// saveSessionState 把会话状态保存到 keystore，没有使用 keystore 时不保存
+func saveSessionState(state *sessionState) {
+	if store == nil {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Warnf("保存会话状态失败: %s", err)
+		return
+	}
+	defer zero(data)
+	if err := store.SetSession(peerKey(), data); err != nil {
+		log.Warnf("保存会话状态失败: %s", err)
+	}
+}
+
+// restoreSession 在验证对方身份后恢复保存的会话状态。之前已经核对过安全码并且对方身份密钥没有改变时，
+// 中间人无法冒充对方完成握手，本次会话直接标记为已验证
+func restoreSession(fingerprint string) {
+	peerSession = loadSessionState(fingerprint)
+	if peerSession.Verified {
+		verified = true
+		log.Infof("之前已与 %s 核对过安全码，对方身份密钥没有改变，本次会话已验证", peerKey())
+	}
+	peerSession.LastSeen = time.Now()
+	saveSessionState(peerSession)
+}
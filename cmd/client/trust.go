@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"terminal-encrypt-chat/knownpeers"
+	"terminal-encrypt-chat/tui"
+)
+
+const knownPeersFile = "known_peers"
+
+// peerKey 是对方在 known_peers 中的记录名，优先使用联系人别名
+func peerKey() string {
+	if alias != "" {
+		return alias
+	}
+	return id
+}
+
+// formatFingerprint 把指纹按 4 个字符分组，便于人工比对
+func formatFingerprint(fingerprint string) string {
+	var groups []string
+	for len(fingerprint) > 4 {
+		groups = append(groups, fingerprint[:4])
+		fingerprint = fingerprint[4:]
+	}
+	groups = append(groups, fingerprint)
+	return strings.Join(groups, " ")
+}
+
+// knownStaticKey 返回 known_peers 中记录的对方 Noise 静态公钥
+func knownStaticKey() ([]byte, bool) {
+	peers, err := openKnownPeers()
+	if err != nil {
+		return nil, false
+	}
+	return peers.StaticKey(peerKey())
+}
+
+// checkPeer 首次连接时记录对方身份指纹，之后指纹变化需要用户明确确认才能继续。
+// Noise 握手后同时记录对方的静态公钥，下次可以使用 IK 模式握手
+func checkPeer(fingerprint string, staticKey []byte) error {
+	peers, err := openKnownPeers()
+	if err != nil {
+		return err
+	}
+
+	key := peerKey()
+	switch peers.Check(key, fingerprint) {
+	case knownpeers.Match:
+		log.Infof("对方身份与 %s 的记录一致", key)
+		return setStaticKey(peers, key, staticKey)
+	case knownpeers.Unknown:
+		log.Infof("首次与 %s 建立联系，已记录对方身份指纹", key)
+		if err := peers.Set(key, fingerprint); err != nil {
+			return err
+		}
+		return setStaticKey(peers, key, staticKey)
+	}
+
+	known, _ := peers.Lookup(key)
+	log.Error("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	log.Error("@    警告: 对方的身份密钥已改变!                         @")
+	log.Error("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	log.Errorf("有人可能正在进行中间人攻击，也可能是对方更换了身份密钥")
+	log.Errorf("%s 记录的指纹: %s", key, formatFingerprint(known))
+	log.Errorf("对方当前的指纹: %s", formatFingerprint(fingerprint))
+	log.Errorf("请通过其他渠道与对方核实，输入 yes 信任新的身份密钥，其他输入将断开连接")
+
+	tui.StartInput()
+	answer := <-tuiInputCh
+	if strings.TrimSpace(string(answer.Text)) != "yes" {
+		return errors.New("对方身份密钥已改变，已拒绝建立会话")
+	}
+
+	log.Warnf("已信任 %s 新的身份密钥", key)
+	if err := peers.Set(key, fingerprint); err != nil {
+		return err
+	}
+	return setStaticKey(peers, key, staticKey)
+}
+
+func setStaticKey(peers *knownpeers.Store, key string, staticKey []byte) error {
+	if staticKey == nil {
+		return nil
+	}
+	if known, ok := peers.StaticKey(key); ok && bytes.Equal(known, staticKey) {
+		return nil
+	}
+	return peers.SetStaticKey(key, staticKey)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"terminal-encrypt-chat/envelope"
+	"terminal-encrypt-chat/message"
+	"terminal-encrypt-chat/tui"
+	"time"
+)
+
+const (
+	// typingRefresh 是持续输入时重复发送输入状态的最短间隔，也是输入状态的发送频率上限
+	typingRefresh = 3 * time.Second
+	// typingIdle 是停止编辑多久后告诉对方已停止输入
+	typingIdle = 5 * time.Second
+	// typingExpiry 是收到输入状态后显示的时长，对方的停止输入消息丢失时提示也会消失
+	typingExpiry = 2 * typingRefresh
+	// typingTick 是检查是否停止输入和提示是否过期的间隔
+	typingTick = time.Second
+
+	typingHint = "对方正在输入…"
+)
+
+// useTyping 判断是否收发输入状态，只有双方都开启时才使用
+func (c *chat) useTyping() bool {
+	return c.caps&message.CapTyping != 0
+}
+
+// sendTyping 发送输入状态。输入状态丢失没有关系，发送队列中还有消息时直接放弃
+func (c *chat) sendTyping(state byte) bool {
+	e, err := envelope.New(envelope.KindTyping)
+	if err != nil {
+		return false
+	}
+	e.State = state
+	sent, err := c.sess.SendIfIdle(e.Marshal())
+	if err != nil {
+		log.Debugf("发送输入状态失败: %s", err)
+	}
+	return sent
+}
+
+// typingLoop 把输入框的编辑和定时检查交给 inputEdited 和 checkTyping
+func (c *chat) typingLoop(done <-chan struct{}) {
+	if !c.useTyping() {
+		return
+	}
+	ticker := time.NewTicker(typingTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case nonEmpty := <-tui.Edits():
+			c.inputEdited(nonEmpty)
+		case <-ticker.C:
+			c.checkTyping()
+		}
+	}
+}
+
+// inputEdited 根据输入框的编辑发送输入状态: 开始输入时立即发送，持续输入时每 typingRefresh 发送一次，
+// 清空输入框或发送消息后发送停止输入。nonEmpty 表示编辑后输入框不为空
+func (c *chat) inputEdited(nonEmpty bool) {
+	now := c.now()
+	c.typingEditedAt = now
+	if !nonEmpty {
+		if c.typing {
+			c.sendTyping(envelope.TypingStopped)
+			c.typing = false
+		}
+		return
+	}
+	if (!c.typing || now.Sub(c.typingSentAt) >= typingRefresh) && c.sendTyping(envelope.TypingStarted) {
+		c.typing = true
+		c.typingSentAt = now
+	}
+}
+
+// checkTyping 每隔 typingTick 检查一次: typingIdle 内没有编辑时告诉对方已停止输入，
+// 对方的输入状态超过 typingExpiry 没有更新时清除提示
+func (c *chat) checkTyping() {
+	now := c.now()
+	if c.typing && now.Sub(c.typingEditedAt) >= typingIdle {
+		c.sendTyping(envelope.TypingStopped)
+		c.typing = false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.peerTypingUntil.IsZero() && !now.Before(c.peerTypingUntil) {
+		c.hideTyping()
+	}
+}
+
+func (c *chat) handleTyping(e *envelope.Envelope) {
+	if !c.useTyping() {
+		return
+	}
+	switch e.State {
+	case envelope.TypingStarted:
+		c.mutex.Lock()
+		if c.peerTypingUntil.IsZero() {
+			c.view.SetHint(typingHint)
+		}
+		c.peerTypingUntil = c.now().Add(typingExpiry)
+		c.mutex.Unlock()
+	case envelope.TypingStopped:
+		c.peerStoppedTyping()
+	}
+}
+
+// peerStoppedTyping 清除对方正在输入的提示，收到对方的消息时也会清除
+func (c *chat) peerStoppedTyping() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.hideTyping()
+}
+
+// hideTyping 需要持有 mutex，提示的显示和清除按顺序进行
+func (c *chat) hideTyping() {
+	if !c.peerTypingUntil.IsZero() {
+		c.peerTypingUntil = time.Time{}
+		c.view.SetHint("")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"terminal-encrypt-chat/envelope"
+	"terminal-encrypt-chat/message"
+)
+
+// fakeClock 是测试中可控的时钟
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// typingStates 取出对方发来的帧，返回其中输入状态的顺序
+func typingStates(t *testing.T, p *chatPeer) []byte {
+	var states []byte
+	for len(p.conn.in) > 0 {
+		plaintext, err := p.sess.Open(<-p.conn.in)
+		if err != nil {
+			t.Fatal("Fail to open frame: ", err)
+		}
+		e, err := envelope.Unmarshal(plaintext)
+		if err != nil || e.Kind != envelope.KindTyping {
+			t.Fatal("Expected a typing envelope, got: ", e, err)
+		}
+		states = append(states, e.State)
+		p.chat.handlePayload(plaintext)
+	}
+	return states
+}
+
+// step 是输入状态测试中的一步: 时钟前进 after 后由 a 执行 action，b 收到的输入状态必须是 expected
+type step struct {
+	after    time.Duration
+	action   func(a *chatPeer)
+	expected []byte
+}
+
+func edit(nonEmpty bool) func(a *chatPeer) {
+	return func(a *chatPeer) { a.chat.inputEdited(nonEmpty) }
+}
+
+func tick(a *chatPeer) {
+	a.chat.checkTyping()
+}
+
+// TestTypingSender 开始输入时立即发送，持续输入时每 typingRefresh 最多发送一次，
+// 清空输入框或 typingIdle 内没有编辑时发送停止输入
+func TestTypingSender(t *testing.T) {
+	const started, stopped = envelope.TypingStarted, envelope.TypingStopped
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"debounce", []step{
+			{0, edit(true), []byte{started}},
+			{time.Second, edit(true), nil},
+			{time.Second, edit(true), nil},
+			{time.Second, edit(true), []byte{started}},
+			{time.Second, edit(true), nil},
+		}},
+		{"idle", []step{
+			{0, edit(true), []byte{started}},
+			{4 * time.Second, tick, nil},
+			{time.Second, tick, []byte{stopped}},
+			{time.Second, tick, nil},
+			// 停止后再编辑立即发送
+			{0, edit(true), []byte{started}},
+		}},
+		{"editing_keeps_typing", []step{
+			{0, edit(true), []byte{started}},
+			{4 * time.Second, edit(true), []byte{started}},
+			{4 * time.Second, tick, nil},
+			{time.Second, tick, []byte{stopped}},
+		}},
+		{"cleared", []step{
+			{0, edit(true), []byte{started}},
+			{time.Second, edit(false), []byte{stopped}},
+			{time.Second, edit(false), nil},
+			{10 * time.Second, tick, nil},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := newChatPair(t, message.CapEnvelope|message.CapTyping)
+			clock := &fakeClock{now: time.Unix(1000, 0)}
+			a.chat.now = clock.Now
+			for i, s := range c.steps {
+				clock.advance(s.after)
+				s.action(a)
+				if got := typingStates(t, b); string(got) != string(s.expected) {
+					t.Fatalf("Step %d: peer received typing states %v, expected %v", i, got, s.expected)
+				}
+			}
+		})
+	}
+}
+
+// TestTypingSender_BusyQueue 发送队列不空时不发送输入状态，队列空闲后的下一次编辑重新发送
+func TestTypingSender_BusyQueue(t *testing.T) {
+	a, b := newChatPair(t, message.CapEnvelope|message.CapTyping)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	a.chat.now = clock.Now
+	busy := true
+	a.sess.conn = busyConn{a.conn, &busy}
+
+	a.chat.inputEdited(true)
+	if len(b.conn.in) != 0 || a.sess.sendSequence != 0 {
+		t.Fatal("Typing state must not be sent or consume a sequence while the queue is busy")
+	}
+	busy = false
+	clock.advance(time.Second)
+	a.chat.inputEdited(true)
+	if got := typingStates(t, b); string(got) != string([]byte{envelope.TypingStarted}) {
+		t.Fatal("Typing state must be sent once the queue is idle, got: ", got)
+	}
+}
+
+// TestTypingIndicator 收到输入状态后显示提示，typingExpiry 内没有更新时过期，收到停止输入或消息时清除
+func TestTypingIndicator(t *testing.T) {
+	a, b := newChatPair(t, message.CapEnvelope|message.CapTyping)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	a.chat.now = clock.Now
+	b.chat.now = clock.Now
+	expectHint := func(expected string) {
+		t.Helper()
+		if hint := b.view.hint; hint != expected {
+			t.Fatalf("Expected hint %q, got %q", expected, hint)
+		}
+	}
+
+	a.chat.inputEdited(true)
+	b.deliver(t)
+	expectHint(typingHint)
+	clock.advance(typingExpiry - time.Second)
+	b.chat.checkTyping()
+	expectHint(typingHint)
+	clock.advance(time.Second)
+	b.chat.checkTyping()
+	expectHint("")
+
+	// 持续输入时提示的到期时间随每次输入状态延后
+	a.chat.inputEdited(false)
+	b.deliver(t)
+	a.chat.inputEdited(true)
+	b.deliver(t)
+	clock.advance(typingRefresh)
+	a.chat.inputEdited(true)
+	b.deliver(t)
+	clock.advance(typingExpiry - time.Second)
+	b.chat.checkTyping()
+	expectHint(typingHint)
+	clock.advance(time.Second)
+	b.chat.checkTyping()
+	expectHint("")
+
+	// 停止输入和收到消息都会清除提示
+	a.chat.inputEdited(false)
+	b.deliver(t)
+	a.chat.inputEdited(true)
+	b.deliver(t)
+	expectHint(typingHint)
+	a.chat.inputEdited(false)
+	b.deliver(t)
+	expectHint("")
+	a.chat.inputEdited(true)
+	b.deliver(t)
+	a.sendText(t, "hello")
+	b.deliver(t)
+	expectHint("")
+
+	// 没有开启输入状态时忽略对方发来的输入状态
+	c, d := newChatPair(t, message.CapEnvelope|message.CapTyping)
+	d.chat = newChat(d.sess, message.CapEnvelope, d.view)
+	c.chat.inputEdited(true)
+	d.deliver(t)
+	if d.view.hint != "" {
+		t.Fatal("Typing state must be ignored when disabled")
+	}
+}
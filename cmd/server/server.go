@@ -6,6 +6,8 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"terminal-encrypt-chat/message"
 	"terminal-encrypt-chat/transfer"
@@ -13,22 +15,29 @@ import (
 )
 
 type chat struct {
-	Id       string
-	Conn     net.Conn
-	Target   *chat
-	Transfer *transfer.Transfer
+	Id        string
+	Conn      net.Conn
+	Target    *chat
+	Transfer  *transfer.Transfer
+	Handshake *message.Message
 }
 
 var (
-	host string
+	host   string
+	limits = message.DefaultLimits
 
 	chats = make(map[string]*chat)
 	mutex = &sync.Mutex{}
+
+	// versionCounts 是当前在线的各协议版本客户端数，由 mutex 保护
+	versionCounts = make(map[byte]int)
 )
 
 func main() {
 	// 解析命令行参数
 	flag.StringVar(&host, "h", ":9468", "listen address (ip:port)")
+	flag.Uint64Var(&limits.Control, "control-limit", limits.Control, "maximum size of handshake and control frames in bytes")
+	flag.Uint64Var(&limits.Data, "data-limit", limits.Data, "maximum size of data frames in bytes")
 	flag.Parse()
 	if host == "" {
 		flag.Usage()
@@ -70,37 +79,57 @@ func handleConn(conn net.Conn) {
 	remoteAddr := conn.RemoteAddr().String()
 	log.Debugf("%s 建立连接\n", remoteAddr)
 
-	tf := transfer.NewTransfer(conn)
+	tf := transfer.NewTransferWithLimits(conn, limits)
 
 	// 接收握手包
-	hsMessage := tf.Receive()
+	hsMessage, ok := tf.ReceiveUntilClose()
+	if !ok {
+		logClose(remoteAddr, tf)
+		return
+	}
 	if hsMessage.MType != message.MTypeHandShake {
 		log.Debugf("%s 接收到非握手包\n", remoteAddr)
 		log.Debug(hsMessage)
+		tf.Close()
 		return
 	}
 
-	id := string(hsMessage.Content)
+	// 服务器只负责转发，旧版本的客户端也可以互相连接，版本是否兼容由客户端判断
+	hs, err := message.ParseHandshake(hsMessage.Content)
+	if err != nil {
+		log.Debugf("%s 握手包格式错误\n", remoteAddr)
+		tf.SendAndClose(message.NewMessage(message.MTypeClose, []byte("握手包格式错误")))
+		return
+	}
+	id := string(hs.ChatID)
 	log.Debugf("%s 获取到聊天 ID: %s\n", remoteAddr, id)
 
 	c1 := &chat{
-		Id:       id,
-		Conn:     conn,
-		Target:   nil,
-		Transfer: tf,
+		Id:        id,
+		Conn:      conn,
+		Target:    nil,
+		Transfer:  tf,
+		Handshake: hsMessage,
 	}
 
 	mutex.Lock()
+	log.Infof("%s 协议版本 v%d，当前在线客户端: %s", remoteAddr, hs.Version, countVersion(hs.Version, 1))
+	defer func() {
+		mutex.Lock()
+		log.Infof("%s 断开，当前在线客户端: %s", remoteAddr, countVersion(hs.Version, -1))
+		mutex.Unlock()
+	}()
 	if c2, ok := chats[id]; ok {
 		// 判断是否已经建立了连接
-		if c2.Target == c1 {
-			c1.Transfer.Send(message.NewMessage(message.MTypeClose, []byte("ID 已被占用")))
+		if c2.Target != nil {
+			c1.Transfer.SendAndClose(message.NewMessage(message.MTypeClose, []byte("ID 已被占用")))
 			log.Debugf("%s ID 已被占用\n", remoteAddr)
 		} else {
 			c1.Target = c2
 			c2.Target = c1
-			c1.Transfer.Send(hsMessage)
-			c2.Transfer.Send(hsMessage)
+			// 双方收到的都是对方的握手包，据此协商协议版本
+			c1.Transfer.Send(c2.Handshake)
+			c2.Transfer.Send(c1.Handshake)
 			log.Debugf("%s 已建立联系", remoteAddr)
 		}
 
@@ -110,22 +139,56 @@ func handleConn(conn net.Conn) {
 	}
 	mutex.Unlock()
 
-	// 转发消息
-	go func() {
-		for {
-			m := c1.Transfer.Receive()
-			if c1.Target != nil {
-				log.Debugf("%s -> %s : %v\n", remoteAddr, c1.Target.Conn.RemoteAddr().String(), m)
-				c1.Target.Transfer.Send(m)
-			}
+	// 转发消息，断开前收到的消息都转发后再通知对方
+	for {
+		m, ok := c1.Transfer.ReceiveUntilClose()
+		if !ok {
+			break
 		}
-	}()
+		if c1.Target != nil {
+			log.Debugf("%s -> %s : %v\n", remoteAddr, c1.Target.Conn.RemoteAddr().String(), m)
+			c1.Target.Transfer.Send(m)
+		}
+	}
 
 	// 如果断开连接
-	c1.Transfer.WaitClose()
-	log.Debugf("%s 连接关闭", remoteAddr)
-	delete(chats, c1.Id)
+	logClose(remoteAddr, c1.Transfer)
+	mutex.Lock()
+	if chats[c1.Id] == c1 {
+		delete(chats, c1.Id)
+	}
+	mutex.Unlock()
 	if c1.Target != nil {
 		c1.Target.Transfer.Send(message.NewMessage(message.MTypeClose, []byte("对方已断开")))
 	}
 }
+
+// logClose 记录连接关闭，因为收到不合法的帧而断开时记录原因
+func logClose(remoteAddr string, tf *transfer.Transfer) {
+	if err := tf.Err(); err != nil {
+		log.Warnf("%s 连接关闭: %s", remoteAddr, transfer.FrameErrorText(err))
+		return
+	}
+	log.Debugf("%s 连接关闭", remoteAddr)
+}
+
+// countVersion 修改 version 的在线客户端数，返回各版本的统计，调用方需要持有 mutex
+func countVersion(version byte, delta int) string {
+	versionCounts[version] += delta
+	if versionCounts[version] <= 0 {
+		delete(versionCounts, version)
+	}
+	versions := make([]int, 0, len(versionCounts))
+	for v := range versionCounts {
+		versions = append(versions, int(v))
+	}
+	sort.Ints(versions)
+	counts := make([]string, len(versions))
+	for i, v := range versions {
+		counts[i] = fmt.Sprintf("v%d=%d", v, versionCounts[byte(v)])
+	}
+	if len(counts) == 0 {
+		return "无"
+	}
+	return strings.Join(counts, " ")
+}
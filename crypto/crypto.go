@@ -2,30 +2,65 @@ package crypto
 
 import (
 	"crypto"
-	"crypto/rand"
+	"crypto/subtle"
 	"errors"
-	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
+	"io"
 )
 
+var (
+	ErrInvalidPublicKey = errors.New("Invalid public key")
+	ErrLowOrderPoint    = errors.New("Low order public key")
+	ErrZeroSharedSecret = errors.New("All-zero shared secret")
+)
+
+// ECDH 的 Unmarshal 和 GenerateSharedSecret 负责校验对方的公钥，
+// 不合法的公钥返回 ErrInvalidPublicKey 或 ErrLowOrderPoint，
+// 共享密钥全为 0 (对方没有贡献任何随机性) 时返回 ErrZeroSharedSecret
 type ECDH interface {
 	GenerateKey() (crypto.PrivateKey, crypto.PublicKey, error)
 	Marshal(crypto.PublicKey) []byte
-	Unmarshal([]byte) (crypto.PublicKey, bool)
+	Unmarshal([]byte) (crypto.PublicKey, error)
 	GenerateSharedSecret(crypto.PrivateKey, crypto.PublicKey) ([]byte, error)
 }
 
+// curve25519LowOrderPoints 是 curve25519 上阶为 1、2、4、8 的点(忽略最高位)，
+// 与任何私钥相乘的结果都是 0，对方用它们可以让共享密钥成为固定值
+var curve25519LowOrderPoints = [][32]byte{
+	// 0 (阶 4)
+	{},
+	// 1 (阶 1)
+	{0x01},
+	// 阶 8
+	{0xe0, 0xeb, 0x7a, 0x7c, 0x3b, 0x41, 0xb8, 0xae, 0x16, 0x56, 0xe3, 0xfa, 0xf1, 0x9f, 0xc4, 0x6a,
+		0xda, 0x09, 0x8d, 0xeb, 0x9c, 0x32, 0xb1, 0xfd, 0x86, 0x62, 0x05, 0x16, 0x5f, 0x49, 0xb8, 0x00},
+	// 阶 8
+	{0x5f, 0x9c, 0x95, 0xbc, 0xa3, 0x50, 0x8c, 0x24, 0xb1, 0xd0, 0xb1, 0x55, 0x9c, 0x83, 0xef, 0x5b,
+		0x04, 0x44, 0x5c, 0xc4, 0x58, 0x1c, 0x8e, 0x86, 0xd8, 0x22, 0x4e, 0xdd, 0xd0, 0x9f, 0x11, 0x57},
+	// p - 1 (阶 2)
+	{0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	// p (即 0)
+	{0xed, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	// p + 1 (即 1)
+	{0xee, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+}
+
 type curve25519ECDH struct {
 	ECDH
+	rand io.Reader
 }
 
-func NewCurve25519ECDH() ECDH {
-	return &curve25519ECDH{}
+// NewCurve25519ECDH 返回 X25519，私钥从 rand 读取
+func NewCurve25519ECDH(rand io.Reader) ECDH {
+	return &curve25519ECDH{rand: rand}
 }
 
 func (e *curve25519ECDH) GenerateKey() (crypto.PrivateKey, crypto.PublicKey, error) {
 	var publicKey, privateKey [32]byte
-	_, err := rand.Read(privateKey[:])
+	_, err := io.ReadFull(e.rand, privateKey[:])
 	if err != nil {
 		return nil, nil, err
 	}
@@ -36,18 +71,39 @@ func (e *curve25519ECDH) GenerateKey() (crypto.PrivateKey, crypto.PublicKey, err
 	return &privateKey, &publicKey, nil
 }
 
+// UnmarshalCurve25519PrivateKey 把 32 字节的 X25519 私钥转换成 NewCurve25519ECDH 使用的私钥类型
+func UnmarshalCurve25519PrivateKey(data []byte) (crypto.PrivateKey, bool) {
+	var privateKey [32]byte
+	if len(data) != 32 {
+		return nil, false
+	}
+	copy(privateKey[:], data)
+	return &privateKey, true
+}
+
 func (e *curve25519ECDH) Marshal(p crypto.PublicKey) []byte {
 	publicKey := p.(*[32]byte)
 	return publicKey[:]
 }
 
-func (e *curve25519ECDH) Unmarshal(data []byte) (crypto.PublicKey, bool) {
+func (e *curve25519ECDH) Unmarshal(data []byte) (crypto.PublicKey, error) {
 	var publicKey [32]byte
 	if len(data) != 32 {
-		return nil, false
+		return nil, ErrInvalidPublicKey
 	}
 	copy(publicKey[:], data)
-	return &publicKey, true
+
+	// X25519 忽略最高位，比较时同样忽略；逐个比较全部黑名单，耗时与公钥无关
+	masked := publicKey
+	masked[31] &= 0x7f
+	lowOrder := 0
+	for i := range curve25519LowOrderPoints {
+		lowOrder |= subtle.ConstantTimeCompare(masked[:], curve25519LowOrderPoints[i][:])
+	}
+	if lowOrder == 1 {
+		return nil, ErrLowOrderPoint
+	}
+	return &publicKey, nil
 }
 
 func (e *curve25519ECDH) GenerateSharedSecret(privateKey crypto.PrivateKey, publicKey crypto.PublicKey) ([]byte, error) {
@@ -56,33 +112,27 @@ func (e *curve25519ECDH) GenerateSharedSecret(privateKey crypto.PrivateKey, publ
 	public = publicKey.(*[32]byte)
 	secret = new([32]byte)
 	curve25519.ScalarMult(secret, private, public)
+
+	var zero [32]byte
+	if subtle.ConstantTimeCompare(secret[:], zero[:]) == 1 {
+		return nil, ErrZeroSharedSecret
+	}
 	return secret[:], nil
 }
 
 func Encrypt(data []byte, key []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		return nil, err
-	}
-
-	nonce := make([]byte, chacha20poly1305.NonceSizeX)
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, err
-	}
-	encrypted := aead.Seal(nonce[:], nonce, data, nil)
-
-	return encrypted, nil
+	return EncryptWithAD(data, key, nil)
 }
 
 func Decrypt(encrypted []byte, key []byte) ([]byte, error) {
-	if len(encrypted) < chacha20poly1305.NonceSizeX {
-		return nil, errors.New("Invalid encrypted data")
-	}
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		return nil, err
-	}
+	return DecryptWithAD(encrypted, key, nil)
+}
+
+// EncryptWithAD 使用 XChaCha20-Poly1305 加密数据并认证附加数据 ad，解密时必须提供相同的 ad
+func EncryptWithAD(data []byte, key []byte, ad []byte) ([]byte, error) {
+	return XChaCha20Poly1305.Encrypt(data, key, ad)
+}
 
-	nonce := encrypted[:chacha20poly1305.NonceSizeX]
-	return aead.Open(nil, nonce, encrypted[chacha20poly1305.NonceSizeX:], nil)
+func DecryptWithAD(encrypted []byte, key []byte, ad []byte) ([]byte, error) {
+	return XChaCha20Poly1305.Decrypt(encrypted, key, ad)
 }
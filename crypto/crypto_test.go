@@ -2,6 +2,9 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
 	"testing"
 )
 
@@ -11,7 +14,7 @@ var (
 )
 
 func TestCurve25519ECDH_GenerateSharedSecret(t *testing.T) {
-	ecdh := NewCurve25519ECDH()
+	ecdh := NewCurve25519ECDH(rand.Reader)
 	privKeyA, pubKeyA, err := ecdh.GenerateKey()
 	if err != nil {
 		t.Fatal("Fail to Generate Key")
@@ -25,14 +28,13 @@ func TestCurve25519ECDH_GenerateSharedSecret(t *testing.T) {
 	pubKeyAMarshal := ecdh.Marshal(pubKeyA)
 	pubKeyBMarshal := ecdh.Marshal(pubKeyB)
 
-	var ok bool
-	pubKeyA, ok = ecdh.Unmarshal(pubKeyAMarshal)
-	if !ok {
+	pubKeyA, err = ecdh.Unmarshal(pubKeyAMarshal)
+	if err != nil {
 		t.Fatal("Fail to Unmarshal public key")
 	}
 
-	pubKeyB, ok = ecdh.Unmarshal(pubKeyBMarshal)
-	if !ok {
+	pubKeyB, err = ecdh.Unmarshal(pubKeyBMarshal)
+	if err != nil {
 		t.Fatal("Fail to Unmarshal public key")
 	}
 
@@ -53,6 +55,37 @@ func TestCurve25519ECDH_GenerateSharedSecret(t *testing.T) {
 	}
 }
 
+func TestCurve25519ECDH_LowOrderPoints(t *testing.T) {
+	ecdh := NewCurve25519ECDH(rand.Reader)
+	privKey, _, err := ecdh.GenerateKey()
+	if err != nil {
+		t.Fatal("Fail to Generate Key")
+	}
+
+	for _, point := range curve25519LowOrderPoints {
+		// 最高位被 X25519 忽略，设置最高位的编码同样是小阶点
+		highBit := point
+		highBit[31] |= 0x80
+		for _, p := range [][32]byte{point, highBit} {
+			if _, err := ecdh.Unmarshal(p[:]); err != ErrLowOrderPoint {
+				t.Fatalf("Unmarshal must reject low order point %x, got: %v", p, err)
+			}
+
+			// 绕过 Unmarshal 时由共享密钥的检查拦截
+			pub := p
+			if _, err := ecdh.GenerateSharedSecret(privKey, &pub); err != ErrZeroSharedSecret {
+				t.Fatalf("GenerateSharedSecret must reject low order point %x, got: %v", p, err)
+			}
+		}
+	}
+
+	for _, data := range [][]byte{nil, make([]byte, 31), make([]byte, 33)} {
+		if _, err := ecdh.Unmarshal(data); err != ErrInvalidPublicKey {
+			t.Fatal("Unmarshal must reject public key of length ", len(data))
+		}
+	}
+}
+
 func TestEncrypt(t *testing.T) {
 	e, err := Encrypt(data, key)
 	if err != nil {
@@ -70,3 +103,256 @@ func TestEncrypt(t *testing.T) {
 		t.Fatal("Fail to decrypt data")
 	}
 }
+
+func TestDeriveSessionKeys(t *testing.T) {
+	secret := key
+	chatID := []byte("chat")
+	pubKeyA := bytes.Repeat([]byte{1}, 32)
+	pubKeyB := bytes.Repeat([]byte{2}, 32)
+
+	keysA, err := DeriveSessionKeys(secret, pubKeyA, pubKeyB, chatID)
+	if err != nil {
+		t.Fatal("Fail to derive session keys: ", err)
+	}
+	keysB, err := DeriveSessionKeys(secret, pubKeyB, pubKeyA, chatID)
+	if err != nil {
+		t.Fatal("Fail to derive session keys: ", err)
+	}
+
+	if !bytes.Equal(keysA.SendKey, keysB.ReceiveKey) || !bytes.Equal(keysA.ReceiveKey, keysB.SendKey) {
+		t.Fatal("Fail to derive matching directional keys")
+	}
+	if bytes.Equal(keysA.SendKey, keysA.ReceiveKey) {
+		t.Fatal("Send and receive keys must differ")
+	}
+	if !bytes.Equal(keysA.ConfirmKey, keysB.ConfirmKey) {
+		t.Fatal("Fail to derive equal confirm key")
+	}
+
+	if _, err := DeriveSessionKeys(secret, pubKeyA, pubKeyA, chatID); err == nil {
+		t.Fatal("Identical public keys must be rejected")
+	}
+}
+
+func TestKeyConfirmation(t *testing.T) {
+	pubKeyA := bytes.Repeat([]byte{1}, 32)
+	pubKeyB := bytes.Repeat([]byte{2}, 32)
+	keysA, _ := DeriveSessionKeys(key, pubKeyA, pubKeyB, []byte("chat"))
+	keysB, _ := DeriveSessionKeys(key, pubKeyB, pubKeyA, []byte("chat"))
+	transcript := []byte("transcript")
+
+	confirmA := keysA.KeyConfirmation(transcript)
+	confirmB := keysB.KeyConfirmation(transcript)
+	if err := keysB.VerifyKeyConfirmation(transcript, confirmA); err != nil {
+		t.Fatal("Fail to verify key confirmation: ", err)
+	}
+	if err := keysA.VerifyKeyConfirmation(transcript, confirmB); err != nil {
+		t.Fatal("Fail to verify key confirmation: ", err)
+	}
+
+	// 原样发回的确认消息
+	if err := keysA.VerifyKeyConfirmation(transcript, confirmA); err != ErrKeyMismatch {
+		t.Fatal("Reflected confirmation must fail with ErrKeyMismatch, got: ", err)
+	}
+	// 密钥不一致
+	keysC, _ := DeriveSessionKeys(data, pubKeyB, pubKeyA, []byte("chat"))
+	if err := keysC.VerifyKeyConfirmation(transcript, confirmA); err != ErrKeyMismatch {
+		t.Fatal("Confirmation with wrong key must fail with ErrKeyMismatch, got: ", err)
+	}
+	// 密钥一致但握手记录不同
+	if err := keysB.VerifyKeyConfirmation([]byte("tampered"), confirmA); err != ErrTranscriptMismatch {
+		t.Fatal("Confirmation over different transcript must fail with ErrTranscriptMismatch, got: ", err)
+	}
+	if err := keysB.VerifyKeyConfirmation(transcript, confirmA[1:]); err != ErrInvalidConfirmation {
+		t.Fatal("Short confirmation must fail with ErrInvalidConfirmation, got: ", err)
+	}
+}
+
+func TestEncryptWithAD(t *testing.T) {
+	e, err := EncryptWithAD(data, key, []byte("ad"))
+	if err != nil {
+		t.Fatal("Fail to encrypt data: ", err)
+	}
+
+	if _, err := DecryptWithAD(e, key, []byte("other")); err == nil {
+		t.Fatal("Decrypt with wrong associated data must fail")
+	}
+
+	d, err := DecryptWithAD(e, key, []byte("ad"))
+	if err != nil {
+		t.Fatal("Fail to decrypt data: ", err)
+	}
+	if !bytes.Equal(d, data) {
+		t.Fatal("Fail to decrypt data")
+	}
+}
+
+func TestCipherSuites(t *testing.T) {
+	for _, suite := range CipherSuites() {
+		e, err := suite.Encrypt(data, key, []byte("ad"))
+		if err != nil {
+			t.Fatal(suite.Name, ": Fail to encrypt data: ", err)
+		}
+		if len(e) != suite.NonceSize+len(data)+suite.TagSize {
+			t.Fatal(suite.Name, ": Wrong tag size: ", suite.TagSize)
+		}
+		if _, err := suite.Decrypt(e, key, []byte("other")); err == nil {
+			t.Fatal(suite.Name, ": Decrypt must fail with different additional data")
+		}
+		d, err := suite.Decrypt(e, key, []byte("ad"))
+		if err != nil || !bytes.Equal(d, data) {
+			t.Fatal(suite.Name, ": Fail to decrypt data: ", err)
+		}
+
+		if s, ok := CipherSuiteByName(strings.ToLower(suite.Name)); !ok || s != suite {
+			t.Fatal("Fail to find cipher suite by name: ", suite.Name)
+		}
+	}
+
+	both := []byte{AES256GCM.ID, XChaCha20Poly1305.ID}
+	if s, err := NegotiateCipherSuite(both, []byte{XChaCha20Poly1305.ID, AES256GCM.ID}); err != nil || s != XChaCha20Poly1305 {
+		t.Fatal("Negotiation must pick the strongest common suite regardless of order")
+	}
+	if s, err := NegotiateCipherSuite(both, []byte{AES256GCM.ID, 0xff}); err != nil || s != AES256GCM {
+		t.Fatal("Negotiation must pick the only common suite")
+	}
+	if _, err := NegotiateCipherSuite([]byte{XChaCha20Poly1305.ID}, []byte{AES256GCM.ID}); err != ErrNoCommonCipherSuite {
+		t.Fatal("Negotiation without common suite must fail, got: ", err)
+	}
+}
+
+// TestKeyExchanges 是所有密钥交换算法都要通过的一致性测试
+func TestKeyExchanges(t *testing.T) {
+	for _, kex := range KeyExchanges() {
+		ecdh := kex.ECDH
+		privKeyA, pubKeyA, err := ecdh.GenerateKey()
+		if err != nil {
+			t.Fatal(kex.Name, ": Fail to Generate Key")
+		}
+		privKeyB, pubKeyB, err := ecdh.GenerateKey()
+		if err != nil {
+			t.Fatal(kex.Name, ": Fail to Generate Key")
+		}
+
+		marshaled := ecdh.Marshal(pubKeyA)
+		pubKeyA, err = ecdh.Unmarshal(marshaled)
+		if err != nil || !bytes.Equal(ecdh.Marshal(pubKeyA), marshaled) {
+			t.Fatal(kex.Name, ": Fail to round trip public key: ", err)
+		}
+
+		secretA, err := ecdh.GenerateSharedSecret(privKeyA, pubKeyB)
+		if err != nil {
+			t.Fatal(kex.Name, ": Fail to GenerateSharedSecret: ", err)
+		}
+		secretB, err := ecdh.GenerateSharedSecret(privKeyB, pubKeyA)
+		if err != nil {
+			t.Fatal(kex.Name, ": Fail to GenerateSharedSecret: ", err)
+		}
+		if !bytes.Equal(secretA, secretB) {
+			t.Fatal(kex.Name, ": Fail to generate equal secret")
+		}
+
+		for _, bad := range [][]byte{nil, marshaled[:len(marshaled)-1], append(marshaled, 0)} {
+			if _, err := ecdh.Unmarshal(bad); err == nil {
+				t.Fatal(kex.Name, ": Public key with wrong length must be rejected")
+			}
+		}
+		// 全零的公钥对 X25519/X448 是小阶点，对 NIST 曲线不是合法的编码
+		if _, err := ecdh.Unmarshal(make([]byte, len(marshaled))); err == nil {
+			t.Fatal(kex.Name, ": All-zero public key must be rejected")
+		}
+
+		if k, ok := KeyExchangeByName(strings.ToLower(kex.Name)); !ok || k != kex {
+			t.Fatal("Fail to find key exchange by name: ", kex.Name)
+		}
+		if k, ok := KeyExchangeByID(kex.ID); !ok || k != kex {
+			t.Fatal("Fail to find key exchange by id: ", kex.Name)
+		}
+
+		a, b := newRatchetPairWith(t, ecdh, XChaCha20Poly1305)
+		for round := 0; round < 3; round++ {
+			mustDecrypt(t, b, encryptN(t, a, "a", 1)[0], "a 0")
+			mustDecrypt(t, a, encryptN(t, b, "b", 1)[0], "b 0")
+		}
+	}
+
+	if k, err := NegotiateKeyExchange([]byte{X448.ID, P256.ID, X25519.ID}, []byte{P256.ID, X25519.ID}); err != nil || k != X25519 {
+		t.Fatal("Negotiation must pick the preferred common key exchange")
+	}
+	if _, err := NegotiateKeyExchange([]byte{X25519.ID}, []byte{P384.ID}); err != ErrNoCommonKeyExchange {
+		t.Fatal("Negotiation without common key exchange must fail, got: ", err)
+	}
+
+	for _, k := range DefaultKeyExchanges() {
+		if k == X448 {
+			t.Fatal("Variable-time X448 must not be used by default")
+		}
+	}
+}
+
+func TestNISTECDH_OffCurve(t *testing.T) {
+	for _, kex := range []*KeyExchange{P256, P384} {
+		_, pub, err := kex.ECDH.GenerateKey()
+		if err != nil {
+			t.Fatal(kex.Name, ": Fail to Generate Key")
+		}
+		data := kex.ECDH.Marshal(pub)
+		data[len(data)-1] ^= 1
+		if _, err := kex.ECDH.Unmarshal(data); err != ErrInvalidPublicKey {
+			t.Fatal(kex.Name, ": Point not on the curve must be rejected, got: ", err)
+		}
+	}
+}
+
+// RFC 7748 6.2 节的测试向量
+func TestX448_RFC7748(t *testing.T) {
+	decode := func(s string) *[x448Size]byte {
+		var b [x448Size]byte
+		d, _ := hex.DecodeString(s)
+		copy(b[:], d)
+		return &b
+	}
+	alicePriv := decode("9a8f4925d1519f5775cf46b04b5800d4ee9ee8bae8bc5565d498c28dd9c9baf574a9419744897391006382a6f127ab1d9ac2d8c0a598726b")
+	alicePub := decode("9b08f7cc31b7e3e67d22d5aea121074a273bd2b83de09c63faa73d2c22c5d9bbc836647241d953d40c5b12da88120d53177f80e532c41fa0")
+	bobPriv := decode("1c306a7ac2a0e2e0990b294470cba339e6453772b075811d8fad0d1d6927c120bb5ee8972b0d3e21374c9c921b09d1b0366f10b65173992d")
+	bobPub := decode("3eb7a829b0cd20f5bcfc0b599b6feccf6da4627107bdb0d4f345b43027d8b972fc3e34fb4232a13ca706dcb57aec3dae07bdc1c67bf33609")
+	shared := "07fff4181ac6cc95ec1c16a94a0f74d12da232ce40a77552281d282bb60c0b56fd2464c335543936521c24403085d59a449a5037514a879d"
+
+	if *x448(alicePriv, x448Base) != *alicePub || *x448(bobPriv, x448Base) != *bobPub {
+		t.Fatal("X448 public key mismatch")
+	}
+	ecdh := NewX448ECDH(rand.Reader)
+	secret, err := ecdh.GenerateSharedSecret(alicePriv, bobPub)
+	if err != nil || hex.EncodeToString(secret) != shared {
+		t.Fatal("X448 shared secret mismatch: ", err)
+	}
+	one := make([]byte, x448Size)
+	one[0] = 1
+	if _, err := ecdh.Unmarshal(one); err != ErrLowOrderPoint {
+		t.Fatal("X448 low order point must be rejected, got: ", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w ReplayWindow
+	check := func(seq uint64, expected SequenceStatus, expectedLost uint64) {
+		status, lost := w.Check(seq)
+		if status != expected || lost != expectedLost {
+			t.Fatalf("Sequence %d: got status %d lost %d, expected %d lost %d", seq, status, lost, expected, expectedLost)
+		}
+		if status != SequenceReplay {
+			w.Accept(seq)
+		}
+	}
+
+	check(0, SequenceInOrder, 0)
+	check(1, SequenceInOrder, 0)
+	check(1, SequenceReplay, 0)
+	check(5, SequenceGap, 3)
+	check(3, SequenceLate, 0)
+	check(3, SequenceReplay, 0)
+	check(6, SequenceInOrder, 0)
+	check(6+ReplayWindowSize, SequenceGap, ReplayWindowSize-1)
+	check(4, SequenceReplay, 0)
+	check(7, SequenceLate, 0)
+}
@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// 签名时附加的上下文，避免身份密钥的签名被挪作他用
+var (
+	keyExchangeContext = []byte("terminal-encrypt-chat key exchange v1")
+	noiseStaticContext = []byte("terminal-encrypt-chat noise static key v1")
+)
+
+// Identity 是客户端的长期身份密钥对，用于对每次握手的临时公钥签名
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+// GenerateIdentity 生成新的身份密钥对，私钥从 rand 读取
+func GenerateIdentity(rand io.Reader) (*Identity, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PublicKey: publicKey, privateKey: privateKey}, nil
+}
+
+// UnmarshalIdentity 从 Marshal 得到的种子恢复身份密钥对
+func UnmarshalIdentity(seed []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Invalid identity seed")
+	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	return &Identity{
+		PublicKey:  privateKey.Public().(ed25519.PublicKey),
+		privateKey: privateKey,
+	}, nil
+}
+
+func (i *Identity) Marshal() []byte {
+	return i.privateKey.Seed()
+}
+
+// SignKeyExchange 对本次会话的临时公钥签名，签名同时绑定聊天 ID
+func (i *Identity) SignKeyExchange(chatID []byte, publicKey []byte) []byte {
+	return ed25519.Sign(i.privateKey, signedMessage(keyExchangeContext, chatID, publicKey))
+}
+
+func VerifyKeyExchange(identityKey ed25519.PublicKey, chatID []byte, publicKey []byte, signature []byte) bool {
+	return verify(identityKey, signedMessage(keyExchangeContext, chatID, publicKey), signature)
+}
+
+// NoiseStaticKey 由身份种子推导出 Noise 握手使用的 X25519 静态私钥，
+// 同一身份每次得到相同的静态密钥，对方才能记录下来用于 IK 握手
+func (i *Identity) NoiseStaticKey() []byte {
+	kdf := hkdf.New(sha256.New, i.privateKey.Seed(), nil, noiseStaticContext)
+	key := make([]byte, 32)
+	io.ReadFull(kdf, key)
+	return key
+}
+
+// SignNoiseStaticKey 对 Noise 静态公钥签名，把静态密钥和身份密钥绑定在一起
+func (i *Identity) SignNoiseStaticKey(chatID []byte, staticKey []byte) []byte {
+	return ed25519.Sign(i.privateKey, signedMessage(noiseStaticContext, chatID, staticKey))
+}
+
+func VerifyNoiseStaticKey(identityKey ed25519.PublicKey, chatID []byte, staticKey []byte, signature []byte) bool {
+	return verify(identityKey, signedMessage(noiseStaticContext, chatID, staticKey), signature)
+}
+
+func verify(identityKey ed25519.PublicKey, message []byte, signature []byte) bool {
+	if len(identityKey) != ed25519.PublicKeySize || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(identityKey, message, signature)
+}
+
+func signedMessage(context []byte, chatID []byte, publicKey []byte) []byte {
+	m := make([]byte, len(context)+4, len(context)+4+len(chatID)+len(publicKey))
+	copy(m, context)
+	binary.BigEndian.PutUint32(m[len(context):], uint32(len(chatID)))
+	m = append(m, chatID...)
+	m = append(m, publicKey...)
+	return m
+}
+
+// Fingerprint 返回身份公钥的 SHA-256 指纹(十六进制)
+func Fingerprint(identityKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(identityKey)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,143 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+)
+
+var ErrNoCommonKeyExchange = errors.New("No common key exchange")
+
+// KeyExchange 是一种 ECDH 算法，新增算法只需要在 keyExchanges 中注册
+type KeyExchange struct {
+	// ID 是协商和在线路上标记公钥时使用的编号
+	ID   byte
+	Name string
+	// ECDH 从 crypto/rand 读取私钥，需要其他随机数来源时使用 NewECDH
+	ECDH    ECDH
+	newECDH func(rand io.Reader) ECDH
+}
+
+func newKeyExchange(id byte, name string, newECDH func(rand io.Reader) ECDH) *KeyExchange {
+	return &KeyExchange{ID: id, Name: name, ECDH: newECDH(rand.Reader), newECDH: newECDH}
+}
+
+var (
+	X25519 = newKeyExchange(1, "X25519", NewCurve25519ECDH)
+	P256   = newKeyExchange(2, "P-256", func(r io.Reader) ECDH { return NewNISTECDH(elliptic.P256(), r) })
+	P384   = newKeyExchange(3, "P-384", func(r io.Reader) ECDH { return NewNISTECDH(elliptic.P384(), r) })
+	X448   = newKeyExchange(4, "X448", NewX448ECDH)
+)
+
+// NewECDH 返回从 rand 读取私钥的 ECDH
+func (k *KeyExchange) NewECDH(rand io.Reader) ECDH {
+	return k.newECDH(rand)
+}
+
+// keyExchanges 按优先级排列，协商时选择双方都支持的第一个。
+// X25519 最快且是常数时间实现，排在最前；P-256 和 P-384 用于需要 NIST 曲线的场合；
+// X448 的实现不是常数时间的，排在最后
+var keyExchanges = []*KeyExchange{X25519, P384, P256, X448}
+
+// KeyExchanges 返回所有支持的算法，按优先级排列
+func KeyExchanges() []*KeyExchange {
+	return append([]*KeyExchange{}, keyExchanges...)
+}
+
+// defaultKeyExchanges 是没有指定算法时使用的算法。X448 使用 math/big 实现，运算时间与私钥有关，
+// 不在默认算法中，只有明确指定时才使用
+var defaultKeyExchanges = []*KeyExchange{X25519, P384, P256}
+
+// DefaultKeyExchanges 返回默认使用的算法，按优先级排列，不包括 X448
+func DefaultKeyExchanges() []*KeyExchange {
+	return append([]*KeyExchange{}, defaultKeyExchanges...)
+}
+
+func KeyExchangeByID(id byte) (*KeyExchange, bool) {
+	for _, k := range keyExchanges {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// KeyExchangeByName 按名称查找算法，不区分大小写
+func KeyExchangeByName(name string) (*KeyExchange, bool) {
+	for _, k := range keyExchanges {
+		if strings.EqualFold(k.Name, name) {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// NegotiateKeyExchange 从双方支持的算法编号中选出优先级最高的一个，双方得到的结果相同
+func NegotiateKeyExchange(local []byte, remote []byte) (*KeyExchange, error) {
+	for _, k := range keyExchanges {
+		if containsByte(local, k.ID) && containsByte(remote, k.ID) {
+			return k, nil
+		}
+	}
+	return nil, ErrNoCommonKeyExchange
+}
+
+// nistECDH 使用 crypto/elliptic 中的 NIST 曲线，公钥为未压缩格式，
+// 共享密钥为共享点的 x 坐标
+type nistECDH struct {
+	ECDH
+	curve elliptic.Curve
+	rand  io.Reader
+}
+
+// NewNISTECDH 返回使用 curve 的 ECDH，私钥从 rand 读取
+func NewNISTECDH(curve elliptic.Curve, rand io.Reader) ECDH {
+	return &nistECDH{curve: curve, rand: rand}
+}
+
+type nistPublicKey struct {
+	x, y *big.Int
+}
+
+func (e *nistECDH) GenerateKey() (crypto.PrivateKey, crypto.PublicKey, error) {
+	privateKey, x, y, err := elliptic.GenerateKey(e.curve, e.rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	return privateKey, &nistPublicKey{x: x, y: y}, nil
+}
+
+func (e *nistECDH) Marshal(p crypto.PublicKey) []byte {
+	publicKey := p.(*nistPublicKey)
+	return elliptic.Marshal(e.curve, publicKey.x, publicKey.y)
+}
+
+// Unmarshal 只接受曲线上的点，NIST 曲线的阶是素数，曲线上除无穷远点外没有小阶点
+func (e *nistECDH) Unmarshal(data []byte) (crypto.PublicKey, error) {
+	byteLen := (e.curve.Params().BitSize + 7) / 8
+	if len(data) != 1+2*byteLen || data[0] != 4 {
+		return nil, ErrInvalidPublicKey
+	}
+	x, y := elliptic.Unmarshal(e.curve, data)
+	if x == nil || !e.curve.IsOnCurve(x, y) {
+		return nil, ErrInvalidPublicKey
+	}
+	return &nistPublicKey{x: x, y: y}, nil
+}
+
+func (e *nistECDH) GenerateSharedSecret(privateKey crypto.PrivateKey, publicKey crypto.PublicKey) ([]byte, error) {
+	public := publicKey.(*nistPublicKey)
+	x, y := e.curve.ScalarMult(public.x, public.y, privateKey.([]byte))
+	if x.Sign() == 0 && y.Sign() == 0 {
+		return nil, ErrZeroSharedSecret
+	}
+
+	secret := make([]byte, (e.curve.Params().BitSize+7)/8)
+	xBytes := x.Bytes()
+	copy(secret[len(secret)-len(xBytes):], xBytes)
+	return secret, nil
+}
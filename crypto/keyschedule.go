@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+const sessionKeySize = 32
+
+var (
+	sessionKeysContext  = []byte("terminal-encrypt-chat session keys v1")
+	keyConfirmContext   = []byte("terminal-encrypt-chat key confirmation v1")
+	keyConfirmationSize = sha256.Size * 2
+
+	ErrInvalidConfirmation = errors.New("Invalid key confirmation message")
+	ErrKeyMismatch         = errors.New("Key confirmation MAC mismatch")
+	ErrTranscriptMismatch  = errors.New("Handshake transcript mismatch")
+)
+
+// SessionKeys 是由共享密钥推导出的会话密钥，收发两个方向使用不同的密钥
+type SessionKeys struct {
+	SendKey    []byte
+	ReceiveKey []byte
+	ConfirmKey []byte
+	RootKey    []byte
+	// Initiator 表示本机公钥较小(即 A 方)，在 Double Ratchet 中率先进行 DH 棘轮
+	Initiator bool
+}
+
+// DeriveSessionKeys 对 ECDH 共享密钥、双方公钥和聊天 ID 做 HKDF-SHA256，
+// 公钥较小的一方为 A，依次推导出 A->B、B->A、密钥确认和根密钥
+func DeriveSessionKeys(secret []byte, localPublicKey []byte, remotePublicKey []byte, chatID []byte) (*SessionKeys, error) {
+	return deriveSessionKeys(secret, nil, localPublicKey, remotePublicKey, chatID)
+}
+
+// DeriveSessionKeysWithPSK 同 DeriveSessionKeys，psk (如 PAKE 得到的共享密钥) 作为 HKDF 的 salt 混入，
+// 不知道 psk 的一方即使完成了 ECDH 也无法得到会话密钥。
+// context 代替聊天 ID，可以包含聊天 ID 和握手前协商的参数，双方看到的参数不一致时会得到不同的密钥
+func DeriveSessionKeysWithPSK(secret []byte, psk []byte, localPublicKey []byte, remotePublicKey []byte, context []byte) (*SessionKeys, error) {
+	return deriveSessionKeys(secret, psk, localPublicKey, remotePublicKey, context)
+}
+
+// Next 用会话中新一次 ECDH 的结果更新密钥，当前根密钥作为 HKDF 的 salt 混入，
+// 新密钥同时依赖之前的会话和新的临时密钥
+func (k *SessionKeys) Next(secret []byte, localPublicKey []byte, remotePublicKey []byte, chatID []byte) (*SessionKeys, error) {
+	return deriveSessionKeys(secret, k.RootKey, localPublicKey, remotePublicKey, chatID)
+}
+
+func deriveSessionKeys(secret []byte, salt []byte, localPublicKey []byte, remotePublicKey []byte, chatID []byte) (*SessionKeys, error) {
+	order := bytes.Compare(localPublicKey, remotePublicKey)
+	if order == 0 {
+		return nil, errors.New("Local and remote public keys are identical")
+	}
+	publicKeyA, publicKeyB := localPublicKey, remotePublicKey
+	if order > 0 {
+		publicKeyA, publicKeyB = remotePublicKey, localPublicKey
+	}
+
+	info := append([]byte{}, sessionKeysContext...)
+	for _, part := range [][]byte{chatID, publicKeyA, publicKeyB} {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(part)))
+		info = append(info, length[:]...)
+		info = append(info, part...)
+	}
+
+	kdf := hkdf.New(sha256.New, secret, salt, info)
+	keyAB := make([]byte, sessionKeySize)
+	keyBA := make([]byte, sessionKeySize)
+	confirmKey := make([]byte, sessionKeySize)
+	rootKey := make([]byte, sessionKeySize)
+	for _, k := range [][]byte{keyAB, keyBA, confirmKey, rootKey} {
+		if _, err := io.ReadFull(kdf, k); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := &SessionKeys{ConfirmKey: confirmKey, RootKey: rootKey, Initiator: order < 0}
+	if keys.Initiator {
+		keys.SendKey, keys.ReceiveKey = keyAB, keyBA
+	} else {
+		keys.SendKey, keys.ReceiveKey = keyBA, keyAB
+	}
+	return keys, nil
+}
+
+// KeyConfirmation 返回密钥确认消息: 握手记录的哈希(32) + 用 ConfirmKey 对角色和哈希计算的 MAC(32)。
+// 角色由 Initiator 决定，对方不能把本方的确认消息原样发回
+func (k *SessionKeys) KeyConfirmation(transcript []byte) []byte {
+	hash := sha256.Sum256(transcript)
+	return append(hash[:], k.confirmationMAC(k.Initiator, hash[:])...)
+}
+
+// VerifyKeyConfirmation 验证对方的密钥确认消息。MAC 不正确说明双方的密钥不一致，返回 ErrKeyMismatch；
+// MAC 正确但哈希与本方的握手记录不同，说明握手消息在途中被篡改，返回 ErrTranscriptMismatch
+func (k *SessionKeys) VerifyKeyConfirmation(transcript []byte, message []byte) error {
+	if len(message) != keyConfirmationSize {
+		return ErrInvalidConfirmation
+	}
+	peerHash, mac := message[:sha256.Size], message[sha256.Size:]
+	if !hmac.Equal(mac, k.confirmationMAC(!k.Initiator, peerHash)) {
+		return ErrKeyMismatch
+	}
+	hash := sha256.Sum256(transcript)
+	if !hmac.Equal(peerHash, hash[:]) {
+		return ErrTranscriptMismatch
+	}
+	return nil
+}
+
+func (k *SessionKeys) confirmationMAC(initiator bool, hash []byte) []byte {
+	role := byte('B')
+	if initiator {
+		role = 'A'
+	}
+	mac := hmac.New(sha256.New, k.ConfirmKey)
+	mac.Write(keyConfirmContext)
+	mac.Write([]byte{role})
+	mac.Write(hash)
+	return mac.Sum(nil)
+}
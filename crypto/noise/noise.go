@@ -0,0 +1,491 @@
+// Package noise 实现 Noise Protocol Framework (revision 34) 中的 XX 和 IK 握手模式，
+// DH 使用 25519，加密使用 ChaChaPoly，哈希可选 SHA256 或 BLAKE2s。
+package noise
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"hash"
+	"io"
+	"math"
+)
+
+const (
+	DHLen         = 32
+	MaxMessageLen = 65535
+	tagLen        = 16
+)
+
+var (
+	ErrShortMessage     = errors.New("noise: message is too short")
+	ErrMessageTooLong   = errors.New("noise: message is too long")
+	ErrUnexpectedTurn   = errors.New("noise: unexpected handshake message direction")
+	ErrHandshakeDone    = errors.New("noise: handshake is already complete")
+	ErrMissingPeerKey   = errors.New("noise: peer static key is required by the pattern")
+	ErrMissingStaticKey = errors.New("noise: static key is required by the pattern")
+	ErrInvalidDH        = errors.New("noise: invalid DH result")
+	ErrNonceExhausted   = errors.New("noise: nonce exhausted")
+)
+
+type HashFunc struct {
+	Name string
+	New  func() hash.Hash
+}
+
+var (
+	SHA256  = HashFunc{Name: "SHA256", New: sha256.New}
+	BLAKE2s = HashFunc{Name: "BLAKE2s", New: func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}}
+)
+
+type token int
+
+const (
+	tokenE token = iota
+	tokenS
+	tokenEE
+	tokenES
+	tokenSE
+	tokenSS
+)
+
+// Pattern 是握手模式，messages 中偶数下标的消息由发起方发送
+type Pattern struct {
+	Name                 string
+	initiatorPreMessages []token
+	responderPreMessages []token
+	messages             [][]token
+}
+
+var (
+	// XX 双方在握手中互相发送静态公钥，不需要预先知道对方
+	XX = &Pattern{
+		Name: "XX",
+		messages: [][]token{
+			{tokenE},
+			{tokenE, tokenEE, tokenS, tokenES},
+			{tokenS, tokenSE},
+		},
+	}
+	// IK 发起方预先知道响应方的静态公钥，只需一个来回
+	IK = &Pattern{
+		Name:                 "IK",
+		responderPreMessages: []token{tokenS},
+		messages: [][]token{
+			{tokenE, tokenES, tokenS, tokenSS},
+			{tokenE, tokenEE, tokenSE},
+		},
+	}
+)
+
+// Len 返回握手消息的条数
+func (p *Pattern) Len() int {
+	return len(p.messages)
+}
+
+type DHKey struct {
+	Private []byte
+	Public  []byte
+}
+
+// GenerateKeypair 从 random 读取 32 字节作为 25519 私钥
+func GenerateKeypair(random io.Reader) (DHKey, error) {
+	var private, public [DHLen]byte
+	if _, err := io.ReadFull(random, private[:]); err != nil {
+		return DHKey{}, err
+	}
+	curve25519.ScalarBaseMult(&public, &private)
+	return DHKey{Private: private[:], Public: public[:]}, nil
+}
+
+func dh(private []byte, public []byte) ([]byte, error) {
+	var priv, pub, out [DHLen]byte
+	copy(priv[:], private)
+	copy(pub[:], public)
+	curve25519.ScalarMult(&out, &priv, &pub)
+	var zero [DHLen]byte
+	if subtle.ConstantTimeCompare(out[:], zero[:]) == 1 {
+		return nil, ErrInvalidDH
+	}
+	return out[:], nil
+}
+
+// CipherState 使用 ChaChaPoly，nonce 为 4 字节 0 加 8 字节小端计数器
+type CipherState struct {
+	k      []byte
+	n      uint64
+	hasKey bool
+}
+
+func (c *CipherState) initializeKey(k []byte) {
+	c.k = k
+	c.n = 0
+	c.hasKey = true
+}
+
+func (c *CipherState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.n)
+	return nonce
+}
+
+func (c *CipherState) Encrypt(out, ad, plaintext []byte) ([]byte, error) {
+	if !c.hasKey {
+		return append(out, plaintext...), nil
+	}
+	if c.n == math.MaxUint64 {
+		return nil, ErrNonceExhausted
+	}
+	aead, err := chacha20poly1305.New(c.k)
+	if err != nil {
+		return nil, err
+	}
+	out = aead.Seal(out, c.nonce(), plaintext, ad)
+	c.n++
+	return out, nil
+}
+
+func (c *CipherState) Decrypt(out, ad, ciphertext []byte) ([]byte, error) {
+	if !c.hasKey {
+		return append(out, ciphertext...), nil
+	}
+	if c.n == math.MaxUint64 {
+		return nil, ErrNonceExhausted
+	}
+	aead, err := chacha20poly1305.New(c.k)
+	if err != nil {
+		return nil, err
+	}
+	out, err = aead.Open(out, c.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	c.n++
+	return out, nil
+}
+
+// UnsafeKey 返回当前密钥，用于从握手结果继续推导其他密钥
+func (c *CipherState) UnsafeKey() []byte {
+	return append([]byte{}, c.k...)
+}
+
+type symmetricState struct {
+	CipherState
+	hash HashFunc
+	ck   []byte
+	h    []byte
+}
+
+func (s *symmetricState) initialize(protocolName []byte) {
+	size := s.hash.New().Size()
+	if len(protocolName) <= size {
+		s.h = make([]byte, size)
+		copy(s.h, protocolName)
+	} else {
+		h := s.hash.New()
+		h.Write(protocolName)
+		s.h = h.Sum(nil)
+	}
+	s.ck = append([]byte{}, s.h...)
+}
+
+func (s *symmetricState) hkdf(ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(s.hash.New, s.ck)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(s.hash.New, tempKey)
+	mac.Write([]byte{1})
+	output1 := mac.Sum(nil)
+
+	mac = hmac.New(s.hash.New, tempKey)
+	mac.Write(output1)
+	mac.Write([]byte{2})
+	output2 := mac.Sum(nil)
+	return output1, output2
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	var tempKey []byte
+	s.ck, tempKey = s.hkdf(ikm)
+	s.initializeKey(tempKey[:chacha20poly1305.KeySize])
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := s.hash.New()
+	h.Write(s.h)
+	h.Write(data)
+	s.h = h.Sum(nil)
+}
+
+func (s *symmetricState) encryptAndHash(out, plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.Encrypt(nil, s.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return append(out, ciphertext...), nil
+}
+
+func (s *symmetricState) decryptAndHash(out, ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.Decrypt(out, s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (s *symmetricState) split() (*CipherState, *CipherState) {
+	tempKey1, tempKey2 := s.hkdf(nil)
+	c1, c2 := &CipherState{}, &CipherState{}
+	c1.initializeKey(tempKey1[:chacha20poly1305.KeySize])
+	c2.initializeKey(tempKey2[:chacha20poly1305.KeySize])
+	return c1, c2
+}
+
+type Config struct {
+	Pattern   *Pattern
+	Hash      HashFunc
+	Initiator bool
+	Prologue  []byte
+	// StaticKeypair 是本方的静态密钥对
+	StaticKeypair DHKey
+	// PeerStatic 是预先知道的对方静态公钥，IK 模式的发起方必须提供
+	PeerStatic []byte
+	// Random 用于生成临时密钥，默认为 crypto/rand
+	Random io.Reader
+}
+
+type HandshakeState struct {
+	ss        symmetricState
+	s         DHKey
+	e         DHKey
+	rs        []byte
+	re        []byte
+	initiator bool
+	pattern   *Pattern
+	index     int
+	random    io.Reader
+}
+
+func NewHandshakeState(c Config) (*HandshakeState, error) {
+	hs := &HandshakeState{
+		ss:        symmetricState{hash: c.Hash},
+		s:         c.StaticKeypair,
+		rs:        c.PeerStatic,
+		initiator: c.Initiator,
+		pattern:   c.Pattern,
+		random:    c.Random,
+	}
+	if hs.random == nil {
+		hs.random = rand.Reader
+	}
+
+	hs.ss.initialize([]byte("Noise_" + c.Pattern.Name + "_25519_ChaChaPoly_" + c.Hash.Name))
+	hs.ss.mixHash(c.Prologue)
+
+	// 预先知道的公钥按发起方、响应方的顺序混入
+	for _, t := range c.Pattern.initiatorPreMessages {
+		if t == tokenS {
+			if err := hs.mixPreMessageKey(c.Initiator); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, t := range c.Pattern.responderPreMessages {
+		if t == tokenS {
+			if err := hs.mixPreMessageKey(!c.Initiator); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hs, nil
+}
+
+func (hs *HandshakeState) mixPreMessageKey(local bool) error {
+	if local {
+		if len(hs.s.Public) != DHLen {
+			return ErrMissingStaticKey
+		}
+		hs.ss.mixHash(hs.s.Public)
+		return nil
+	}
+	if len(hs.rs) != DHLen {
+		return ErrMissingPeerKey
+	}
+	hs.ss.mixHash(hs.rs)
+	return nil
+}
+
+// WriteMessage 生成下一条握手消息。握手的最后一条消息完成后返回两个 CipherState，
+// 第一个用于发起方发送，第二个用于响应方发送
+func (hs *HandshakeState) WriteMessage(out, payload []byte) ([]byte, *CipherState, *CipherState, error) {
+	if hs.index >= len(hs.pattern.messages) {
+		return nil, nil, nil, ErrHandshakeDone
+	}
+	if (hs.index%2 == 0) != hs.initiator {
+		return nil, nil, nil, ErrUnexpectedTurn
+	}
+
+	var err error
+	for _, t := range hs.pattern.messages[hs.index] {
+		switch t {
+		case tokenE:
+			hs.e, err = GenerateKeypair(hs.random)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			out = append(out, hs.e.Public...)
+			hs.ss.mixHash(hs.e.Public)
+		case tokenS:
+			if len(hs.s.Public) != DHLen {
+				return nil, nil, nil, ErrMissingStaticKey
+			}
+			out, err = hs.ss.encryptAndHash(out, hs.s.Public)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		default:
+			if err := hs.dhToken(t); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+
+	out, err = hs.ss.encryptAndHash(out, payload)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(out) > MaxMessageLen {
+		return nil, nil, nil, ErrMessageTooLong
+	}
+
+	hs.index++
+	if hs.index == len(hs.pattern.messages) {
+		c1, c2 := hs.ss.split()
+		return out, c1, c2, nil
+	}
+	return out, nil, nil, nil
+}
+
+// ReadMessage 处理对方的握手消息并返回其中的 payload，返回的 CipherState 同 WriteMessage
+func (hs *HandshakeState) ReadMessage(out, message []byte) ([]byte, *CipherState, *CipherState, error) {
+	if hs.index >= len(hs.pattern.messages) {
+		return nil, nil, nil, ErrHandshakeDone
+	}
+	if (hs.index%2 == 0) == hs.initiator {
+		return nil, nil, nil, ErrUnexpectedTurn
+	}
+	if len(message) > MaxMessageLen {
+		return nil, nil, nil, ErrMessageTooLong
+	}
+
+	var err error
+	for _, t := range hs.pattern.messages[hs.index] {
+		switch t {
+		case tokenE:
+			if len(message) < DHLen {
+				return nil, nil, nil, ErrShortMessage
+			}
+			hs.re = append([]byte{}, message[:DHLen]...)
+			message = message[DHLen:]
+			hs.ss.mixHash(hs.re)
+		case tokenS:
+			size := DHLen
+			if hs.ss.hasKey {
+				size += tagLen
+			}
+			if len(message) < size {
+				return nil, nil, nil, ErrShortMessage
+			}
+			hs.rs, err = hs.ss.decryptAndHash(nil, message[:size])
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			message = message[size:]
+		default:
+			if err := hs.dhToken(t); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+
+	if hs.ss.hasKey && len(message) < tagLen {
+		return nil, nil, nil, ErrShortMessage
+	}
+	out, err = hs.ss.decryptAndHash(out, message)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	hs.index++
+	if hs.index == len(hs.pattern.messages) {
+		c1, c2 := hs.ss.split()
+		return out, c1, c2, nil
+	}
+	return out, nil, nil, nil
+}
+
+// PeerStatic 返回对方的静态公钥，握手中收到对方静态公钥后才可用
+func (hs *HandshakeState) PeerStatic() []byte {
+	return hs.rs
+}
+
+// LocalEphemeral 返回本方本次握手的临时密钥对
+func (hs *HandshakeState) LocalEphemeral() DHKey {
+	return hs.e
+}
+
+// PeerEphemeral 返回对方本次握手的临时公钥
+func (hs *HandshakeState) PeerEphemeral() []byte {
+	return hs.re
+}
+
+// ChannelBinding 返回握手哈希，双方一致说明看到的是同一次握手
+func (hs *HandshakeState) ChannelBinding() []byte {
+	return hs.ss.h
+}
+
+func (hs *HandshakeState) dhToken(t token) error {
+	var private, public []byte
+	switch t {
+	case tokenEE:
+		private, public = hs.e.Private, hs.re
+	case tokenSS:
+		private, public = hs.s.Private, hs.rs
+	case tokenES:
+		if hs.initiator {
+			private, public = hs.e.Private, hs.rs
+		} else {
+			private, public = hs.s.Private, hs.re
+		}
+	case tokenSE:
+		if hs.initiator {
+			private, public = hs.s.Private, hs.re
+		} else {
+			private, public = hs.e.Private, hs.rs
+		}
+	}
+	if len(private) != DHLen {
+		return ErrMissingStaticKey
+	}
+	if len(public) != DHLen {
+		return ErrMissingPeerKey
+	}
+	k, err := dh(private, public)
+	if err != nil {
+		return err
+	}
+	hs.ss.mixKey(k)
+	return nil
+}
@@ -0,0 +1,232 @@
+package noise
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+type vector struct {
+	name     string
+	fields   map[string][]byte
+	messages []vectorMessage
+}
+
+type vectorMessage struct {
+	payload    []byte
+	ciphertext []byte
+}
+
+func loadVectors(t *testing.T) []*vector {
+	f, err := os.Open("testdata/vectors.txt")
+	if err != nil {
+		t.Fatal("Fail to open test vectors: ", err)
+	}
+	defer f.Close()
+
+	var vectors []*vector
+	var v *vector
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			t.Fatal("Invalid vector line: ", line)
+		}
+		if parts[0] == "handshake" {
+			v = &vector{name: parts[1], fields: make(map[string][]byte)}
+			vectors = append(vectors, v)
+			continue
+		}
+		value, err := hex.DecodeString(parts[1])
+		if err != nil {
+			t.Fatal("Invalid vector value: ", line)
+		}
+
+		var index int
+		var kind string
+		if n, _ := fmt.Sscanf(strings.Replace(parts[0], "_", " ", -1), "msg %d %s", &index, &kind); n == 2 {
+			for len(v.messages) <= index {
+				v.messages = append(v.messages, vectorMessage{})
+			}
+			if kind == "payload" {
+				v.messages[index].payload = value
+			} else {
+				v.messages[index].ciphertext = value
+			}
+			continue
+		}
+		v.fields[parts[0]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal("Fail to read test vectors: ", err)
+	}
+	return vectors
+}
+
+func keypair(t *testing.T, private []byte) DHKey {
+	if private == nil {
+		return DHKey{}
+	}
+	k, err := GenerateKeypair(bytes.NewReader(private))
+	if err != nil {
+		t.Fatal("Fail to generate keypair: ", err)
+	}
+	return k
+}
+
+func TestVectors(t *testing.T) {
+	vectors := loadVectors(t)
+	if len(vectors) == 0 {
+		t.Fatal("No test vectors")
+	}
+
+	for _, v := range vectors {
+		var pattern *Pattern
+		var hash HashFunc
+		switch {
+		case strings.HasPrefix(v.name, "Noise_XX_"):
+			pattern = XX
+		case strings.HasPrefix(v.name, "Noise_IK_"):
+			pattern = IK
+		default:
+			t.Fatal("Unknown pattern: ", v.name)
+		}
+		switch {
+		case strings.HasSuffix(v.name, "_SHA256"):
+			hash = SHA256
+		case strings.HasSuffix(v.name, "_BLAKE2s"):
+			hash = BLAKE2s
+		default:
+			t.Fatal("Unknown hash: ", v.name)
+		}
+
+		responderStatic := keypair(t, v.fields["resp_static"])
+		initiator, err := NewHandshakeState(Config{
+			Pattern:       pattern,
+			Hash:          hash,
+			Initiator:     true,
+			Prologue:      v.fields["prologue"],
+			StaticKeypair: keypair(t, v.fields["init_static"]),
+			PeerStatic:    responderStatic.Public,
+			Random:        bytes.NewReader(v.fields["gen_init_ephemeral"]),
+		})
+		if err != nil {
+			t.Fatal(v.name, ": Fail to create initiator: ", err)
+		}
+		responder, err := NewHandshakeState(Config{
+			Pattern:       pattern,
+			Hash:          hash,
+			Initiator:     false,
+			Prologue:      v.fields["prologue"],
+			StaticKeypair: responderStatic,
+			Random:        bytes.NewReader(v.fields["gen_resp_ephemeral"]),
+		})
+		if err != nil {
+			t.Fatal(v.name, ": Fail to create responder: ", err)
+		}
+
+		// 握手消息由双方交替发送，握手完成后的传输消息重新从发起方开始交替
+		var initiatorSend, initiatorReceive, responderSend, responderReceive *CipherState
+		handshakeLen := 0
+		for i, m := range v.messages {
+			var ciphertext, payload []byte
+			if initiatorSend == nil {
+				var c1, c2 *CipherState
+				if i%2 == 0 {
+					ciphertext, c1, c2, err = initiator.WriteMessage(nil, m.payload)
+					if err == nil {
+						initiatorSend, initiatorReceive = c1, c2
+						payload, c1, c2, err = responder.ReadMessage(nil, ciphertext)
+						responderReceive, responderSend = c1, c2
+					}
+				} else {
+					ciphertext, c1, c2, err = responder.WriteMessage(nil, m.payload)
+					if err == nil {
+						responderReceive, responderSend = c1, c2
+						payload, c1, c2, err = initiator.ReadMessage(nil, ciphertext)
+						initiatorSend, initiatorReceive = c1, c2
+					}
+				}
+				handshakeLen = i + 1
+			} else if (i-handshakeLen)%2 == 0 {
+				ciphertext, err = initiatorSend.Encrypt(nil, nil, m.payload)
+				if err == nil {
+					payload, err = responderReceive.Decrypt(nil, nil, ciphertext)
+				}
+			} else {
+				ciphertext, err = responderSend.Encrypt(nil, nil, m.payload)
+				if err == nil {
+					payload, err = initiatorReceive.Decrypt(nil, nil, ciphertext)
+				}
+			}
+
+			if err != nil {
+				t.Fatalf("%s: message %d: %s", v.name, i, err)
+			}
+			if !bytes.Equal(ciphertext, m.ciphertext) {
+				t.Fatalf("%s: message %d: ciphertext mismatch\n got %x\nwant %x", v.name, i, ciphertext, m.ciphertext)
+			}
+			if !bytes.Equal(payload, m.payload) {
+				t.Fatalf("%s: message %d: payload mismatch", v.name, i)
+			}
+		}
+
+		if !bytes.Equal(initiator.ChannelBinding(), responder.ChannelBinding()) {
+			t.Fatal(v.name, ": Handshake hash mismatch")
+		}
+	}
+}
+
+func TestIKWrongPeerStatic(t *testing.T) {
+	responderStatic := keypair(t, bytes.Repeat([]byte{1}, DHLen))
+	otherStatic := keypair(t, bytes.Repeat([]byte{2}, DHLen))
+
+	initiator, err := NewHandshakeState(Config{
+		Pattern:       IK,
+		Hash:          BLAKE2s,
+		Initiator:     true,
+		StaticKeypair: keypair(t, bytes.Repeat([]byte{3}, DHLen)),
+		PeerStatic:    otherStatic.Public,
+	})
+	if err != nil {
+		t.Fatal("Fail to create initiator: ", err)
+	}
+	responder, err := NewHandshakeState(Config{
+		Pattern:       IK,
+		Hash:          BLAKE2s,
+		StaticKeypair: responderStatic,
+	})
+	if err != nil {
+		t.Fatal("Fail to create responder: ", err)
+	}
+
+	m, _, _, err := initiator.WriteMessage(nil, []byte("hello"))
+	if err != nil {
+		t.Fatal("Fail to write message: ", err)
+	}
+	if _, _, _, err := responder.ReadMessage(nil, m); err == nil {
+		t.Fatal("Message encrypted to a different static key must be rejected")
+	}
+}
+
+func TestHandshakeTurns(t *testing.T) {
+	hs, err := NewHandshakeState(Config{Pattern: XX, Hash: SHA256})
+	if err != nil {
+		t.Fatal("Fail to create responder: ", err)
+	}
+	if _, _, _, err := hs.WriteMessage(nil, nil); err != ErrUnexpectedTurn {
+		t.Fatal("Responder must not write the first message, got: ", err)
+	}
+	if _, err := NewHandshakeState(Config{Pattern: IK, Hash: SHA256, Initiator: true}); err != ErrMissingPeerKey {
+		t.Fatal("IK initiator without peer static key must be rejected, got: ", err)
+	}
+}
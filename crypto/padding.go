@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"errors"
+	"strings"
+)
+
+// paddingMinSize 是填充后的最小长度，短消息都填充到这个长度
+const paddingMinSize = 32
+
+var ErrInvalidPadding = errors.New("Invalid padding")
+
+// Padding 是一种填充方案，决定明文填充后的长度，用于隐藏消息的真实长度。
+// 所有方案都使用相同的格式: 明文 + 0x80 + 0x00...，接收方不需要知道对方使用的方案就能去掉填充
+type Padding struct {
+	Name string
+	size func(n int) int
+}
+
+var (
+	// PaddingNone 只添加 0x80 标记，不隐藏长度
+	PaddingNone = &Padding{Name: "none", size: func(n int) int { return n }}
+	// PaddingPadme 使用 Padmé 方案，填充后的长度最多比原长度多约 12%，
+	// 长度为 L 的消息只会泄露 O(log log L) 位信息
+	PaddingPadme = &Padding{Name: "padme", size: padmeSize}
+	// PaddingPow2 填充到 2 的幂，隐藏效果更好，最多多出一倍
+	PaddingPow2 = &Padding{Name: "pow2", size: pow2Size}
+)
+
+var paddings = []*Padding{PaddingPadme, PaddingPow2, PaddingNone}
+
+// Paddings 返回所有支持的填充方案，第一个为默认方案
+func Paddings() []*Padding {
+	return append([]*Padding{}, paddings...)
+}
+
+// PaddingByName 按名称查找填充方案，不区分大小写
+func PaddingByName(name string) (*Padding, bool) {
+	for _, p := range paddings {
+		if strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Size 返回长度为 n 的明文填充后的长度，包含 0x80 标记
+func (p *Padding) Size(n int) int {
+	return p.size(n + 1)
+}
+
+// Pad 在明文后添加 0x80 和若干 0x00，填充到方案决定的长度
+func (p *Padding) Pad(data []byte) []byte {
+	padded := make([]byte, p.Size(len(data)))
+	copy(padded, data)
+	padded[len(data)] = 0x80
+	return padded
+}
+
+// Unpad 去掉 Pad 添加的填充
+func Unpad(data []byte) ([]byte, error) {
+	for i := len(data) - 1; i >= 0; i-- {
+		switch data[i] {
+		case 0x00:
+			continue
+		case 0x80:
+			return data[:i], nil
+		}
+		break
+	}
+	return nil, ErrInvalidPadding
+}
+
+// padmeSize 按 Padmé 计算长度: 保留最高的 floor(log2(E))+1 位，其余低位向上取整，E = floor(log2(L))
+func padmeSize(n int) int {
+	if n < paddingMinSize {
+		return paddingMinSize
+	}
+	e := log2(n)
+	s := log2(e) + 1
+	mask := 1<<uint(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+func pow2Size(n int) int {
+	size := paddingMinSize
+	for size < n {
+		size <<= 1
+	}
+	return size
+}
+
+// log2 返回 floor(log2(n))，n > 0
+func log2(n int) int {
+	l := 0
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return l
+}
@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPadding(t *testing.T) {
+	for _, p := range Paddings() {
+		for n := 0; n < 3000; n++ {
+			data := bytes.Repeat([]byte{0x80}, n)
+			padded := p.Pad(data)
+			if len(padded) != p.Size(n) || len(padded) <= n {
+				t.Fatal(p.Name, ": Wrong padded size for ", n, ": ", len(padded))
+			}
+			unpadded, err := Unpad(padded)
+			if err != nil || !bytes.Equal(unpadded, data) {
+				t.Fatal(p.Name, ": Fail to unpad ", n, " bytes: ", err)
+			}
+		}
+	}
+
+	for _, invalid := range [][]byte{nil, {}, {0}, {1, 2, 3}, {0x80, 1}} {
+		if _, err := Unpad(invalid); err != ErrInvalidPadding {
+			t.Fatal("Invalid padding must be rejected: ", invalid)
+		}
+	}
+}
+
+func TestPadme(t *testing.T) {
+	// Padmé 论文中的例子
+	for n, expected := range map[int]int{100: 104, 1000: 1024, 1025: 1088, 9999: 10240, 1 << 20: 1 << 20} {
+		if size := padmeSize(n); size != expected {
+			t.Fatal("Padmé size of ", n, " must be ", expected, ", got: ", size)
+		}
+	}
+	// 填充后的长度最多比原长度多约 12%
+	for n := paddingMinSize; n < 1<<16; n++ {
+		if size := padmeSize(n); size < n || float64(size-n) > 0.12*float64(n) {
+			t.Fatal("Padmé overhead too large for ", n, ": ", size)
+		}
+	}
+}
+
+// TestPadding_CiphertextSizes 验证填充后经过 Double Ratchet 加密的密文长度只取决于所在的区间:
+// 同一区间内不同长度的明文得到相同长度的密文，密文长度等于按方案独立算出的填充长度加上固定的开销
+func TestPadding_CiphertextSizes(t *testing.T) {
+	cases := []struct {
+		padding *Padding
+		// 明文长度 first 到 last 都填充到 padded，last+1 进入下一个区间
+		first, last, padded int
+	}{
+		{PaddingPadme, 0, 31, 32},
+		{PaddingPadme, 97, 103, 104},
+		{PaddingPadme, 992, 1023, 1024},
+		{PaddingPadme, 1024, 1087, 1088},
+		{PaddingPow2, 0, 31, 32},
+		{PaddingPow2, 513, 1023, 1024},
+	}
+	a, _ := newRatchetPair(t)
+	encryptedSize := func(p *Padding, n int) int {
+		e, err := a.Encrypt(p.Pad(make([]byte, n)), nil)
+		if err != nil {
+			t.Fatal(p.Name, ": Fail to encrypt: ", err)
+		}
+		return len(e)
+	}
+
+	overhead := -1
+	for _, c := range cases {
+		first, last := encryptedSize(c.padding, c.first), encryptedSize(c.padding, c.last)
+		if first != last {
+			t.Fatalf("%s: Plaintexts of %d and %d bytes must have the same ciphertext size, got %d and %d", c.padding.Name, c.first, c.last, first, last)
+		}
+		if overhead < 0 {
+			overhead = first - c.padded
+		}
+		if first-overhead != c.padded {
+			t.Fatalf("%s: Plaintext of %d bytes must be padded to %d, got %d", c.padding.Name, c.first, c.padded, first-overhead)
+		}
+		if next := encryptedSize(c.padding, c.last+1); next <= last {
+			t.Fatalf("%s: Plaintext of %d bytes must be in the next bucket, got ciphertext size %d", c.padding.Name, c.last+1, next)
+		}
+	}
+}
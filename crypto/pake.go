@@ -0,0 +1,208 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+	"io"
+	"math/big"
+)
+
+var (
+	ErrInvalidPAKEMessage = errors.New("Invalid PAKE message")
+	ErrPassphraseMismatch = errors.New("Passphrase mismatch")
+)
+
+var (
+	cpaceDSI            = []byte("CPace255")
+	cpaceConfirmContext = []byte("terminal-encrypt-chat pake confirm v1")
+
+	// curve25519 的素数 p = 2^255 - 19 和 Montgomery 曲线参数 A
+	fieldPrime  = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	montgomeryA = big.NewInt(486662)
+	legendreExp = new(big.Int).Rsh(new(big.Int).Sub(fieldPrime, big.NewInt(1)), 1)
+	elligatorZ  = big.NewInt(2)
+	minusOneMod = new(big.Int).Sub(fieldPrime, big.NewInt(1))
+)
+
+// CPace 实现 CFRG 推荐的对称 PAKE 协议 CPace (draft-irtf-cfrg-cpace)，群为 X25519，哈希为 SHA-512。
+//
+// 双方用口令、信道标识 ci 和会话标识 sid 计算出相同的生成元 g，各自发送 Y = X25519(y, g)，
+// 只有口令相同时双方才能得到相同的共享密钥 ISK。不知道口令的中间人每次会话只能猜一次口令。
+type CPace struct {
+	scalar  [32]byte
+	message []byte
+	sid     []byte
+}
+
+// NewCPace 计算生成元并从 rand 读取本方的临时密钥，sid 必须是双方都知道且每次会话都不同的值
+func NewCPace(rand io.Reader, passphrase []byte, ci []byte, sid []byte) (*CPace, error) {
+	c := &CPace{sid: sid}
+	if _, err := io.ReadFull(rand, c.scalar[:]); err != nil {
+		return nil, err
+	}
+
+	var generator, message [32]byte
+	copy(generator[:], cpaceGenerator(passphrase, ci, sid))
+	curve25519.ScalarMult(&message, &c.scalar, &generator)
+	c.message = message[:]
+	return c, nil
+}
+
+// Message 返回需要发送给对方的 Y
+func (c *CPace) Message() []byte {
+	return c.message
+}
+
+// Finish 用对方的 Y 计算共享密钥 ISK
+func (c *CPace) Finish(peerMessage []byte) ([]byte, error) {
+	if len(peerMessage) != 32 || bytes.Equal(peerMessage, c.message) {
+		return nil, ErrInvalidPAKEMessage
+	}
+	var peer, k [32]byte
+	copy(peer[:], peerMessage)
+	curve25519.ScalarMult(&k, &c.scalar, &peer)
+	var zero [32]byte
+	if subtle.ConstantTimeCompare(k[:], zero[:]) == 1 {
+		// 对方发送的是小阶点
+		return nil, ErrInvalidPAKEMessage
+	}
+
+	h := sha512.New()
+	h.Write(lvCat(append(append([]byte{}, cpaceDSI...), "_ISK"...), c.sid, k[:]))
+	h.Write(oCat(lvCat(c.message), lvCat(peerMessage)))
+	return h.Sum(nil)[:32], nil
+}
+
+// Confirmation 返回本方的密钥确认码，对方用 VerifyConfirmation 验证
+func (c *CPace) Confirmation(isk []byte) []byte {
+	return cpaceConfirmation(isk, c.message)
+}
+
+// VerifyConfirmation 验证对方的密钥确认码，失败说明双方的口令不一致
+func (c *CPace) VerifyConfirmation(isk []byte, peerMessage []byte, mac []byte) error {
+	if !hmac.Equal(mac, cpaceConfirmation(isk, peerMessage)) {
+		return ErrPassphraseMismatch
+	}
+	return nil
+}
+
+func cpaceConfirmation(isk []byte, message []byte) []byte {
+	mac := hmac.New(sha256.New, isk)
+	mac.Write(cpaceConfirmContext)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// cpaceGenerator 把口令哈希后用 Elligator2 映射为曲线上的点，返回 u 坐标
+func cpaceGenerator(passphrase []byte, ci []byte, sid []byte) []byte {
+	// 填充 0 使 DSI 和口令占满 SHA-512 的第一个分组
+	zpad := sha512.BlockSize - 1 - len(prependLen(passphrase)) - len(prependLen(cpaceDSI))
+	if zpad < 0 {
+		zpad = 0
+	}
+	sum := sha512.Sum512(lvCat(cpaceDSI, passphrase, make([]byte, zpad), ci, sid))
+
+	u := littleEndianToInt(sum[:32])
+	return intToLittleEndian(elligator2(u))
+}
+
+// elligator2 是 RFC 9380 中 curve25519 的 map_to_curve_elligator2。
+// 使用 math/big 实现，不是常数时间的，口令的哈希值可能通过时间侧信道泄露，
+// 在本地终端客户端中可以接受
+func elligator2(u *big.Int) *big.Int {
+	p := fieldPrime
+
+	tv1 := new(big.Int).Mul(u, u)
+	tv1.Mul(tv1, elligatorZ)
+	tv1.Mod(tv1, p)
+	if tv1.Cmp(minusOneMod) == 0 {
+		tv1.SetInt64(0)
+	}
+
+	// x1 = -A / (1 + Z * u^2)
+	x1 := new(big.Int).Add(tv1, big.NewInt(1))
+	x1.ModInverse(x1, p)
+	x1.Mul(x1, montgomeryA)
+	x1.Neg(x1)
+	x1.Mod(x1, p)
+
+	if isSquare(montgomeryRHS(x1)) {
+		return x1
+	}
+	// x2 = -x1 - A
+	x2 := new(big.Int).Neg(x1)
+	x2.Sub(x2, montgomeryA)
+	return x2.Mod(x2, p)
+}
+
+// montgomeryRHS 计算 x^3 + A*x^2 + x
+func montgomeryRHS(x *big.Int) *big.Int {
+	p := fieldPrime
+	x2 := new(big.Int).Mul(x, x)
+	y := new(big.Int).Mul(x2, x)
+	y.Add(y, new(big.Int).Mul(montgomeryA, x2))
+	y.Add(y, x)
+	return y.Mod(y, p)
+}
+
+func isSquare(x *big.Int) bool {
+	l := new(big.Int).Exp(x, legendreExp, fieldPrime)
+	return l.Sign() == 0 || l.Cmp(big.NewInt(1)) == 0
+}
+
+// littleEndianToInt 按 X25519 的 decodeUCoordinate 解码，忽略最高位
+func littleEndianToInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	be[0] &= 0x7f
+	return new(big.Int).Mod(new(big.Int).SetBytes(be), fieldPrime)
+}
+
+func intToLittleEndian(x *big.Int) []byte {
+	be := x.Bytes()
+	out := make([]byte, 32)
+	for i := range be {
+		out[i] = be[len(be)-1-i]
+	}
+	return out
+}
+
+// prependLen 在数据前加上 LEB128 编码的长度
+func prependLen(data []byte) []byte {
+	var out []byte
+	n := len(data)
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			out = append(out, b)
+			break
+		}
+		out = append(out, b|0x80)
+	}
+	return append(out, data...)
+}
+
+func lvCat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, prependLen(part)...)
+	}
+	return out
+}
+
+// oCat 按字典序从大到小拼接，双方得到相同的结果
+func oCat(a []byte, b []byte) []byte {
+	if bytes.Compare(a, b) < 0 {
+		a, b = b, a
+	}
+	out := append([]byte("oc"), a...)
+	return append(out, b...)
+}
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/big"
+	"testing"
+)
+
+func runCPace(t *testing.T, passphraseA, passphraseB string) ([]byte, []byte, error) {
+	ci := []byte("chat")
+	sid := []byte("session id")
+	a, err := NewCPace(rand.Reader, []byte(passphraseA), ci, sid)
+	if err != nil {
+		t.Fatal("Fail to create CPace: ", err)
+	}
+	b, err := NewCPace(rand.Reader, []byte(passphraseB), ci, sid)
+	if err != nil {
+		t.Fatal("Fail to create CPace: ", err)
+	}
+
+	iskA, err := a.Finish(b.Message())
+	if err != nil {
+		t.Fatal("Fail to finish CPace: ", err)
+	}
+	iskB, err := b.Finish(a.Message())
+	if err != nil {
+		t.Fatal("Fail to finish CPace: ", err)
+	}
+
+	if err := a.VerifyConfirmation(iskA, b.Message(), b.Confirmation(iskB)); err != nil {
+		return iskA, iskB, err
+	}
+	return iskA, iskB, b.VerifyConfirmation(iskB, a.Message(), a.Confirmation(iskA))
+}
+
+func TestCPace(t *testing.T) {
+	iskA, iskB, err := runCPace(t, "correct horse battery staple", "correct horse battery staple")
+	if err != nil {
+		t.Fatal("Confirmation must succeed with the same passphrase: ", err)
+	}
+	if !bytes.Equal(iskA, iskB) {
+		t.Fatal("Same passphrase must give the same key")
+	}
+
+	iskA, iskB, err = runCPace(t, "correct horse battery staple", "correct horse battery stapler")
+	if err != ErrPassphraseMismatch {
+		t.Fatal("Different passphrases must give ErrPassphraseMismatch, got: ", err)
+	}
+	if bytes.Equal(iskA, iskB) {
+		t.Fatal("Different passphrases must give different keys")
+	}
+}
+
+func TestCPaceGenerator(t *testing.T) {
+	for _, passphrase := range []string{"", "a", "passphrase", string(make([]byte, 200))} {
+		g := cpaceGenerator([]byte(passphrase), []byte("chat"), []byte("sid"))
+		u := littleEndianToInt(g)
+		if u.Sign() == 0 {
+			t.Fatal("Generator must not be zero")
+		}
+		if !isSquare(montgomeryRHS(u)) {
+			t.Fatal("Generator must be on curve25519")
+		}
+		if bytes.Equal(g, cpaceGenerator([]byte(passphrase), []byte("chat"), []byte("other sid"))) {
+			t.Fatal("Generator must depend on the session id")
+		}
+	}
+
+	// Z * u^2 == -1 的特殊情况同样要映射到曲线上
+	for _, u := range []int64{0, 1, 2, 12345} {
+		if !isSquare(montgomeryRHS(elligator2(big.NewInt(u)))) {
+			t.Fatal("Elligator2 output must be on curve25519 for u = ", u)
+		}
+	}
+}
+
+func TestCPaceInvalidMessage(t *testing.T) {
+	c, err := NewCPace(rand.Reader, []byte("passphrase"), nil, []byte("sid"))
+	if err != nil {
+		t.Fatal("Fail to create CPace: ", err)
+	}
+	for _, m := range [][]byte{make([]byte, 32), c.Message(), make([]byte, 31)} {
+		if _, err := c.Finish(m); err != ErrInvalidPAKEMessage {
+			t.Fatal("Invalid PAKE message must be rejected, got: ", err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// deterministicRand 输出 SHA-256(seed || counter) 组成的字节流
+type deterministicRand struct {
+	seed    [sha256.Size]byte
+	counter uint64
+	buf     []byte
+}
+
+// NewDeterministicRand 返回由 seed 决定的随机数来源，相同的 seed 总是得到相同的输出。
+// 传给 NewCurve25519ECDH、CipherSuite.WithRand 等需要随机数的函数可以复现握手过程和密文，
+// 只能用于测试和复现问题，输出是可以预测的，不能用于真正的通信
+func NewDeterministicRand(seed []byte) io.Reader {
+	return &deterministicRand{seed: sha256.Sum256(seed)}
+}
+
+func (r *deterministicRand) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			block := make([]byte, len(r.seed)+8)
+			copy(block, r.seed[:])
+			binary.BigEndian.PutUint64(block[len(r.seed):], r.counter)
+			r.counter++
+			sum := sha256.Sum256(block)
+			r.buf = sum[:]
+		}
+		copied := copy(p[n:], r.buf)
+		r.buf = r.buf[copied:]
+		n += copied
+	}
+	return n, nil
+}
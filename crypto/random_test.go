@@ -0,0 +1,130 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	d, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDeterministicRand(t *testing.T) {
+	read := func(seed string, n int) []byte {
+		out := make([]byte, n)
+		r := NewDeterministicRand([]byte(seed))
+		// 分多次读取，结果应与一次读取相同
+		for i := 0; i < n; i += 7 {
+			end := i + 7
+			if end > n {
+				end = n
+			}
+			if _, err := io.ReadFull(r, out[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out
+	}
+	a, b := read("seed", 100), make([]byte, 100)
+	io.ReadFull(NewDeterministicRand([]byte("seed")), b)
+	if !bytes.Equal(a, b) {
+		t.Fatal("Same seed must produce the same output")
+	}
+	if bytes.Equal(a, read("other seed", 100)) {
+		t.Fatal("Different seeds must produce different output")
+	}
+
+	generate := func() ([]byte, []byte) {
+		r := NewDeterministicRand([]byte("seed"))
+		identity, err := GenerateIdentity(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := AES256GCM.WithRand(r).Encrypt(data, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return identity.PublicKey, ciphertext
+	}
+	identity1, ciphertext1 := generate()
+	identity2, ciphertext2 := generate()
+	if !bytes.Equal(identity1, identity2) || !bytes.Equal(ciphertext1, ciphertext2) {
+		t.Fatal("Keys and ciphertexts must be reproducible with the same random source")
+	}
+}
+
+// TestX25519_RFC7748 使用 RFC 7748 6.1 节的测试向量，私钥通过随机数来源注入
+func TestX25519_RFC7748(t *testing.T) {
+	alicePriv := mustDecodeHex(t, "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	alicePub := "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+	bobPriv := mustDecodeHex(t, "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb")
+	bobPub := "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	shared := "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+
+	ecdh := NewCurve25519ECDH(bytes.NewReader(append(alicePriv, bobPriv...)))
+	privKeyA, pubKeyA, err := ecdh.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKeyB, pubKeyB, err := ecdh.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(ecdh.Marshal(pubKeyA)) != alicePub || hex.EncodeToString(ecdh.Marshal(pubKeyB)) != bobPub {
+		t.Fatal("X25519 public key mismatch")
+	}
+	secretA, err := ecdh.GenerateSharedSecret(privKeyA, pubKeyB)
+	if err != nil || hex.EncodeToString(secretA) != shared {
+		t.Fatal("X25519 shared secret mismatch: ", err)
+	}
+	secretB, err := ecdh.GenerateSharedSecret(privKeyB, pubKeyA)
+	if err != nil || hex.EncodeToString(secretB) != shared {
+		t.Fatal("X25519 shared secret mismatch: ", err)
+	}
+}
+
+// TestX448_GenerateKeyRFC7748 使用 RFC 7748 6.2 节 Alice 的私钥，确认 GenerateKey 从注入的来源读取私钥
+func TestX448_GenerateKeyRFC7748(t *testing.T) {
+	alicePriv := mustDecodeHex(t, "9a8f4925d1519f5775cf46b04b5800d4ee9ee8bae8bc5565d498c28dd9c9baf574a9419744897391006382a6f127ab1d9ac2d8c0a598726b")
+	alicePub := "9b08f7cc31b7e3e67d22d5aea121074a273bd2b83de09c63faa73d2c22c5d9bbc836647241d953d40c5b12da88120d53177f80e532c41fa0"
+
+	ecdh := NewX448ECDH(bytes.NewReader(alicePriv))
+	_, publicKey, err := ecdh.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(ecdh.Marshal(publicKey)) != alicePub {
+		t.Fatal("X448 public key mismatch")
+	}
+}
+
+// TestXChaCha20Poly1305_KnownAnswer 使用 draft-irtf-cfrg-xchacha A.3.1 节的测试向量，nonce 通过 WithRand 注入
+func TestXChaCha20Poly1305_KnownAnswer(t *testing.T) {
+	plaintext := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	ad := mustDecodeHex(t, "50515253c0c1c2c3c4c5c6c7")
+	key := mustDecodeHex(t, "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce := mustDecodeHex(t, "404142434445464748494a4b4c4d4e4f5051525354555657")
+	ciphertext := "bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb" +
+		"731c7f1b0b4aa6440bf3a82f4eda7e39ae64c6708c54c216cb96b72e1213b452" +
+		"2f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3fff9" +
+		"21f9664c97637da9768812f615c68b13b52e"
+	tag := "c0875924c1c7987947deafd8780acf49"
+
+	encrypted, err := XChaCha20Poly1305.WithRand(bytes.NewReader(nonce)).Encrypt(plaintext, key, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := hex.EncodeToString(nonce) + ciphertext + tag; hex.EncodeToString(encrypted) != expected {
+		t.Fatalf("XChaCha20-Poly1305 ciphertext mismatch:\n%x\nexpected:\n%s", encrypted, expected)
+	}
+	decrypted, err := XChaCha20Poly1305.Decrypt(encrypted, key, ad)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("Fail to decrypt known answer: ", err)
+	}
+}
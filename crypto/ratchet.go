@@ -0,0 +1,301 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+)
+
+const (
+	// MaxSkip 是单条接收链上一次允许跳过的最大消息数
+	MaxSkip = 1000
+	// maxSkippedKeys 是缓存的跳过消息密钥总数上限，超出时丢弃最早的
+	maxSkippedKeys = 2000
+)
+
+var (
+	ErrDuplicateMessage      = errors.New("Duplicate or expired message")
+	ErrTooManySkipped        = errors.New("Too many skipped messages")
+	ErrInvalidRatchetMessage = errors.New("Invalid ratchet message")
+)
+
+var (
+	ratchetRootContext    = []byte("terminal-encrypt-chat ratchet root v1")
+	ratchetMessageContext = []byte("terminal-encrypt-chat ratchet message v1")
+)
+
+type skippedKey struct {
+	publicKey string
+	n         uint32
+}
+
+type ratchetState struct {
+	rootKey                 []byte
+	privateKey              crypto.PrivateKey
+	publicKey               []byte
+	remotePublicKey         []byte
+	previousRemotePublicKey []byte
+	sendChain               []byte
+	receiveChain            []byte
+	sendN                   uint32
+	receiveN                uint32
+	previousN               uint32
+}
+
+// Ratchet 实现 Signal 的 Double Ratchet 算法: 每收到对方新的 DH 公钥就做一次 DH 棘轮，
+// 每条消息在对称链上前进一步，旧的消息密钥用后即弃，从而提供前向安全。
+//
+// 握手得到的临时密钥作为初始 DH 密钥对，SessionKeys 中的根密钥和收发密钥作为初始链，
+// Initiator 一方在创建时立即做一次 DH 棘轮，之后双方交替进行。
+//
+// 加密后的消息格式为: 公钥长度(1) + DH 公钥 + PN(4) + N(4) + 密文，密文使用 suite 指定的 AEAD 加密
+type Ratchet struct {
+	ecdh  ECDH
+	suite *CipherSuite
+	mutex *sync.Mutex
+	ratchetState
+
+	skipped      map[skippedKey][]byte
+	skippedOrder []skippedKey
+}
+
+func NewRatchet(ecdh ECDH, suite *CipherSuite, keys *SessionKeys, privateKey crypto.PrivateKey, publicKey crypto.PublicKey, remotePublicKey crypto.PublicKey) (*Ratchet, error) {
+	r := &Ratchet{
+		ecdh:  ecdh,
+		suite: suite,
+		mutex: &sync.Mutex{},
+		ratchetState: ratchetState{
+			rootKey:         keys.RootKey,
+			privateKey:      privateKey,
+			publicKey:       ecdh.Marshal(publicKey),
+			remotePublicKey: ecdh.Marshal(remotePublicKey),
+			sendChain:       keys.SendKey,
+			receiveChain:    keys.ReceiveKey,
+		},
+		skipped: make(map[skippedKey][]byte),
+	}
+
+	if keys.Initiator {
+		newPrivateKey, newPublicKey, err := ecdh.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		dh, err := ecdh.GenerateSharedSecret(newPrivateKey, remotePublicKey)
+		if err != nil {
+			return nil, err
+		}
+		r.rootKey, r.sendChain = kdfRoot(r.rootKey, dh)
+		r.privateKey, r.publicKey = newPrivateKey, ecdh.Marshal(newPublicKey)
+	}
+
+	return r, nil
+}
+
+func (r *Ratchet) Encrypt(plaintext []byte, ad []byte) ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var messageKey []byte
+	messageKey, r.sendChain = kdfChain(r.sendChain)
+	header := make([]byte, 1+len(r.publicKey)+8)
+	header[0] = byte(len(r.publicKey))
+	copy(header[1:], r.publicKey)
+	binary.BigEndian.PutUint32(header[1+len(r.publicKey):], r.previousN)
+	binary.BigEndian.PutUint32(header[5+len(r.publicKey):], r.sendN)
+	r.sendN++
+
+	return sealMessage(r.suite, messageKey, header, plaintext, ad)
+}
+
+// Overhead 返回 Encrypt 得到的密文比明文长多少: 消息头和认证标签
+func (r *Ratchet) Overhead() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return 1 + len(r.publicKey) + 8 + r.suite.TagSize
+}
+
+func (r *Ratchet) Decrypt(message []byte, ad []byte) ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(message) < 1 || len(message) < 1+int(message[0])+8 {
+		return nil, ErrInvalidRatchetMessage
+	}
+	headerSize := 1 + int(message[0]) + 8
+	header, ciphertext := message[:headerSize], message[headerSize:]
+	publicKey := header[1 : headerSize-8]
+	pn := binary.BigEndian.Uint32(header[headerSize-8:])
+	n := binary.BigEndian.Uint32(header[headerSize-4:])
+
+	// 先尝试之前跳过的消息
+	sk := skippedKey{publicKey: string(publicKey), n: n}
+	if messageKey, ok := r.skipped[sk]; ok {
+		plaintext, err := openMessage(r.suite, messageKey, header, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		r.removeSkipped(sk)
+		return plaintext, nil
+	}
+
+	if bytes.Equal(publicKey, r.previousRemotePublicKey) {
+		return nil, ErrDuplicateMessage
+	}
+
+	// 在副本上推进状态，解密成功后才提交，避免伪造的消息破坏会话
+	st := r.ratchetState
+	var skipped []skippedKey
+	var skippedKeys [][]byte
+
+	skip := func(until uint32) error {
+		if until < st.receiveN {
+			return nil
+		}
+		if until-st.receiveN > MaxSkip {
+			return ErrTooManySkipped
+		}
+		for st.receiveN < until {
+			var messageKey []byte
+			messageKey, st.receiveChain = kdfChain(st.receiveChain)
+			skipped = append(skipped, skippedKey{publicKey: string(st.remotePublicKey), n: st.receiveN})
+			skippedKeys = append(skippedKeys, messageKey)
+			st.receiveN++
+		}
+		return nil
+	}
+
+	if !bytes.Equal(publicKey, st.remotePublicKey) {
+		remotePublicKey, err := r.ecdh.Unmarshal(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := skip(pn); err != nil {
+			return nil, err
+		}
+
+		// DH 棘轮
+		dh, err := r.ecdh.GenerateSharedSecret(st.privateKey, remotePublicKey)
+		if err != nil {
+			return nil, err
+		}
+		st.rootKey, st.receiveChain = kdfRoot(st.rootKey, dh)
+
+		newPrivateKey, newPublicKey, err := r.ecdh.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		dh, err = r.ecdh.GenerateSharedSecret(newPrivateKey, remotePublicKey)
+		if err != nil {
+			return nil, err
+		}
+		st.rootKey, st.sendChain = kdfRoot(st.rootKey, dh)
+
+		st.previousRemotePublicKey = st.remotePublicKey
+		st.remotePublicKey = append([]byte{}, publicKey...)
+		st.privateKey, st.publicKey = newPrivateKey, r.ecdh.Marshal(newPublicKey)
+		st.previousN = st.sendN
+		st.sendN = 0
+		st.receiveN = 0
+	}
+
+	if n < st.receiveN {
+		return nil, ErrDuplicateMessage
+	}
+	if err := skip(n); err != nil {
+		return nil, err
+	}
+
+	var messageKey []byte
+	messageKey, st.receiveChain = kdfChain(st.receiveChain)
+	st.receiveN++
+
+	plaintext, err := openMessage(r.suite, messageKey, header, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ratchetState = st
+	for i := range skipped {
+		r.addSkipped(skipped[i], skippedKeys[i])
+	}
+	return plaintext, nil
+}
+
+func (r *Ratchet) addSkipped(sk skippedKey, messageKey []byte) {
+	r.skipped[sk] = messageKey
+	r.skippedOrder = append(r.skippedOrder, sk)
+	for len(r.skipped) > maxSkippedKeys {
+		delete(r.skipped, r.skippedOrder[0])
+		r.skippedOrder = r.skippedOrder[1:]
+	}
+}
+
+func (r *Ratchet) removeSkipped(sk skippedKey) {
+	delete(r.skipped, sk)
+	if len(r.skippedOrder) <= 2*maxSkippedKeys {
+		return
+	}
+	order := make([]skippedKey, 0, len(r.skipped))
+	for _, k := range r.skippedOrder {
+		if _, ok := r.skipped[k]; ok {
+			order = append(order, k)
+		}
+	}
+	r.skippedOrder = order
+}
+
+// kdfRoot 用 DH 输出推进根密钥，返回新的根密钥和链密钥
+func kdfRoot(rootKey []byte, dh []byte) ([]byte, []byte) {
+	kdf := hkdf.New(sha256.New, dh, rootKey, ratchetRootContext)
+	newRootKey := make([]byte, 32)
+	chainKey := make([]byte, 32)
+	io.ReadFull(kdf, newRootKey)
+	io.ReadFull(kdf, chainKey)
+	return newRootKey, chainKey
+}
+
+// kdfChain 在对称链上前进一步，返回消息密钥和下一个链密钥
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	messageKey := mac.Sum(nil)
+	mac.Reset()
+	mac.Write([]byte{2})
+	return messageKey, mac.Sum(nil)
+}
+
+// messageAEAD 由一次性的消息密钥推导出加密密钥和 nonce，算法名称混入推导，不同算法的密钥互不相关
+func messageAEAD(suite *CipherSuite, messageKey []byte) (cipher.AEAD, []byte, error) {
+	info := append(append([]byte{}, ratchetMessageContext...), suite.Name...)
+	kdf := hkdf.New(sha256.New, messageKey, nil, info)
+	key := make([]byte, suite.KeySize)
+	nonce := make([]byte, suite.NonceSize)
+	io.ReadFull(kdf, key)
+	io.ReadFull(kdf, nonce)
+	aead, err := suite.New(key)
+	return aead, nonce, err
+}
+
+func sealMessage(suite *CipherSuite, messageKey []byte, header []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageAEAD(suite, messageKey)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, header...)
+	return aead.Seal(out, nonce, plaintext, append(append([]byte{}, ad...), header...)), nil
+}
+
+func openMessage(suite *CipherSuite, messageKey []byte, header []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageAEAD(suite, messageKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, append(append([]byte{}, ad...), header...))
+}
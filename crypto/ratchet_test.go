@@ -0,0 +1,203 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+func newRatchetPair(t *testing.T) (*Ratchet, *Ratchet) {
+	return newRatchetPairWithSuite(t, XChaCha20Poly1305)
+}
+
+func newRatchetPairWithSuite(t *testing.T, suite *CipherSuite) (*Ratchet, *Ratchet) {
+	return newRatchetPairWith(t, NewCurve25519ECDH(rand.Reader), suite)
+}
+
+func newRatchetPairWith(t *testing.T, ecdh ECDH, suite *CipherSuite) (*Ratchet, *Ratchet) {
+	privKeyA, pubKeyA, err := ecdh.GenerateKey()
+	if err != nil {
+		t.Fatal("Fail to Generate Key")
+	}
+	privKeyB, pubKeyB, err := ecdh.GenerateKey()
+	if err != nil {
+		t.Fatal("Fail to Generate Key")
+	}
+
+	secret, err := ecdh.GenerateSharedSecret(privKeyA, pubKeyB)
+	if err != nil {
+		t.Fatal("Fail to GenerateSharedSecret")
+	}
+
+	chatID := []byte("chat")
+	keysA, err := DeriveSessionKeys(secret, ecdh.Marshal(pubKeyA), ecdh.Marshal(pubKeyB), chatID)
+	if err != nil {
+		t.Fatal("Fail to derive session keys: ", err)
+	}
+	keysB, err := DeriveSessionKeys(secret, ecdh.Marshal(pubKeyB), ecdh.Marshal(pubKeyA), chatID)
+	if err != nil {
+		t.Fatal("Fail to derive session keys: ", err)
+	}
+
+	a, err := NewRatchet(ecdh, suite, keysA, privKeyA, pubKeyA, pubKeyB)
+	if err != nil {
+		t.Fatal("Fail to create ratchet: ", err)
+	}
+	b, err := NewRatchet(ecdh, suite, keysB, privKeyB, pubKeyB, pubKeyA)
+	if err != nil {
+		t.Fatal("Fail to create ratchet: ", err)
+	}
+	return a, b
+}
+
+func encryptN(t *testing.T, r *Ratchet, prefix string, n int) [][]byte {
+	messages := make([][]byte, n)
+	for i := range messages {
+		m, err := r.Encrypt([]byte(fmt.Sprintf("%s %d", prefix, i)), nil)
+		if err != nil {
+			t.Fatal("Fail to encrypt: ", err)
+		}
+		messages[i] = m
+	}
+	return messages
+}
+
+func mustDecrypt(t *testing.T, r *Ratchet, message []byte, expected string) {
+	d, err := r.Decrypt(message, nil)
+	if err != nil {
+		t.Fatalf("Fail to decrypt %q: %s", expected, err)
+	}
+	if string(d) != expected {
+		t.Fatalf("Decrypted %q, expected %q", d, expected)
+	}
+}
+
+func TestRatchet_Conversation(t *testing.T) {
+	for _, suite := range CipherSuites() {
+		a, b := newRatchetPairWithSuite(t, suite)
+
+		// 双方都可以先发消息
+		for round := 0; round < 5; round++ {
+			mb := encryptN(t, b, fmt.Sprintf("b%d", round), 2)
+			ma := encryptN(t, a, fmt.Sprintf("a%d", round), 2)
+			for i := range ma {
+				mustDecrypt(t, b, ma[i], fmt.Sprintf("a%d %d", round, i))
+				mustDecrypt(t, a, mb[i], fmt.Sprintf("b%d %d", round, i))
+			}
+		}
+	}
+}
+
+func TestRatchet_ForwardSecrecy(t *testing.T) {
+	a, b := newRatchetPair(t)
+
+	m1 := encryptN(t, a, "a", 1)
+	mustDecrypt(t, b, m1[0], "a 0")
+	m2 := encryptN(t, b, "b", 1)
+	mustDecrypt(t, a, m2[0], "b 0")
+	m3 := encryptN(t, a, "a", 1)
+
+	// 每次 DH 棘轮后消息携带的公钥都不同
+	if bytes.Equal(m1[0][:33], m3[0][:33]) {
+		t.Fatal("DH ratchet public key did not change")
+	}
+	mustDecrypt(t, b, m3[0], "a 0")
+}
+
+func TestRatchet_LostMessages(t *testing.T) {
+	a, b := newRatchetPair(t)
+
+	ma := encryptN(t, a, "a", 6)
+	mustDecrypt(t, b, ma[1], "a 1")
+	mustDecrypt(t, b, ma[4], "a 4")
+
+	mb := encryptN(t, b, "b", 3)
+	mustDecrypt(t, a, mb[2], "b 2")
+
+	// 对方收到回复后换了新的链，之前丢失的消息不影响后续消息
+	ma = encryptN(t, a, "a2", 2)
+	mustDecrypt(t, b, ma[1], "a2 1")
+	mb = encryptN(t, b, "b2", 1)
+	mustDecrypt(t, a, mb[0], "b2 0")
+}
+
+func TestRatchet_ReorderedMessages(t *testing.T) {
+	a, b := newRatchetPair(t)
+
+	first := encryptN(t, a, "first", 5)
+	mustDecrypt(t, b, first[0], "first 0")
+	reply := encryptN(t, b, "reply", 1)
+	mustDecrypt(t, a, reply[0], "reply 0")
+	second := encryptN(t, a, "second", 3)
+
+	// 跨越一次 DH 棘轮的乱序消息都能解密
+	mustDecrypt(t, b, second[2], "second 2")
+	mustDecrypt(t, b, first[3], "first 3")
+	mustDecrypt(t, b, second[0], "second 0")
+	mustDecrypt(t, b, first[1], "first 1")
+	mustDecrypt(t, b, first[4], "first 4")
+	mustDecrypt(t, b, second[1], "second 1")
+	mustDecrypt(t, b, first[2], "first 2")
+}
+
+func TestRatchet_DuplicatedMessages(t *testing.T) {
+	a, b := newRatchetPair(t)
+
+	first := encryptN(t, a, "first", 3)
+	mustDecrypt(t, b, first[0], "first 0")
+	if _, err := b.Decrypt(first[0], nil); err != ErrDuplicateMessage {
+		t.Fatal("Duplicated message must be rejected, got: ", err)
+	}
+
+	mustDecrypt(t, b, first[2], "first 2")
+	mustDecrypt(t, b, first[1], "first 1")
+	if _, err := b.Decrypt(first[1], nil); err != ErrDuplicateMessage {
+		t.Fatal("Duplicated skipped message must be rejected, got: ", err)
+	}
+
+	reply := encryptN(t, b, "reply", 1)
+	mustDecrypt(t, a, reply[0], "reply 0")
+	second := encryptN(t, a, "second", 1)
+	mustDecrypt(t, b, second[0], "second 0")
+
+	// 旧链上的重复消息
+	if _, err := b.Decrypt(first[2], nil); err != ErrDuplicateMessage {
+		t.Fatal("Duplicated message from previous chain must be rejected, got: ", err)
+	}
+	if _, err := a.Decrypt(reply[0], nil); err != ErrDuplicateMessage {
+		t.Fatal("Duplicated reply must be rejected, got: ", err)
+	}
+
+	// 重复消息不影响会话
+	third := encryptN(t, a, "third", 1)
+	mustDecrypt(t, b, third[0], "third 0")
+}
+
+func TestRatchet_TamperedMessage(t *testing.T) {
+	a, b := newRatchetPair(t)
+
+	m := encryptN(t, a, "a", 2)
+	tampered := append([]byte{}, m[1]...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := b.Decrypt(tampered, nil); err == nil {
+		t.Fatal("Tampered message must be rejected")
+	}
+	if _, err := b.Decrypt(m[0], []byte("other")); err == nil {
+		t.Fatal("Message with wrong associated data must be rejected")
+	}
+
+	// 篡改的消息不改变会话状态
+	mustDecrypt(t, b, m[0], "a 0")
+	mustDecrypt(t, b, m[1], "a 1")
+}
+
+func TestRatchet_TooManySkipped(t *testing.T) {
+	a, b := newRatchetPair(t)
+
+	m := encryptN(t, a, "a", MaxSkip+2)
+	if _, err := b.Decrypt(m[MaxSkip+1], nil); err != ErrTooManySkipped {
+		t.Fatal("Skipping too many messages must be rejected, got: ", err)
+	}
+	mustDecrypt(t, b, m[MaxSkip], fmt.Sprintf("a %d", MaxSkip))
+}
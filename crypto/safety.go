@@ -0,0 +1,43 @@
+package crypto
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	safetyNumberGroups     = 4
+	safetyNumberIterations = 5200
+)
+
+var safetyNumberContext = []byte("terminal-encrypt-chat safety number v1")
+
+// SafetyNumber 从握手记录推导出一串便于人工比对的安全码，
+// 形如 "12345 67890 13579 24680"，双方安全码一致说明没有中间人
+func SafetyNumber(transcript []byte) string {
+	h := sha512.New()
+	h.Write(safetyNumberContext)
+	h.Write(transcript)
+	sum := h.Sum(nil)
+	for i := 1; i < safetyNumberIterations; i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(transcript)
+		sum = h.Sum(sum[:0])
+	}
+
+	groups := make([]string, safetyNumberGroups)
+	for i := range groups {
+		var chunk [8]byte
+		copy(chunk[3:], sum[i*5:i*5+5])
+		groups[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk[:])%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+// SafetyNumberEqual 比较用户输入的安全码，忽略其中的空白
+func SafetyNumberEqual(a, b string) bool {
+	return strings.Join(strings.Fields(a), "") == strings.Join(strings.Fields(b), "")
+}
@@ -0,0 +1,55 @@
+package crypto
+
+// ReplayWindowSize 是 ReplayWindow 能识别的乱序范围，更早的序号一律视为重放
+const ReplayWindowSize = 64
+
+type SequenceStatus int
+
+const (
+	// SequenceInOrder 表示正是期望的下一个序号
+	SequenceInOrder SequenceStatus = iota
+	// SequenceGap 表示中间有消息丢失
+	SequenceGap
+	// SequenceLate 表示一条之前跳过的消息迟到了
+	SequenceLate
+	// SequenceReplay 表示序号已经收到过或者太旧
+	SequenceReplay
+)
+
+// ReplayWindow 是按 IPsec 方式实现的滑动窗口，记录最近收到的序号，
+// 用于发现重放、丢失和乱序的消息
+type ReplayWindow struct {
+	next   uint64 // 期望的下一个序号
+	bitmap uint64 // 第 i 位表示序号 next-1-i 已经收到
+}
+
+// Check 判断序号的状态，不修改窗口；对于 SequenceGap 同时返回丢失的消息数。
+// 只有消息认证通过后才应调用 Accept 记录序号
+func (w *ReplayWindow) Check(seq uint64) (SequenceStatus, uint64) {
+	if seq == w.next {
+		return SequenceInOrder, 0
+	}
+	if seq > w.next {
+		return SequenceGap, seq - w.next
+	}
+	diff := w.next - 1 - seq
+	if diff >= ReplayWindowSize || w.bitmap&(1<<diff) != 0 {
+		return SequenceReplay, 0
+	}
+	return SequenceLate, 0
+}
+
+func (w *ReplayWindow) Accept(seq uint64) {
+	if seq < w.next {
+		w.bitmap |= 1 << (w.next - 1 - seq)
+		return
+	}
+	shift := seq - w.next + 1
+	if shift >= ReplayWindowSize {
+		w.bitmap = 0
+	} else {
+		w.bitmap <<= shift
+	}
+	w.bitmap |= 1
+	w.next = seq + 1
+}
@@ -0,0 +1,217 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// StreamChunkSize 是流式加密每个分段的明文长度，只有最后一个分段可以更短
+const StreamChunkSize = 64 * 1024
+
+const streamSaltSize = 32
+
+var (
+	ErrStreamTruncated = errors.New("Stream truncated")
+	ErrStreamCorrupted = errors.New("Stream chunk authentication failed")
+	ErrStreamClosed    = errors.New("Stream already closed")
+
+	streamContext = []byte("terminal-encrypt-chat stream v1")
+)
+
+// 流式加密使用 STREAM 结构 (与 age 的格式类似):
+//
+//	salt(32) + 分段 0 + 分段 1 + ... + 最后一个分段
+//
+// 每个流用随机 salt 从 key 推导出独立的加密密钥，同一个 key 可以加密多个流。
+// 每个分段的明文为 StreamChunkSize 字节，加密后附带认证标签，
+// nonce 由分段序号和是否为最后一个分段的标记组成，调换、删除分段都会导致认证失败，
+// 在最后一个分段之前结束的流会被识别为被截断。空的流也有一个空的最后分段。
+
+// streamNonce 是分段的 nonce: 0... + 分段序号(8) + 最后分段标记(1)
+func streamNonce(nonce []byte, counter uint64, final bool) {
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	nonce[len(nonce)-1] = 0
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+func streamAEAD(suite *CipherSuite, key []byte, salt []byte) (cipher.AEAD, error) {
+	info := append(append([]byte{}, streamContext...), suite.Name...)
+	streamKey := make([]byte, suite.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, info), streamKey); err != nil {
+		return nil, err
+	}
+	return suite.New(streamKey)
+}
+
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+// NewStreamWriter 返回一个加密写入 w 的 io.WriteCloser，写完后必须调用 Close 写入最后一个分段，
+// Close 不会关闭 w
+func NewStreamWriter(suite *CipherSuite, key []byte, w io.Writer) (io.WriteCloser, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := io.ReadFull(suite.random(), salt); err != nil {
+		return nil, err
+	}
+	aead, err := streamAEAD(suite, key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &streamWriter{
+		w:     w,
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, 0, StreamChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		// 缓冲区满了且还有数据时才写出，保证最后一个分段不为空
+		if len(s.buf) == StreamChunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(s.buf[len(s.buf):StreamChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close 写入最后一个分段
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+func (s *streamWriter) flush(final bool) error {
+	streamNonce(s.nonce, s.counter, final)
+	s.buf = s.aead.Seal(s.buf[:0], s.nonce, s.buf, nil)
+	if _, err := s.w.Write(s.buf); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	s.counter++
+	return nil
+}
+
+type streamReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	// buf 多读一个字节，读满说明当前分段后面还有数据，不是最后一个分段
+	buf   []byte
+	ahead int
+	// 解密到单独的缓冲区，认证失败时部分算法会清零输出，不能覆盖密文
+	plainBuf []byte
+	plain    []byte
+	done     bool
+	err      error
+}
+
+// NewStreamReader 返回一个从 r 读取并解密的 io.Reader。
+// 每个分段验证通过后才会返回其中的明文，读到流的末尾但没有遇到最后一个分段时返回 ErrStreamTruncated，
+// 分段被篡改、调换时返回 ErrStreamCorrupted
+func NewStreamReader(suite *CipherSuite, key []byte, r io.Reader) (io.Reader, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrStreamTruncated
+		}
+		return nil, err
+	}
+	aead, err := streamAEAD(suite, key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{
+		r:        r,
+		aead:     aead,
+		nonce:    make([]byte, aead.NonceSize()),
+		buf:      make([]byte, StreamChunkSize+aead.Overhead()+1),
+		plainBuf: make([]byte, 0, StreamChunkSize),
+	}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.readChunk()
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *streamReader) readChunk() error {
+	n, err := io.ReadFull(s.r, s.buf[s.ahead:])
+	n += s.ahead
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := err != nil
+	chunk := s.buf[:n]
+	if !final {
+		chunk = s.buf[:n-1]
+	}
+	if len(chunk) < s.aead.Overhead() {
+		return ErrStreamTruncated
+	}
+
+	streamNonce(s.nonce, s.counter, final)
+	plain, openErr := s.aead.Open(s.plainBuf[:0], s.nonce, chunk, nil)
+	if openErr != nil {
+		if final {
+			// 按非最后分段能解密，说明流在分段边界处被截断
+			streamNonce(s.nonce, s.counter, false)
+			if _, err := s.aead.Open(s.plainBuf[:0], s.nonce, chunk, nil); err == nil {
+				return ErrStreamTruncated
+			}
+		}
+		return ErrStreamCorrupted
+	}
+	// 只有空的流才会有空的最后分段
+	if final && len(plain) == 0 && s.counter > 0 {
+		return ErrStreamCorrupted
+	}
+
+	s.plain = plain
+	s.counter++
+	s.done = final
+	if !final {
+		s.buf[0] = s.buf[n-1]
+		s.ahead = 1
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func encryptStream(t *testing.T, suite *CipherSuite, plaintext []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(suite, key, &buf)
+	if err != nil {
+		t.Fatal("Fail to create stream writer: ", err)
+	}
+	// 分多次写入，写入的边界与分段边界无关
+	for p := plaintext; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal("Fail to write stream: ", err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Fail to close stream: ", err)
+	}
+	return buf.Bytes()
+}
+
+func decryptStream(suite *CipherSuite, encrypted []byte) ([]byte, error) {
+	r, err := NewStreamReader(suite, key, bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestStream_RoundTrip(t *testing.T) {
+	for _, suite := range CipherSuites() {
+		for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 17} {
+			plaintext := randomBytes(t, size)
+			encrypted := encryptStream(t, suite, plaintext)
+			decrypted, err := decryptStream(suite, encrypted)
+			if err != nil || !bytes.Equal(decrypted, plaintext) {
+				t.Fatal(suite.Name, ": Fail to decrypt stream of size ", size, ": ", err)
+			}
+		}
+	}
+}
+
+func TestStream_Pipe(t *testing.T) {
+	plaintext := randomBytes(t, 5*StreamChunkSize/2)
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := NewStreamWriter(XChaCha20Poly1305, key, pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		w.Write(plaintext)
+		pw.CloseWithError(w.Close())
+	}()
+
+	r, err := NewStreamReader(XChaCha20Poly1305, key, pr)
+	if err != nil {
+		t.Fatal("Fail to create stream reader: ", err)
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("Fail to decrypt stream through pipe: ", err)
+	}
+}
+
+func TestStream_File(t *testing.T) {
+	f, err := ioutil.TempFile("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	plaintext := randomBytes(t, 2*StreamChunkSize)
+	w, err := NewStreamWriter(AES256GCM, key, f)
+	if err != nil {
+		t.Fatal("Fail to create stream writer: ", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal("Fail to write stream: ", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Fail to close stream: ", err)
+	}
+	if _, err := w.Write(plaintext); err != ErrStreamClosed {
+		t.Fatal("Write after Close must fail, got: ", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewStreamReader(AES256GCM, key, f)
+	if err != nil {
+		t.Fatal("Fail to create stream reader: ", err)
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("Fail to decrypt stream from file: ", err)
+	}
+}
+
+func TestStream_Truncated(t *testing.T) {
+	for _, suite := range CipherSuites() {
+		encrypted := encryptStream(t, suite, randomBytes(t, 3*StreamChunkSize))
+		encryptedChunk := len(encrypted[streamSaltSize:]) / 3
+
+		// 在分段边界处截断，去掉最后一个分段
+		_, err := decryptStream(suite, encrypted[:streamSaltSize+2*encryptedChunk])
+		if err != ErrStreamTruncated {
+			t.Fatal(suite.Name, ": Stream truncated at chunk boundary must fail with ErrStreamTruncated, got: ", err)
+		}
+		// 在分段中间截断
+		if _, err := decryptStream(suite, encrypted[:len(encrypted)-10]); err == nil {
+			t.Fatal(suite.Name, ": Stream truncated inside chunk must fail")
+		}
+		// 只有 salt
+		if _, err := decryptStream(suite, encrypted[:streamSaltSize]); err != ErrStreamTruncated {
+			t.Fatal(suite.Name, ": Stream without chunks must fail with ErrStreamTruncated, got: ", err)
+		}
+		if _, err := decryptStream(suite, encrypted[:10]); err != ErrStreamTruncated {
+			t.Fatal(suite.Name, ": Stream without salt must fail with ErrStreamTruncated, got: ", err)
+		}
+		// 最后一个分段后面还有数据
+		if _, err := decryptStream(suite, append(encrypted, 0)); err == nil {
+			t.Fatal(suite.Name, ": Stream with trailing data must fail")
+		}
+	}
+}
+
+func TestStream_Reordered(t *testing.T) {
+	plaintext := randomBytes(t, 3*StreamChunkSize)
+	encrypted := encryptStream(t, XChaCha20Poly1305, plaintext)
+	encryptedChunk := len(encrypted[streamSaltSize:]) / 3
+
+	reordered := append([]byte{}, encrypted[:streamSaltSize]...)
+	reordered = append(reordered, encrypted[streamSaltSize+encryptedChunk:streamSaltSize+2*encryptedChunk]...)
+	reordered = append(reordered, encrypted[streamSaltSize:streamSaltSize+encryptedChunk]...)
+	reordered = append(reordered, encrypted[streamSaltSize+2*encryptedChunk:]...)
+	if _, err := decryptStream(XChaCha20Poly1305, reordered); err != ErrStreamCorrupted {
+		t.Fatal("Reordered chunks must fail with ErrStreamCorrupted, got: ", err)
+	}
+
+	// 删除中间的分段
+	dropped := append([]byte{}, encrypted[:streamSaltSize+encryptedChunk]...)
+	dropped = append(dropped, encrypted[streamSaltSize+2*encryptedChunk:]...)
+	if _, err := decryptStream(XChaCha20Poly1305, dropped); err != ErrStreamCorrupted {
+		t.Fatal("Dropped chunk must fail with ErrStreamCorrupted, got: ", err)
+	}
+}
+
+func TestStream_Tampered(t *testing.T) {
+	plaintext := randomBytes(t, 2*StreamChunkSize)
+	encrypted := encryptStream(t, XChaCha20Poly1305, plaintext)
+	encrypted[len(encrypted)-100] ^= 1
+
+	// 被篡改的分段之前的明文可以正常读出
+	r, err := NewStreamReader(XChaCha20Poly1305, key, bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal("Fail to create stream reader: ", err)
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != ErrStreamCorrupted {
+		t.Fatal("Tampered chunk must fail with ErrStreamCorrupted, got: ", err)
+	}
+	if !bytes.Equal(decrypted, plaintext[:StreamChunkSize]) {
+		t.Fatal("Chunks before the tampered one must be returned")
+	}
+
+	var other [32]byte
+	r, _ = NewStreamReader(XChaCha20Poly1305, other[:], bytes.NewReader(encryptStream(t, XChaCha20Poly1305, plaintext)))
+	if _, err := ioutil.ReadAll(r); err != ErrStreamCorrupted {
+		t.Fatal("Decrypt with wrong key must fail, got: ", err)
+	}
+}
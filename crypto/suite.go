@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"strings"
+)
+
+var ErrNoCommonCipherSuite = errors.New("No common cipher suite")
+
+// CipherSuite 是一种 AEAD 加密算法，新增算法只需要在 cipherSuites 中注册
+type CipherSuite struct {
+	// ID 是协商时使用的编号
+	ID        byte
+	Name      string
+	KeySize   int
+	NonceSize int
+	// TagSize 是认证标签的长度，密文比明文长这么多
+	TagSize int
+	new     func(key []byte) (cipher.AEAD, error)
+	// rand 是生成 nonce 和 salt 的随机数来源，为 nil 时使用 crypto/rand
+	rand io.Reader
+}
+
+var (
+	XChaCha20Poly1305 = &CipherSuite{
+		ID:        1,
+		Name:      "XChaCha20-Poly1305",
+		KeySize:   chacha20poly1305.KeySize,
+		NonceSize: chacha20poly1305.NonceSizeX,
+		TagSize:   16,
+		new:       chacha20poly1305.NewX,
+	}
+	AES256GCM = &CipherSuite{
+		ID:        2,
+		Name:      "AES-256-GCM",
+		KeySize:   32,
+		NonceSize: 12,
+		TagSize:   16,
+		new: func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		},
+	}
+)
+
+// cipherSuites 按强度从高到低排列，协商时选择双方都支持的第一个。
+// XChaCha20-Poly1305 的 nonce 更长，随机 nonce 也不会重复，因此排在 AES-256-GCM 之前。
+// 依赖的库中没有 AES-GCM-SIV 的实现，暂不支持
+var cipherSuites = []*CipherSuite{XChaCha20Poly1305, AES256GCM}
+
+// CipherSuites 返回所有支持的算法，按强度从高到低排列
+func CipherSuites() []*CipherSuite {
+	return append([]*CipherSuite{}, cipherSuites...)
+}
+
+func CipherSuiteByID(id byte) (*CipherSuite, bool) {
+	for _, s := range cipherSuites {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// CipherSuiteByName 按名称查找算法，不区分大小写
+func CipherSuiteByName(name string) (*CipherSuite, bool) {
+	for _, s := range cipherSuites {
+		if strings.EqualFold(s.Name, name) {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// NegotiateCipherSuite 从双方支持的算法编号中选出最强的一个，双方得到的结果相同
+func NegotiateCipherSuite(local []byte, remote []byte) (*CipherSuite, error) {
+	for _, s := range cipherSuites {
+		if containsByte(local, s.ID) && containsByte(remote, s.ID) {
+			return s, nil
+		}
+	}
+	return nil, ErrNoCommonCipherSuite
+}
+
+func containsByte(list []byte, b byte) bool {
+	for _, v := range list {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *CipherSuite) New(key []byte) (cipher.AEAD, error) {
+	return s.new(key)
+}
+
+// WithRand 返回从 rand 读取随机数的副本，协商时按 ID 比较，副本和原来的算法是同一种
+func (s *CipherSuite) WithRand(rand io.Reader) *CipherSuite {
+	suite := *s
+	suite.rand = rand
+	return &suite
+}
+
+func (s *CipherSuite) random() io.Reader {
+	if s.rand == nil {
+		return rand.Reader
+	}
+	return s.rand
+}
+
+// Encrypt 使用随机 nonce 加密，nonce 放在密文前面
+func (s *CipherSuite) Encrypt(data []byte, key []byte, ad []byte) ([]byte, error) {
+	aead, err := s.new(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(s.random(), nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, ad), nil
+}
+
+func (s *CipherSuite) Decrypt(encrypted []byte, key []byte, ad []byte) ([]byte, error) {
+	aead, err := s.new(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < aead.NonceSize() {
+		return nil, errors.New("Invalid encrypted data")
+	}
+
+	nonce := encrypted[:aead.NonceSize()]
+	return aead.Open(nil, nonce, encrypted[aead.NonceSize():], ad)
+}
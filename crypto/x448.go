@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"io"
+	"math/big"
+)
+
+const x448Size = 56
+
+var (
+	// X448 的素数 p = 2^448 - 2^224 - 1
+	x448Prime = new(big.Int).Sub(
+		new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 448), new(big.Int).Lsh(big.NewInt(1), 224)),
+		big.NewInt(1))
+	x448A24  = big.NewInt(39081)
+	x448Base = func() *[x448Size]byte {
+		var base [x448Size]byte
+		base[0] = 5
+		return &base
+	}()
+)
+
+// x448ECDH 按 RFC 7748 实现 X448。
+// 使用 math/big 实现，不是常数时间的，私钥可能通过时间侧信道泄露，只适合对性能和侧信道要求不高的场合
+type x448ECDH struct {
+	ECDH
+	rand io.Reader
+}
+
+// NewX448ECDH 返回 X448，私钥从 rand 读取
+func NewX448ECDH(rand io.Reader) ECDH {
+	return &x448ECDH{rand: rand}
+}
+
+func (e *x448ECDH) GenerateKey() (crypto.PrivateKey, crypto.PublicKey, error) {
+	var privateKey [x448Size]byte
+	if _, err := io.ReadFull(e.rand, privateKey[:]); err != nil {
+		return nil, nil, err
+	}
+	publicKey := x448(&privateKey, x448Base)
+	return &privateKey, publicKey, nil
+}
+
+func (e *x448ECDH) Marshal(p crypto.PublicKey) []byte {
+	publicKey := p.(*[x448Size]byte)
+	return publicKey[:]
+}
+
+func (e *x448ECDH) Unmarshal(data []byte) (crypto.PublicKey, error) {
+	var publicKey [x448Size]byte
+	if len(data) != x448Size {
+		return nil, ErrInvalidPublicKey
+	}
+	copy(publicKey[:], data)
+
+	// X448 的小阶点只有 0、1 和 p-1 (包括未约简的 p、p+1)
+	u := new(big.Int).Mod(x448Decode(publicKey[:]), x448Prime)
+	if u.Sign() == 0 || u.Cmp(big.NewInt(1)) == 0 || u.Cmp(new(big.Int).Sub(x448Prime, big.NewInt(1))) == 0 {
+		return nil, ErrLowOrderPoint
+	}
+	return &publicKey, nil
+}
+
+func (e *x448ECDH) GenerateSharedSecret(privateKey crypto.PrivateKey, publicKey crypto.PublicKey) ([]byte, error) {
+	secret := x448(privateKey.(*[x448Size]byte), publicKey.(*[x448Size]byte))
+	var zero [x448Size]byte
+	if subtle.ConstantTimeCompare(secret[:], zero[:]) == 1 {
+		return nil, ErrZeroSharedSecret
+	}
+	return secret[:], nil
+}
+
+// x448 是 RFC 7748 第 5 节的 X448 函数
+func x448(scalar *[x448Size]byte, point *[x448Size]byte) *[x448Size]byte {
+	k := *scalar
+	k[0] &= 252
+	k[x448Size-1] |= 128
+
+	p := x448Prime
+	x1 := new(big.Int).Mod(x448Decode(point[:]), p)
+	x2, z2 := big.NewInt(1), big.NewInt(0)
+	x3, z3 := new(big.Int).Set(x1), big.NewInt(1)
+
+	mod := func(x *big.Int) *big.Int {
+		return x.Mod(x, p)
+	}
+
+	swap := uint(0)
+	for t := 448 - 1; t >= 0; t-- {
+		kt := uint(k[t/8]>>uint(t%8)) & 1
+		swap ^= kt
+		if swap == 1 {
+			x2, x3 = x3, x2
+			z2, z3 = z3, z2
+		}
+		swap = kt
+
+		a := mod(new(big.Int).Add(x2, z2))
+		aa := mod(new(big.Int).Mul(a, a))
+		b := mod(new(big.Int).Sub(x2, z2))
+		bb := mod(new(big.Int).Mul(b, b))
+		e := mod(new(big.Int).Sub(aa, bb))
+		c := mod(new(big.Int).Add(x3, z3))
+		d := mod(new(big.Int).Sub(x3, z3))
+		da := mod(new(big.Int).Mul(d, a))
+		cb := mod(new(big.Int).Mul(c, b))
+
+		x3 = mod(new(big.Int).Add(da, cb))
+		x3 = mod(x3.Mul(x3, x3))
+		z3 = mod(new(big.Int).Sub(da, cb))
+		z3 = mod(z3.Mul(z3, z3))
+		z3 = mod(z3.Mul(z3, x1))
+		x2 = mod(new(big.Int).Mul(aa, bb))
+		z2 = mod(new(big.Int).Mul(x448A24, e))
+		z2 = mod(z2.Add(z2, aa))
+		z2 = mod(z2.Mul(z2, e))
+	}
+	if swap == 1 {
+		x2, z2 = x3, z3
+	}
+
+	inv := new(big.Int).Exp(z2, new(big.Int).Sub(p, big.NewInt(2)), p)
+	u := mod(new(big.Int).Mul(x2, inv))
+
+	var out [x448Size]byte
+	be := u.Bytes()
+	for i := range be {
+		out[i] = be[len(be)-1-i]
+	}
+	return &out
+}
+
+func x448Decode(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
@@ -0,0 +1,238 @@
+// Package envelope 定义 MTypeData 密文中的明文格式。服务器只能看到密文，
+// 消息的种类、ID 和时间都只在加密后传输。
+//
+// 格式: 版本(1) + 种类(1) + 消息 ID(8) + 发送时间(8，Unix 毫秒) + 若干字段，
+// 每个字段为: 标签(1) + 长度(uvarint) + 值。
+// 解析时跳过不认识的标签，新版本可以增加字段而不影响旧版本；
+// 不认识的种类照常解析，由调用方决定如何降级显示。
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+)
+
+// Version 是当前的格式版本，收到更高版本的信封时返回 ErrUnsupportedVersion
+const Version = 1
+
+const (
+	IDSize     = 8
+	headerSize = 1 + 1 + IDSize + 8
+)
+
+var (
+	ErrInvalidEnvelope    = errors.New("Invalid envelope")
+	ErrUnsupportedVersion = errors.New("Unsupported envelope version")
+)
+
+// Kind 是信封中消息的种类
+type Kind byte
+
+const (
+	// KindText 是聊天文字，Body 为 UTF-8 文本
+	KindText Kind = 1 + iota
+	// KindNotice 是客户端自动发送的系统提示，Body 为 UTF-8 文本
+	KindNotice
+	// KindTyping 是输入状态，State 为 TypingStarted 或 TypingStopped
+	KindTyping
+	// KindReceipt 是回执，Ref 为对应消息的 ID，State 为回执类型
+	KindReceipt
+	// KindFileChunk 是文件的一段，Ref 为文件 ID，Offset 为这一段在文件中的位置，
+	// 第一段带有 Name，State 不为 0 表示最后一段
+	KindFileChunk
+	// KindControl 是对已发送消息的操作，Ref 为被操作消息的 ID，State 为操作类型
+	KindControl
+)
+
+var kindNames = map[Kind]string{
+	KindText:      "text",
+	KindNotice:    "notice",
+	KindTyping:    "typing",
+	KindReceipt:   "receipt",
+	KindFileChunk: "file-chunk",
+	KindControl:   "control",
+}
+
+// Known 判断是否是本版本认识的种类
+func (k Kind) Known() bool {
+	_, ok := kindNames[k]
+	return ok
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// 回执类型，保存在 KindReceipt 的 State 中
+const (
+	ReceiptDelivered = 1
+	ReceiptRead      = 2
+	// ReceiptDecryptFailed 表示解密失败。解密失败时不知道消息 ID，Ref 为空，Offset 为失败的帧的序号
+	ReceiptDecryptFailed = 3
+)
+
+// 输入状态，保存在 KindTyping 的 State 中
+const (
+	TypingStarted = 1
+	TypingStopped = 2
+)
+
+// 对已发送消息的操作，保存在 KindControl 的 State 中
+const (
+	// ControlEdit 把消息的内容替换为 Body
+	ControlEdit = 1
+	// ControlDelete 删除消息，双方都不再保存消息的内容
+	ControlDelete = 2
+)
+
+// 字段标签
+const (
+	tagBody   = 1
+	tagRef    = 2
+	tagState  = 3
+	tagOffset = 4
+	tagName   = 5
+)
+
+// ID 是随机生成的消息 ID，双方用它引用同一条消息
+type ID [IDSize]byte
+
+func (id ID) IsZero() bool {
+	return id == ID{}
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseID 解析 String 返回的十六进制 ID
+func ParseID(s string) (ID, error) {
+	var id ID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != IDSize {
+		return id, ErrInvalidEnvelope
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// NewID 生成随机的消息 ID
+func NewID() (ID, error) {
+	var id ID
+	_, err := io.ReadFull(rand.Reader, id[:])
+	return id, err
+}
+
+// Envelope 是一条解密后的消息，没有用到的字段为零值，不会编码
+type Envelope struct {
+	Kind      Kind
+	ID        ID
+	Timestamp time.Time
+	Body      []byte
+	Ref       ID
+	State     byte
+	Offset    uint64
+	Name      string
+}
+
+// New 返回一个新的信封，ID 随机生成，发送时间为当前时间
+func New(kind Kind) (*Envelope, error) {
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{Kind: kind, ID: id, Timestamp: time.Now()}, nil
+}
+
+func (e *Envelope) Marshal() []byte {
+	buf := make([]byte, headerSize, headerSize+len(e.Body)+len(e.Name)+32)
+	buf[0] = Version
+	buf[1] = byte(e.Kind)
+	copy(buf[2:], e.ID[:])
+	binary.BigEndian.PutUint64(buf[2+IDSize:], uint64(e.Timestamp.UnixNano()/int64(time.Millisecond)))
+
+	if len(e.Body) > 0 {
+		buf = appendField(buf, tagBody, e.Body)
+	}
+	if !e.Ref.IsZero() {
+		buf = appendField(buf, tagRef, e.Ref[:])
+	}
+	if e.State != 0 {
+		buf = appendField(buf, tagState, []byte{e.State})
+	}
+	if e.Offset != 0 {
+		var offset [binary.MaxVarintLen64]byte
+		buf = appendField(buf, tagOffset, offset[:binary.PutUvarint(offset[:], e.Offset)])
+	}
+	if e.Name != "" {
+		buf = appendField(buf, tagName, []byte(e.Name))
+	}
+	return buf
+}
+
+func appendField(buf []byte, tag byte, value []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	buf = append(buf, tag)
+	buf = append(buf, length[:binary.PutUvarint(length[:], uint64(len(value)))]...)
+	return append(buf, value...)
+}
+
+// Unmarshal 解析信封，返回的字段不引用 data
+func Unmarshal(data []byte) (*Envelope, error) {
+	if len(data) < 1 {
+		return nil, ErrInvalidEnvelope
+	}
+	if data[0] > Version {
+		return nil, ErrUnsupportedVersion
+	}
+	if data[0] != Version || len(data) < headerSize {
+		return nil, ErrInvalidEnvelope
+	}
+	e := &Envelope{Kind: Kind(data[1])}
+	copy(e.ID[:], data[2:])
+	ms := int64(binary.BigEndian.Uint64(data[2+IDSize:]))
+	e.Timestamp = time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+
+	r := bytes.NewReader(data[headerSize:])
+	for r.Len() > 0 {
+		tag, _ := r.ReadByte()
+		length, err := binary.ReadUvarint(r)
+		if err != nil || length > uint64(r.Len()) {
+			return nil, ErrInvalidEnvelope
+		}
+		value := make([]byte, length)
+		r.Read(value)
+
+		switch tag {
+		case tagBody:
+			e.Body = value
+		case tagRef:
+			if len(value) != IDSize {
+				return nil, ErrInvalidEnvelope
+			}
+			copy(e.Ref[:], value)
+		case tagState:
+			if len(value) != 1 {
+				return nil, ErrInvalidEnvelope
+			}
+			e.State = value[0]
+		case tagOffset:
+			offset, n := binary.Uvarint(value)
+			if n != len(value) {
+				return nil, ErrInvalidEnvelope
+			}
+			e.Offset = offset
+		case tagName:
+			e.Name = string(value)
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,88 @@
+package envelope
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+	text, err := New(KindText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text.Body = []byte("你好")
+	chunk, _ := New(KindFileChunk)
+	chunk.Ref = text.ID
+	chunk.Offset = 1 << 40
+	chunk.State = 1
+	chunk.Name = "a.txt"
+	chunk.Body = bytes.Repeat([]byte{7}, 300)
+
+	for _, e := range []*Envelope{text, chunk, {Kind: KindTyping, State: 1}} {
+		data := e.Marshal()
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatal("Fail to unmarshal: ", err)
+		}
+		if got.Kind != e.Kind || got.ID != e.ID || !bytes.Equal(got.Body, e.Body) || got.Ref != e.Ref ||
+			got.State != e.State || got.Offset != e.Offset || got.Name != e.Name {
+			t.Fatalf("Envelope mismatch: %+v, expected %+v", got, e)
+		}
+		if got.Timestamp.UnixNano()/int64(time.Millisecond) != e.Timestamp.UnixNano()/int64(time.Millisecond) {
+			t.Fatal("Timestamp mismatch")
+		}
+		data[len(data)-1] ^= 0xff
+		if len(e.Body) > 0 && bytes.Equal(got.Body, data) {
+			t.Fatal("Unmarshal must not reference the input")
+		}
+	}
+	if a, b := text.ID, chunk.ID; a == b || a.IsZero() {
+		t.Fatal("Message IDs must be random")
+	}
+	if id, err := ParseID(text.ID.String()); err != nil || id != text.ID {
+		t.Fatal("Fail to parse ID: ", err)
+	}
+	for _, s := range []string{"", "0011", "zz" + text.ID.String()[2:]} {
+		if _, err := ParseID(s); err == nil {
+			t.Fatalf("Invalid ID %q must be rejected", s)
+		}
+	}
+}
+
+func TestUnmarshal_Compatibility(t *testing.T) {
+	e := &Envelope{Kind: 200, Body: []byte("from the future")}
+	// 新版本增加的字段
+	data := appendField(e.Marshal(), 99, []byte("unknown field"))
+	got, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal("Unknown kinds and fields must be accepted: ", err)
+	}
+	if got.Kind.Known() || got.Kind.String() != "unknown" || string(got.Body) != "from the future" {
+		t.Fatal("Unexpected envelope: ", got)
+	}
+
+	data[0] = Version + 1
+	if _, err := Unmarshal(data); err != ErrUnsupportedVersion {
+		t.Fatal("Newer version must return ErrUnsupportedVersion, got: ", err)
+	}
+}
+
+func TestUnmarshal_Invalid(t *testing.T) {
+	valid := (&Envelope{Kind: KindText, Body: []byte("hello")}).Marshal()
+	inputs := [][]byte{
+		nil,
+		{0},
+		valid[:headerSize-1],
+		valid[:len(valid)-1],
+		append(valid[:headerSize:headerSize], tagRef, 3, 1, 2, 3),
+		append(valid[:headerSize:headerSize], tagState, 2, 1, 2),
+		append(valid[:headerSize:headerSize], tagOffset, 1, 0x80),
+		append(valid[:headerSize:headerSize], tagBody, 0xff),
+	}
+	for _, data := range inputs {
+		if _, err := Unmarshal(data); err != ErrInvalidEnvelope {
+			t.Fatalf("Envelope %x must be rejected, got: %v", data, err)
+		}
+	}
+}
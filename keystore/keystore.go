@@ -0,0 +1,363 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"terminal-encrypt-chat/crypto"
+)
+
+const (
+	version  = 1
+	saltSize = 32
+	keySize  = 32
+)
+
+// 新建或修改口令时使用的 scrypt 参数，解锁时使用文件中记录的参数
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// 解锁时接受的 scrypt 参数范围。文件头在推导出密钥后才能认证，
+// 被篡改的超大参数会让 scrypt 分配大量内存，必须在推导之前拒绝
+var (
+	scryptMinN = 1 << 14
+	scryptMaxN = 1 << 20
+	scryptMaxR = 32
+	scryptMaxP = 16
+)
+
+var (
+	ErrWrongPassphrase = errors.New("Wrong passphrase or corrupted keystore")
+	ErrInvalidKeystore = errors.New("Invalid keystore file")
+	ErrPermissions     = errors.New("Keystore file permissions are too open")
+	ErrWiped           = errors.New("Keystore has been wiped")
+)
+
+// file 是 keystore 文件的格式，除密文外的字段都作为附加数据参与认证
+type file struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (f *file) ad() []byte {
+	return []byte(fmt.Sprintf("terminal-encrypt-chat keystore v%d %s N=%d r=%d p=%d", f.Version, f.KDF, f.N, f.R, f.P))
+}
+
+// contents 是加密保存的内容
+type contents struct {
+	Identity   []byte            `json:"identity,omitempty"`
+	KnownPeers []byte            `json:"known_peers,omitempty"`
+	Sessions   map[string][]byte `json:"sessions,omitempty"`
+}
+
+// zero 清零所有内容
+func (c *contents) zero() {
+	zero(c.Identity)
+	zero(c.KnownPeers)
+	for _, state := range c.Sessions {
+		zero(state)
+	}
+}
+
+// Keystore 把身份密钥、known_peers 和保存的会话状态加密保存在一个文件中，加密密钥由口令经 scrypt 推导。
+// 每次修改后整个文件重新加密，先写入临时文件再改名，写入过程中退出也不会损坏原来的文件
+type Keystore struct {
+	path     string
+	header   file
+	key      []byte
+	contents contents
+	mutex    *sync.Mutex
+}
+
+// Exists 判断 path 处是否已有 keystore
+func Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Create 新建一个空的 keystore，path 处已有文件时返回错误
+func Create(path string, passphrase []byte) (*Keystore, error) {
+	if Exists(path) {
+		return nil, os.ErrExist
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	k := &Keystore{path: path, mutex: &sync.Mutex{}}
+	if err := k.setPassphrase(passphrase); err != nil {
+		return nil, err
+	}
+	if err := k.save(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// CheckPermissions 检查 keystore 文件是否只有所有者可以读写，Windows 上不检查
+func CheckPermissions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return ErrPermissions
+	}
+	return nil
+}
+
+// Open 用口令解锁 keystore，其他用户可以读写文件时拒绝打开
+func Open(path string, passphrase []byte) (*Keystore, error) {
+	if err := CheckPermissions(path); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keystore{path: path, mutex: &sync.Mutex{}}
+	if err := json.Unmarshal(data, &k.header); err != nil {
+		return nil, ErrInvalidKeystore
+	}
+	h := &k.header
+	if h.Version != version || h.KDF != "scrypt" || len(h.Salt) != saltSize || !validScryptParams(h.N, h.R, h.P) {
+		return nil, ErrInvalidKeystore
+	}
+	k.key, err = scrypt.Key(passphrase, h.Salt, h.N, h.R, h.P, keySize)
+	if err != nil {
+		return nil, ErrInvalidKeystore
+	}
+	plaintext, err := crypto.XChaCha20Poly1305.Decrypt(h.Ciphertext, k.key, h.ad())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	defer zero(plaintext)
+	if err := json.Unmarshal(plaintext, &k.contents); err != nil {
+		return nil, ErrInvalidKeystore
+	}
+	return k, nil
+}
+
+// Identity 返回保存的身份密钥种子的副本，Wipe 只能清除 Keystore 内部的数据，调用方用完后应自行清零
+func (k *Keystore) Identity() []byte {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return clone(k.contents.Identity)
+}
+
+func (k *Keystore) SetIdentity(seed []byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.key == nil {
+		return ErrWiped
+	}
+	zero(k.contents.Identity)
+	k.contents.Identity = clone(seed)
+	return k.save()
+}
+
+// KnownPeers 返回 known_peers 内容的副本，格式与 known_peers 文件相同
+func (k *Keystore) KnownPeers() []byte {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return clone(k.contents.KnownPeers)
+}
+
+func (k *Keystore) SetKnownPeers(data []byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.key == nil {
+		return ErrWiped
+	}
+	zero(k.contents.KnownPeers)
+	k.contents.KnownPeers = clone(data)
+	return k.save()
+}
+
+// Session 返回以 name 保存的会话状态的副本
+func (k *Keystore) Session(name string) ([]byte, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	state, ok := k.contents.Sessions[name]
+	return clone(state), ok
+}
+
+// SetSession 保存会话状态，state 为 nil 时删除
+func (k *Keystore) SetSession(name string, state []byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.key == nil {
+		return ErrWiped
+	}
+	zero(k.contents.Sessions[name])
+	if state == nil {
+		delete(k.contents.Sessions, name)
+	} else {
+		if k.contents.Sessions == nil {
+			k.contents.Sessions = make(map[string][]byte)
+		}
+		k.contents.Sessions[name] = clone(state)
+	}
+	return k.save()
+}
+
+// ChangePassphrase 使用新的口令和 salt 重新加密 keystore
+func (k *Keystore) ChangePassphrase(passphrase []byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	old, oldKey := k.header, k.key
+	if err := k.setPassphrase(passphrase); err != nil {
+		return err
+	}
+	if err := k.save(); err != nil {
+		k.header, k.key = old, oldKey
+		return err
+	}
+	zero(oldKey)
+	return nil
+}
+
+// Wipe 用随机数据覆盖 keystore 文件后删除，并清零内存中的密钥和全部内容，之后 Keystore 不能再使用。
+// 在日志型文件系统或 SSD 上覆盖不一定能清除磁盘上的旧数据，但文件内容本身是加密的
+func (k *Keystore) Wipe() error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if err := WipeFile(k.path); err != nil {
+		return err
+	}
+	zero(k.key)
+	k.contents.zero()
+	k.key = nil
+	k.contents = contents{}
+	return nil
+}
+
+// validScryptParams 判断 N 是否为范围内的 2 的幂，r 和 p 是否在范围内
+func validScryptParams(n, r, p int) bool {
+	return n >= scryptMinN && n <= scryptMaxN && n&(n-1) == 0 &&
+		r >= 1 && r <= scryptMaxR && p >= 1 && p <= scryptMaxP
+}
+
+func (k *Keystore) setPassphrase(passphrase []byte) error {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return err
+	}
+	k.header = file{Version: version, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: salt}
+	k.key = key
+	return nil
+}
+
+// save 加密全部内容，写入同一目录下的临时文件并同步到磁盘后改名替换原文件
+func (k *Keystore) save() error {
+	if k.key == nil {
+		return ErrWiped
+	}
+	plaintext, err := json.Marshal(&k.contents)
+	if err != nil {
+		return err
+	}
+	defer zero(plaintext)
+	h := k.header
+	if h.Ciphertext, err = crypto.XChaCha20Poly1305.Encrypt(plaintext, k.key, h.ad()); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&h, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(k.path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(k.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), k.path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	k.header = h
+	return nil
+}
+
+// WipeFile 用随机数据覆盖文件并同步到磁盘后删除，用于删除导入 keystore 后的明文文件
+func WipeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		noise := make([]byte, info.Size())
+		io.ReadFull(rand.Reader, noise)
+		_, err = f.WriteAt(noise, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// syncDir 把改名操作同步到磁盘，部分系统不支持对目录 Sync，忽略错误
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// clone 返回 b 的副本，b 为 nil 时返回 nil
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,179 @@
+package keystore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func init() {
+	// 测试中使用较小的参数
+	scryptN = 1 << 10
+	scryptMinN = 1 << 10
+}
+
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "keystore"), func() { os.RemoveAll(dir) }
+}
+
+func TestKeystore(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	k, err := Create(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal("Fail to create keystore: ", err)
+	}
+	if _, err := Create(path, []byte("passphrase")); err == nil {
+		t.Fatal("Create must not overwrite an existing keystore")
+	}
+	if err := k.SetIdentity([]byte("seed")); err != nil {
+		t.Fatal("Fail to set identity: ", err)
+	}
+	if err := k.SetKnownPeers([]byte("alice abcd\n")); err != nil {
+		t.Fatal("Fail to set known peers: ", err)
+	}
+	if err := k.SetSession("alice", []byte("state")); err != nil {
+		t.Fatal("Fail to set session: ", err)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	for _, secret := range []string{"seed", "alice", "state"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Fatal("Keystore file must not contain plaintext: ", secret)
+		}
+	}
+
+	if _, err := Open(path, []byte("wrong")); err != ErrWrongPassphrase {
+		t.Fatal("Open with wrong passphrase must fail, got: ", err)
+	}
+	k, err = Open(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal("Fail to open keystore: ", err)
+	}
+	state, ok := k.Session("alice")
+	if string(k.Identity()) != "seed" || string(k.KnownPeers()) != "alice abcd\n" || !ok || string(state) != "state" {
+		t.Fatal("Keystore contents mismatch")
+	}
+
+	if err := k.ChangePassphrase([]byte("new passphrase")); err != nil {
+		t.Fatal("Fail to change passphrase: ", err)
+	}
+	if _, err := Open(path, []byte("passphrase")); err != ErrWrongPassphrase {
+		t.Fatal("Old passphrase must not open the keystore, got: ", err)
+	}
+	k, err = Open(path, []byte("new passphrase"))
+	if err != nil || string(k.Identity()) != "seed" {
+		t.Fatal("Fail to open keystore with new passphrase: ", err)
+	}
+
+	// 临时文件不会残留
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Fatal("Temporary files left behind: ", len(files))
+	}
+
+	// 返回的是副本，修改不影响 keystore
+	identity := k.Identity()
+	identity[0] = 'x'
+	if string(k.Identity()) != "seed" {
+		t.Fatal("Identity must return a copy")
+	}
+
+	if err := k.SetSession("bob", []byte("removed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.SetSession("bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := k.Session("bob"); ok {
+		t.Fatal("Session set to nil must be removed")
+	}
+
+	internal := [][]byte{k.key, k.contents.Identity, k.contents.KnownPeers, k.contents.Sessions["alice"]}
+	if err := k.Wipe(); err != nil {
+		t.Fatal("Fail to wipe keystore: ", err)
+	}
+	for _, b := range internal {
+		if !bytes.Equal(b, make([]byte, len(b))) {
+			t.Fatal("Wipe must zero all secrets in memory")
+		}
+	}
+	if Exists(path) {
+		t.Fatal("Keystore file must be removed after wipe")
+	}
+	if k.Identity() != nil || k.SetIdentity([]byte("seed")) != ErrWiped || k.contents.Identity != nil {
+		t.Fatal("Wiped keystore must not be usable")
+	}
+}
+
+func TestKeystore_Tampered(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	k, err := Create(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal("Fail to create keystore: ", err)
+	}
+	k.SetIdentity([]byte("seed"))
+
+	// 修改 scrypt 参数(附加数据)后无法解密
+	data, _ := ioutil.ReadFile(path)
+	tampered := bytes.Replace(data, []byte(`"p": 1`), []byte(`"p": 2`), 1)
+	if bytes.Equal(tampered, data) {
+		t.Fatal("Fail to tamper keystore")
+	}
+	ioutil.WriteFile(path, tampered, 0600)
+	if _, err := Open(path, []byte("passphrase")); err != ErrWrongPassphrase {
+		t.Fatal("Tampered keystore must fail to open, got: ", err)
+	}
+
+	// 超出范围的 scrypt 参数在推导密钥之前拒绝，不会分配大量内存
+	for _, params := range []string{`"n": 1073741824`, `"n": 1000`, `"n": 0`} {
+		ioutil.WriteFile(path, bytes.Replace(data, []byte(`"n": 1024`), []byte(params), 1), 0600)
+		if _, err := Open(path, []byte("passphrase")); err != ErrInvalidKeystore {
+			t.Fatalf("Keystore with %s must be rejected, got: %v", params, err)
+		}
+	}
+	for _, params := range []string{`"r": 64`, `"r": 0`} {
+		ioutil.WriteFile(path, bytes.Replace(data, []byte(`"r": 8`), []byte(params), 1), 0600)
+		if _, err := Open(path, []byte("passphrase")); err != ErrInvalidKeystore {
+			t.Fatalf("Keystore with %s must be rejected, got: %v", params, err)
+		}
+	}
+	ioutil.WriteFile(path, bytes.Replace(data, []byte(`"p": 1`), []byte(`"p": 17`), 1), 0600)
+	if _, err := Open(path, []byte("passphrase")); err != ErrInvalidKeystore {
+		t.Fatal("Keystore with too large p must be rejected, got: ", err)
+	}
+
+	ioutil.WriteFile(path, []byte("not json"), 0600)
+	if _, err := Open(path, []byte("passphrase")); err != ErrInvalidKeystore {
+		t.Fatal("Invalid keystore must fail to open, got: ", err)
+	}
+}
+
+func TestKeystore_Permissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("File permissions are not checked on windows")
+	}
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	if _, err := Create(path, []byte("passphrase")); err != nil {
+		t.Fatal("Fail to create keystore: ", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Fatal("Keystore must be created with mode 0600, got: ", info.Mode().Perm())
+	}
+	os.Chmod(path, 0644)
+	if _, err := Open(path, []byte("passphrase")); err != ErrPermissions {
+		t.Fatal("Keystore readable by others must not be opened, got: ", err)
+	}
+}
@@ -0,0 +1,158 @@
+package knownpeers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Status 是对方身份与已记录身份的比对结果
+type Status int
+
+const (
+	Unknown Status = iota
+	Match
+	Mismatch
+)
+
+// staticKeyPrefix 标记行尾可选的 Noise 静态公钥
+const staticKeyPrefix = "x25519:"
+
+// Store 类似 SSH 的 known_hosts，按聊天 ID 或联系人别名记录对方身份公钥指纹，
+// 文件每行格式为 "<key> <fingerprint>"，使用过 Noise 握手的对方还会在行尾记录
+// "x25519:<静态公钥>"，用于之后的 IK 握手
+type Store struct {
+	write      func([]byte) error
+	peers      map[string]string
+	staticKeys map[string]string
+	mutex      *sync.Mutex
+}
+
+// Open 读取文件中的记录，修改后写回同一个文件
+func Open(path string) (*Store, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return Load(data, func(data []byte) error {
+		return ioutil.WriteFile(path, data, 0600)
+	})
+}
+
+// Load 解析 data 中的记录，修改后调用 write 保存，用于把记录保存在其他地方(如加密的 keystore)
+func Load(data []byte, write func([]byte) error) (*Store, error) {
+	s := &Store{
+		write:      write,
+		peers:      make(map[string]string),
+		staticKeys: make(map[string]string),
+		mutex:      &sync.Mutex{},
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var staticKey string
+		i := strings.LastIndexByte(line, ' ')
+		if i > 0 && strings.HasPrefix(line[i+1:], staticKeyPrefix) {
+			staticKey = line[i+1+len(staticKeyPrefix):]
+			line = strings.TrimSpace(line[:i])
+			i = strings.LastIndexByte(line, ' ')
+		}
+		if i <= 0 {
+			return nil, errors.New("Invalid known peers line: " + line)
+		}
+		key := strings.TrimSpace(line[:i])
+		s.peers[key] = line[i+1:]
+		if staticKey != "" {
+			s.staticKeys[key] = staticKey
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Check(key string, fingerprint string) Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	known, ok := s.peers[key]
+	if !ok {
+		return Unknown
+	}
+	if known != fingerprint {
+		return Mismatch
+	}
+	return Match
+}
+
+func (s *Store) Lookup(key string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fingerprint, ok := s.peers[key]
+	return fingerprint, ok
+}
+
+// Set 记录(或替换)对方指纹并立即写回文件，指纹改变时丢弃旧的静态公钥
+func (s *Store) Set(key string, fingerprint string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.peers[key] != fingerprint {
+		delete(s.staticKeys, key)
+	}
+	s.peers[key] = fingerprint
+	return s.save()
+}
+
+// StaticKey 返回记录的对方 Noise 静态公钥
+func (s *Store) StaticKey(key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	staticKey, err := hex.DecodeString(s.staticKeys[key])
+	if err != nil || len(staticKey) == 0 {
+		return nil, false
+	}
+	return staticKey, true
+}
+
+// SetStaticKey 记录对方的 Noise 静态公钥，对方指纹必须已经记录
+func (s *Store) SetStaticKey(key string, staticKey []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.peers[key]; !ok {
+		return errors.New("Unknown peer: " + key)
+	}
+	s.staticKeys[key] = hex.EncodeToString(staticKey)
+	return s.save()
+}
+
+func (s *Store) save() error {
+	keys := make([]string, 0, len(s.peers))
+	for k := range s.peers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteString(" ")
+		buf.WriteString(s.peers[k])
+		if staticKey, ok := s.staticKeys[k]; ok {
+			buf.WriteString(" ")
+			buf.WriteString(staticKeyPrefix)
+			buf.WriteString(staticKey)
+		}
+		buf.WriteString("\n")
+	}
+	return s.write(buf.Bytes())
+}
@@ -0,0 +1,160 @@
+package knownpeers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	fingerprintA = "e3e66a0a40d1ce4ba009e79e1b4884782799cda723fb48093d333d51281e0c28"
+	fingerprintB = "57657478203083155175e3e66a0a40d1ce4ba009e79e1b4884782799cda723fb"
+)
+
+// newStore 从 data 加载记录，保存的内容写入返回的 Buffer
+func newStore(t *testing.T, data string) (*Store, *bytes.Buffer) {
+	saved := &bytes.Buffer{}
+	s, err := Load([]byte(data), func(data []byte) error {
+		saved.Reset()
+		saved.Write(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Fail to load: ", err)
+	}
+	return s, saved
+}
+
+func TestLoadSave(t *testing.T) {
+	data := "# known peers\n" +
+		"\n" +
+		"room " + fingerprintA + "\n" +
+		"  my friend   " + fingerprintB + " x25519:0a0b  \n"
+	s, saved := newStore(t, data)
+
+	if fingerprint, ok := s.Lookup("room"); !ok || fingerprint != fingerprintA {
+		t.Fatal("Unexpected fingerprint of room: ", fingerprint)
+	}
+	// 别名中可以有空格
+	if fingerprint, ok := s.Lookup("my friend"); !ok || fingerprint != fingerprintB {
+		t.Fatal("Unexpected fingerprint of alias with spaces: ", fingerprint)
+	}
+	if staticKey, ok := s.StaticKey("my friend"); !ok || !bytes.Equal(staticKey, []byte{0x0a, 0x0b}) {
+		t.Fatal("Unexpected static key: ", staticKey)
+	}
+	if _, ok := s.StaticKey("room"); ok {
+		t.Fatal("Peer without static key must not have one")
+	}
+
+	if err := s.SetStaticKey("room", []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "my friend " + fingerprintB + " x25519:0a0b\n" +
+		"room " + fingerprintA + " x25519:010203\n"
+	if saved.String() != expected {
+		t.Fatalf("Unexpected saved data:\n%s", saved)
+	}
+
+	// 保存的内容重新加载后得到相同的记录
+	again, savedAgain := newStore(t, saved.String())
+	if err := again.Set("room", fingerprintA); err != nil {
+		t.Fatal(err)
+	}
+	if savedAgain.String() != expected {
+		t.Fatalf("Round trip changed the data:\n%s", savedAgain)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s, _ := newStore(t, "room "+fingerprintA+"\n")
+	if status := s.Check("room", fingerprintA); status != Match {
+		t.Fatal("Expected Match, got: ", status)
+	}
+	if status := s.Check("room", fingerprintB); status != Mismatch {
+		t.Fatal("Expected Mismatch, got: ", status)
+	}
+	if status := s.Check("other", fingerprintA); status != Unknown {
+		t.Fatal("Expected Unknown, got: ", status)
+	}
+
+	if err := s.Set("other", fingerprintB); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.Check("other", fingerprintB); status != Match {
+		t.Fatal("Expected Match after Set, got: ", status)
+	}
+}
+
+// TestSet_ChangedFingerprint 对方指纹改变后，旧的静态公钥属于旧身份，不能再用于 IK 握手
+func TestSet_ChangedFingerprint(t *testing.T) {
+	s, saved := newStore(t, "room "+fingerprintA+" x25519:0a0b\n")
+
+	if err := s.Set("room", fingerprintA); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.StaticKey("room"); !ok {
+		t.Fatal("Setting the same fingerprint must keep the static key")
+	}
+
+	if err := s.Set("room", fingerprintB); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.StaticKey("room"); ok {
+		t.Fatal("Changed fingerprint must drop the old static key")
+	}
+	if saved.String() != "room "+fingerprintB+"\n" {
+		t.Fatalf("Unexpected saved data:\n%s", saved)
+	}
+
+	if err := s.SetStaticKey("unknown", []byte{1}); err == nil {
+		t.Fatal("Static key of an unknown peer must be rejected")
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	for _, data := range []string{
+		"room\n",
+		fingerprintA + "\n",
+		"room x25519:0a0b\n",
+		"room " + fingerprintA + "\nbroken\n",
+	} {
+		if _, err := Load([]byte(data), nil); err == nil {
+			t.Fatalf("Malformed data %q must be rejected", data)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knownpeers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_peers")
+
+	// 文件不存在时是空的记录
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("room", fingerprintA); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatal("known_peers must only be readable by the owner, got: ", info.Mode().Perm())
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := s.Check("room", fingerprintA); status != Match {
+		t.Fatal("Expected Match after reopening, got: ", status)
+	}
+}
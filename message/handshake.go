@@ -0,0 +1,134 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 协议版本。版本 1 是没有版本号的旧格式，握手包只有聊天 ID
+const (
+	ProtocolVersion = 2
+
+	// MinProtocolVersion 是客户端可以接受的最低协议版本，
+	// 版本 1 的客户端没有密钥确认和消息填充，无法与当前版本通信
+	MinProtocolVersion = 2
+)
+
+// handshakeMagic 是 MTypeHandShake 的开头，用于区分旧格式的握手包
+var handshakeMagic = []byte("TEC")
+
+const handshakeHeaderSize = 3 + 1 + 4
+
+// Capabilities 是客户端支持的功能位图，功能只在双方都支持时使用
+type Capabilities uint32
+
+const (
+	CapKeyConfirmation Capabilities = 1 << iota
+	CapPadding
+	CapNoise
+	CapPAKE
+	// CapEnvelope 表示 MTypeData 的明文使用 envelope 格式，不支持时明文就是聊天文字
+	CapEnvelope
+	// CapReceipts 表示发送送达和已读回执，用户关闭回执时不声明
+	CapReceipts
+	// CapTyping 表示发送输入状态，用户关闭输入状态时不声明
+	CapTyping
+	// CapEdit 表示支持编辑和删除已发送的消息
+	CapEdit
+)
+
+// RequiredCapabilities 是双方都必须支持的功能，缺少任意一个都无法通信
+const RequiredCapabilities = CapKeyConfirmation | CapPadding
+
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapKeyConfirmation, "key-confirmation"},
+	{CapPadding, "padding"},
+	{CapNoise, "noise"},
+	{CapPAKE, "pake"},
+	{CapEnvelope, "envelope"},
+	{CapReceipts, "receipts"},
+	{CapTyping, "typing"},
+	{CapEdit, "edit"},
+}
+
+func (c Capabilities) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c&n.cap != 0 {
+			names = append(names, n.name)
+			c &^= n.cap
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(c)))
+	}
+	return strings.Join(names, ",")
+}
+
+var (
+	ErrInvalidHandshake    = errors.New("Invalid handshake")
+	ErrUnsupportedVersion  = errors.New("Unsupported protocol version")
+	ErrMissingCapabilities = errors.New("Missing required capabilities")
+)
+
+// Handshake 是客户端连接服务器后发送的握手包:
+// "TEC"(3) + 协议版本(1) + 能力位图(4) + 聊天 ID。
+// 服务器根据聊天 ID 配对，并把对方的握手包转发给客户端，双方据此协商协议版本
+type Handshake struct {
+	Version      byte
+	Capabilities Capabilities
+	ChatID       []byte
+}
+
+// NewHandshake 返回当前协议版本的握手包
+func NewHandshake(chatID []byte, caps Capabilities) *Handshake {
+	return &Handshake{Version: ProtocolVersion, Capabilities: caps, ChatID: chatID}
+}
+
+func (h *Handshake) Message() *Message {
+	content := make([]byte, handshakeHeaderSize, handshakeHeaderSize+len(h.ChatID))
+	copy(content, handshakeMagic)
+	content[3] = h.Version
+	binary.BigEndian.PutUint32(content[4:], uint32(h.Capabilities))
+	return NewMessage(MTypeHandShake, append(content, h.ChatID...))
+}
+
+// ParseHandshake 解析握手包，不以 "TEC" 开头的是版本 1 的旧格式，整个内容都是聊天 ID
+func ParseHandshake(content []byte) (*Handshake, error) {
+	if !bytes.HasPrefix(content, handshakeMagic) {
+		return &Handshake{Version: 1, ChatID: content}, nil
+	}
+	if len(content) < handshakeHeaderSize || content[3] < 2 {
+		return nil, ErrInvalidHandshake
+	}
+	return &Handshake{
+		Version:      content[3],
+		Capabilities: Capabilities(binary.BigEndian.Uint32(content[4:handshakeHeaderSize])),
+		ChatID:       content[handshakeHeaderSize:],
+	}, nil
+}
+
+// Negotiate 按以下规则协商协议版本和功能:
+//   - 使用双方版本中较低的一个，较新的一方需要兼容较旧的版本；
+//   - 协商出的版本低于本方的 MinProtocolVersion 时拒绝，不会为了连通而降级到不安全的版本；
+//   - 功能取双方的交集，缺少 RequiredCapabilities 中的功能时拒绝。
+func Negotiate(local *Handshake, remote *Handshake) (byte, Capabilities, error) {
+	version := local.Version
+	if remote.Version < version {
+		version = remote.Version
+	}
+	if version < MinProtocolVersion {
+		return 0, 0, ErrUnsupportedVersion
+	}
+	caps := local.Capabilities & remote.Capabilities
+	if caps&RequiredCapabilities != RequiredCapabilities {
+		return 0, 0, ErrMissingCapabilities
+	}
+	return version, caps, nil
+}
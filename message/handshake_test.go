@@ -0,0 +1,52 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	caps := CapKeyConfirmation | CapPadding | CapNoise
+	m := NewHandshake([]byte("chat id"), caps).Message()
+	if m.MType != MTypeHandShake {
+		t.Fatal("Wrong message type")
+	}
+	h, err := ParseHandshake(m.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != ProtocolVersion || h.Capabilities != caps || !bytes.Equal(h.ChatID, []byte("chat id")) {
+		t.Fatal("Handshake mismatch: ", h)
+	}
+
+	// 旧格式的握手包只有聊天 ID
+	legacy, err := ParseHandshake([]byte("chat id"))
+	if err != nil || legacy.Version != 1 || !bytes.Equal(legacy.ChatID, []byte("chat id")) {
+		t.Fatal("Legacy handshake must be parsed as version 1")
+	}
+
+	for _, content := range [][]byte{[]byte("TEC"), []byte("TEC\x02\x00\x00"), append([]byte("TEC\x01"), 0, 0, 0, 0)} {
+		if _, err := ParseHandshake(content); err != ErrInvalidHandshake {
+			t.Fatalf("Handshake %q must be rejected, got: %v", content, err)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	all := RequiredCapabilities | CapNoise | CapPAKE
+	local := NewHandshake(nil, all)
+
+	version, caps, err := Negotiate(local, &Handshake{Version: ProtocolVersion + 1, Capabilities: RequiredCapabilities | CapNoise | 1<<20})
+	if err != nil || version != ProtocolVersion || caps != RequiredCapabilities|CapNoise {
+		t.Fatal("Newer peer must be downgraded to the local version: ", version, caps, err)
+	}
+	if _, _, err := Negotiate(local, &Handshake{Version: 1}); err != ErrUnsupportedVersion {
+		t.Fatal("Version below minimum must be refused, got: ", err)
+	}
+	if _, _, err := Negotiate(local, &Handshake{Version: ProtocolVersion, Capabilities: CapPadding}); err != ErrMissingCapabilities {
+		t.Fatal("Missing required capabilities must be refused, got: ", err)
+	}
+	if s := (CapPadding | CapPAKE | CapTyping | 1<<20).String(); s != "padding,pake,typing,0x100000" {
+		t.Fatal("Unexpected capabilities string: ", s)
+	}
+}
@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
@@ -15,6 +16,48 @@ const (
 	SizeLength = 8
 )
 
+var (
+	ErrFrameTooLarge = errors.New("Frame too large")
+	ErrUnknownType   = errors.New("Unknown frame type")
+	ErrTruncated     = errors.New("Truncated frame")
+)
+
+// Limits 是接收时允许的最大帧长度(不含类型和长度字段)。控制帧包括握手、密钥交换和关闭连接，
+// 数据帧是加密后的聊天消息
+type Limits struct {
+	Control uint64
+	Data    uint64
+}
+
+// DefaultLimits 是 Unpack 使用的默认限制
+var DefaultLimits = Limits{
+	Control: 64 * 1024,
+	Data:    1024 * 1024,
+}
+
+// Max 返回 mtype 类型的帧允许的最大长度，未知类型返回 ErrUnknownType
+func (l Limits) Max(mtype byte) (uint64, error) {
+	switch mtype {
+	case MTypeHandShake, MTypeSecret, MTypeClose:
+		return l.Control, nil
+	case MTypeData:
+		return l.Data, nil
+	}
+	return 0, ErrUnknownType
+}
+
+// Check 检查 m 的类型和长度是否符合限制，发送前检查可以避免对方收到超过限制的帧后断开连接
+func (l Limits) Check(m *Message) error {
+	max, err := l.Max(m.MType)
+	if err != nil {
+		return err
+	}
+	if uint64(len(m.Content)) > max {
+		return ErrFrameTooLarge
+	}
+	return nil
+}
+
 type Message struct {
 	MType   byte
 	length  uint64
@@ -40,30 +83,47 @@ func (m *Message) Pack(writer io.Writer) error {
 	return err
 }
 
+// Unpack 使用 DefaultLimits 读取一帧
 func (m *Message) Unpack(reader io.Reader) error {
-	var err error
-	mtype := make([]byte, SizeMType)
-	length := make([]byte, SizeLength)
+	return m.UnpackWithLimits(reader, DefaultLimits)
+}
 
-	_, err = io.ReadFull(reader, mtype)
-	if err != nil {
+// UnpackWithLimits 读取一帧，在分配内存前检查类型和长度。
+// 类型未知返回 ErrUnknownType，长度超过限制返回 ErrFrameTooLarge，
+// 帧读到一半连接断开返回 ErrTruncated，在两帧之间断开返回 io.EOF。
+// 除 io.EOF 外出错后数据流的位置已经不可信，调用方应断开连接
+func (m *Message) UnpackWithLimits(reader io.Reader, limits Limits) error {
+	header := make([]byte, SizeMType+SizeLength)
+	if _, err := io.ReadFull(reader, header[:SizeMType]); err != nil {
 		return err
 	}
-
-	m.MType = mtype[0]
-
-	_, err = io.ReadFull(reader, length)
+	max, err := limits.Max(header[0])
 	if err != nil {
 		return err
 	}
-	m.length = binary.BigEndian.Uint64(length)
-	content := make([]byte, m.length)
-	_, err = io.ReadFull(reader, content)
-	if err != nil {
-		return err
+	if _, err := io.ReadFull(reader, header[SizeMType:]); err != nil {
+		return truncated(err)
+	}
+	length := binary.BigEndian.Uint64(header[SizeMType:])
+	if length > max {
+		return ErrFrameTooLarge
 	}
 
-	m.Content = content
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return truncated(err)
+	}
 
+	m.MType = header[0]
+	m.length = length
+	m.Content = content
 	return nil
 }
+
+// truncated 把帧中间遇到的 EOF 转换成 ErrTruncated
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
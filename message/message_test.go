@@ -0,0 +1,65 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func frame(mtype byte, length uint64, content []byte) []byte {
+	buf := []byte{mtype}
+	var l [SizeLength]byte
+	binary.BigEndian.PutUint64(l[:], length)
+	buf = append(buf, l[:]...)
+	return append(buf, content...)
+}
+
+func TestPackUnpack(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, m := range []*Message{
+		NewMessage(MTypeHandShake, []byte("chat id")),
+		NewMessage(MTypeData, bytes.Repeat([]byte{1}, 1000)),
+		NewMessage(MTypeClose, nil),
+	} {
+		if err := m.Pack(buf); err != nil {
+			t.Fatal(err)
+		}
+		var got Message
+		if err := got.Unpack(buf); err != nil {
+			t.Fatal("Fail to unpack: ", err)
+		}
+		if got.MType != m.MType || !bytes.Equal(got.Content, m.Content) {
+			t.Fatal("Message mismatch")
+		}
+	}
+	var m Message
+	if err := m.Unpack(buf); err != io.EOF {
+		t.Fatal("Empty stream must return io.EOF, got: ", err)
+	}
+}
+
+func TestUnpackWithLimits(t *testing.T) {
+	limits := Limits{Control: 16, Data: 64}
+	cases := []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{"control at limit", frame(MTypeSecret, 16, make([]byte, 16)), nil},
+		{"data at limit", frame(MTypeData, 64, make([]byte, 64)), nil},
+		{"control too large", frame(MTypeSecret, 17, make([]byte, 17)), ErrFrameTooLarge},
+		{"data too large", frame(MTypeData, 65, make([]byte, 65)), ErrFrameTooLarge},
+		// 只有 9 字节的帧声明了极大的长度，必须在分配内存前拒绝
+		{"huge length", frame(MTypeData, 1<<63, nil), ErrFrameTooLarge},
+		{"unknown type", frame('9', 1, []byte{0}), ErrUnknownType},
+		{"truncated header", frame(MTypeData, 1, nil)[:5], ErrTruncated},
+		{"truncated content", frame(MTypeData, 10, make([]byte, 5)), ErrTruncated},
+	}
+	for _, c := range cases {
+		var m Message
+		if err := m.UnpackWithLimits(bytes.NewReader(c.data), limits); err != c.expected {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.expected, err)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package qr
+
+import (
+	"errors"
+)
+
+// Level 是纠错等级，等级越高能恢复的损坏越多，能容纳的数据越少
+type Level int
+
+const (
+	L Level = iota
+	M
+	Q
+	H
+)
+
+// MaxVersion 是支持的最大版本，版本 10 的 L 级可以容纳 271 字节，足够显示指纹等短文本
+const MaxVersion = 10
+
+// QuietZone 是渲染时四周留白的模块数
+const QuietZone = 4
+
+var ErrTooLong = errors.New("Data too long for QR code")
+
+// formatBits 是纠错等级在格式信息中的编码
+var formatBits = [...]int{L: 1, M: 0, Q: 3, H: 2}
+
+// block 描述一个版本和纠错等级下的分块方式: 每块的纠错码字数，
+// 第一组的块数和每块数据码字数，第二组的块数和每块数据码字数(比第一组多一个)
+type block struct {
+	ec      int
+	blocks1 int
+	data1   int
+	blocks2 int
+	data2   int
+}
+
+var blocks = [MaxVersion + 1][4]block{
+	1:  {L: {7, 1, 19, 0, 0}, M: {10, 1, 16, 0, 0}, Q: {13, 1, 13, 0, 0}, H: {17, 1, 9, 0, 0}},
+	2:  {L: {10, 1, 34, 0, 0}, M: {16, 1, 28, 0, 0}, Q: {22, 1, 22, 0, 0}, H: {28, 1, 16, 0, 0}},
+	3:  {L: {15, 1, 55, 0, 0}, M: {26, 1, 44, 0, 0}, Q: {18, 2, 17, 0, 0}, H: {22, 2, 13, 0, 0}},
+	4:  {L: {20, 1, 80, 0, 0}, M: {18, 2, 32, 0, 0}, Q: {26, 2, 24, 0, 0}, H: {16, 4, 9, 0, 0}},
+	5:  {L: {26, 1, 108, 0, 0}, M: {24, 2, 43, 0, 0}, Q: {18, 2, 15, 2, 16}, H: {22, 2, 11, 2, 12}},
+	6:  {L: {18, 2, 68, 0, 0}, M: {16, 4, 27, 0, 0}, Q: {24, 4, 19, 0, 0}, H: {28, 4, 15, 0, 0}},
+	7:  {L: {20, 2, 78, 0, 0}, M: {18, 4, 31, 0, 0}, Q: {18, 2, 14, 4, 15}, H: {26, 4, 13, 1, 14}},
+	8:  {L: {24, 2, 97, 0, 0}, M: {22, 2, 38, 2, 39}, Q: {22, 4, 18, 2, 19}, H: {26, 4, 14, 2, 15}},
+	9:  {L: {30, 2, 116, 0, 0}, M: {22, 3, 36, 2, 37}, Q: {20, 4, 16, 4, 17}, H: {24, 4, 12, 4, 13}},
+	10: {L: {18, 2, 68, 2, 69}, M: {26, 4, 43, 1, 44}, Q: {24, 6, 19, 2, 20}, H: {28, 6, 15, 2, 16}},
+}
+
+var alignmentPositions = [MaxVersion + 1][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+func (b block) dataCodewords() int {
+	return b.blocks1*b.data1 + b.blocks2*b.data2
+}
+
+// Code 是编码后的二维码
+type Code struct {
+	Version  int
+	Level    Level
+	Mask     int
+	Size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// Black 返回 (x, y) 处的模块是否为深色，超出范围的位置为浅色
+func (c *Code) Black(x, y int) bool {
+	return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.modules[y][x]
+}
+
+// Encode 使用字节模式把 data 编码为二维码，自动选择能容纳数据的最小版本和惩罚分最低的掩码
+func Encode(data []byte, level Level) (*Code, error) {
+	version := 1
+	for ; version <= MaxVersion; version++ {
+		if dataBits(version, len(data)) <= blocks[version][level].dataCodewords()*8 {
+			break
+		}
+	}
+	if version > MaxVersion {
+		return nil, ErrTooLong
+	}
+
+	codewords := addErrorCorrection(encodeData(data, version, level), version, level)
+
+	c := newCode(version, level)
+	c.drawCodewords(codewords)
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask)
+	}
+	c.Mask = best
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c, nil
+}
+
+// countBits 是字节模式下字符数字段的位数
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+func dataBits(version int, n int) int {
+	return 4 + countBits(version) + 8*n
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value int, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>uint(i)&1 == 1)
+	}
+}
+
+// encodeData 生成数据码字: 模式(0100) + 字符数 + 数据 + 结束符，再用 0xEC 0x11 填满
+func encodeData(data []byte, version int, level Level) []byte {
+	capacity := blocks[version][level].dataCodewords() * 8
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), countBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return codewords
+}
+
+// addErrorCorrection 把数据分块并计算每块的纠错码，然后按规范交错排列
+func addErrorCorrection(data []byte, version int, level Level) []byte {
+	b := blocks[version][level]
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < b.blocks1+b.blocks2; i++ {
+		n := b.data1
+		if i >= b.blocks1 {
+			n = b.data2
+		}
+		dataBlocks = append(dataBlocks, data[:n])
+		ecBlocks = append(ecBlocks, reedSolomon(data[:n], b.ec))
+		data = data[n:]
+	}
+
+	var result []byte
+	for i := 0; i < b.data2 || i < b.data1; i++ {
+		for _, d := range dataBlocks {
+			if i < len(d) {
+				result = append(result, d[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, e := range ecBlocks {
+			result = append(result, e[i])
+		}
+	}
+	return result
+}
+
+func newCode(version int, level Level) *Code {
+	size := version*4 + 17
+	c := &Code{Version: version, Level: level, Size: size}
+	c.modules = make([][]bool, size)
+	c.function = make([][]bool, size)
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	// 定时图案
+	for i := 0; i < size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	// 三个角上的定位图案，包括外围的分隔符
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+	// 校正图案，不与定位图案重叠
+	positions := alignmentPositions[version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+	// 先占住格式信息的位置，选定掩码后再写入
+	c.drawFormat(0)
+	c.drawVersion()
+	return c
+}
+
+func (c *Code) set(x, y int, black bool) {
+	c.modules[y][x] = black
+	c.function[y][x] = true
+}
+
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.set(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// FormatInfo 返回纠错等级和掩码对应的 15 位格式信息(BCH 编码后与 0x5412 异或)
+func FormatInfo(level Level, mask int) int {
+	data := formatBits[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) drawFormat(mask int) {
+	bits := FormatInfo(c.Level, mask)
+	bit := func(i int) bool {
+		return bits>>uint(i)&1 == 1
+	}
+	// 左上角
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	// 右上角和左下角
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i))
+	}
+	// 固定的深色模块
+	c.set(8, c.Size-8, true)
+}
+
+// drawVersion 在版本 7 及以上写入 18 位版本信息
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+	rem := c.Version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := c.Version<<12 | rem
+	for i := 0; i < 18; i++ {
+		black := bits>>uint(i)&1 == 1
+		a, b := c.Size-11+i%3, i/3
+		c.set(a, b, black)
+		c.set(b, a, black)
+	}
+}
+
+// drawCodewords 从右下角开始，按两列一组上下交替的顺序填入码字，跳过功能图案和第 6 列的定时图案
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = codewords[i/8]>>uint(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// MaskBit 返回掩码在 (x, y) 处是否翻转模块
+func MaskBit(mask int, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	}
+	return ((x+y)%2+x*y%3)%2 == 0
+}
+
+// applyMask 翻转非功能模块，再次调用可以撤销
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.function[y][x] && MaskBit(mask, x, y) {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty 按规范的四条规则计算惩罚分: 连续同色、2x2 同色块、类似定位图案的序列和深浅比例
+func (c *Code) penalty() int {
+	penalty := 0
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < c.Size; i++ {
+			line := make([]bool, c.Size)
+			for j := range line {
+				if pass == 0 {
+					line[j] = c.modules[i][j]
+				} else {
+					line[j] = c.modules[j][i]
+				}
+			}
+			run := 1
+			for j := 1; j <= len(line); j++ {
+				if j < len(line) && line[j] == line[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += 3 + run - 5
+				}
+				run = 1
+			}
+			for j := 0; j+7 <= len(line); j++ {
+				if !matches(line[j:j+7], finderLike) {
+					continue
+				}
+				if lightRun(line, j-4, j) || lightRun(line, j+7, j+11) {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size {
+				v := c.modules[y][x]
+				if c.modules[y][x+1] == v && c.modules[y+1][x] == v && c.modules[y+1][x+1] == v {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := c.Size * c.Size
+	percent := dark * 100 / total
+	penalty += abs(percent-50) / 5 * 10
+	return penalty
+}
+
+func matches(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lightRun 判断 [from, to) 内都是浅色，超出范围的部分视为浅色的留白
+func lightRun(line []bool, from, to int) bool {
+	for i := from; i < to; i++ {
+		if i >= 0 && i < len(line) && line[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HalfBlocks 把二维码渲染成文本，每个字符表示上下两个模块，四周留出 QuietZone 的空白。
+// '▀'、'▄'、'█' 表示深色模块，需要以深色前景、浅色背景显示
+func (c *Code) HalfBlocks() []string {
+	var lines []string
+	for y := -QuietZone; y < c.Size+QuietZone; y += 2 {
+		line := make([]rune, 0, c.Size+2*QuietZone)
+		for x := -QuietZone; x < c.Size+QuietZone; x++ {
+			top, bottom := c.Black(x, y), c.Black(x, y+1)
+			switch {
+			case top && bottom:
+				line = append(line, '█')
+			case top:
+				line = append(line, '▀')
+			case bottom:
+				line = append(line, '▄')
+			default:
+				line = append(line, ' ')
+			}
+		}
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,290 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// isFunction 按规范独立计算 (x, y) 是否属于功能图案，不使用编码器记录的结果
+func isFunction(version int, x, y int) bool {
+	size := version*4 + 17
+	// 定位图案、分隔符和格式信息
+	if (x <= 8 && y <= 8) || (x >= size-8 && y <= 8) || (x <= 8 && y >= size-8) {
+		return true
+	}
+	if x == 6 || y == 6 {
+		return true
+	}
+	if version >= 7 && ((x >= size-11 && x < size-8 && y < 6) || (y >= size-11 && y < size-8 && x < 6)) {
+		return true
+	}
+	positions := alignmentPositions[version]
+	for _, ax := range positions {
+		for _, ay := range positions {
+			if (ax <= 8 && ay <= 8) || (ax >= size-9 && ay <= 8) || (ax <= 8 && ay >= size-9) {
+				continue
+			}
+			if abs(x-ax) <= 2 && abs(y-ay) <= 2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decode 是测试用的解码器，从模块矩阵中读出字节模式的数据，并检查格式信息和每块的纠错码
+func decode(c *Code) ([]byte, error) {
+	size := c.Size
+	version := (size - 17) / 4
+	if version < 1 || version > MaxVersion || size != version*4+17 {
+		return nil, errors.New("invalid size")
+	}
+
+	// 两份格式信息
+	var format1, format2 int
+	for i := 0; i <= 5; i++ {
+		format1 |= bit(c.Black(8, i)) << uint(i)
+	}
+	format1 |= bit(c.Black(8, 7))<<6 | bit(c.Black(8, 8))<<7 | bit(c.Black(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		format1 |= bit(c.Black(14-i, 8)) << uint(i)
+	}
+	for i := 0; i < 8; i++ {
+		format2 |= bit(c.Black(size-1-i, 8)) << uint(i)
+	}
+	for i := 8; i < 15; i++ {
+		format2 |= bit(c.Black(8, size-15+i)) << uint(i)
+	}
+	if format1 != format2 {
+		return nil, errors.New("format information mismatch")
+	}
+	if !c.Black(8, size-8) {
+		return nil, errors.New("missing dark module")
+	}
+	level, mask := Level(-1), -1
+	for l := L; l <= H; l++ {
+		for m := 0; m < 8; m++ {
+			if FormatInfo(l, m) == format1 {
+				level, mask = l, m
+			}
+		}
+	}
+	if mask < 0 {
+		return nil, errors.New("invalid format information")
+	}
+
+	// 去掉掩码，按之字形顺序读出码字
+	var raw []byte
+	var current byte
+	n := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if isFunction(version, x, y) {
+					continue
+				}
+				current = current<<1 | byte(bit(c.Black(x, y) != MaskBit(mask, x, y)))
+				n++
+				if n%8 == 0 {
+					raw = append(raw, current)
+					current = 0
+				}
+			}
+		}
+	}
+
+	// 解交错，检查每块的伴随式都为 0
+	b := blocks[version][level]
+	count := b.blocks1 + b.blocks2
+	lengths := make([]int, count)
+	for i := range lengths {
+		lengths[i] = b.data1
+		if i >= b.blocks1 {
+			lengths[i] = b.data2
+		}
+	}
+	codewordBlocks := make([][]byte, count)
+	pos := 0
+	for i := 0; i < b.data1 || i < b.data2; i++ {
+		for k := range codewordBlocks {
+			if i < lengths[k] {
+				codewordBlocks[k] = append(codewordBlocks[k], raw[pos])
+				pos++
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for k := range codewordBlocks {
+			codewordBlocks[k] = append(codewordBlocks[k], raw[pos])
+			pos++
+		}
+	}
+	var data []byte
+	for k, block := range codewordBlocks {
+		for i := 0; i < b.ec; i++ {
+			var s byte
+			for _, cw := range block {
+				s = gfMul(s, gfExp[i]) ^ cw
+			}
+			if s != 0 {
+				return nil, fmt.Errorf("block %d: error correction mismatch", k)
+			}
+		}
+		data = append(data, block[:lengths[k]]...)
+	}
+
+	// 解析字节模式的数据
+	readBits := func(offset, n int) int {
+		v := 0
+		for i := offset; i < offset+n; i++ {
+			v = v<<1 | int(data[i/8]>>uint(7-i%8)&1)
+		}
+		return v
+	}
+	if readBits(0, 4) != 0x4 {
+		return nil, errors.New("not byte mode")
+	}
+	length := readBits(4, countBits(version))
+	offset := 4 + countBits(version)
+	if offset+length*8 > len(data)*8 {
+		return nil, errors.New("invalid length")
+	}
+	result := make([]byte, length)
+	for i := range result {
+		result[i] = byte(readBits(offset+i*8, 8))
+	}
+	return result, nil
+}
+
+func bit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestEncodeDecode(t *testing.T) {
+	inputs := []string{
+		"",
+		"hello",
+		"fingerprint:e3e66a0a40d1ce4ba009e79e1b4884782799cda723fb48093d333d51281e0c28\nsafety:57657478203083155175",
+		strings.Repeat("terminal-encrypt-chat ", 12),
+	}
+	for _, input := range inputs {
+		for level := L; level <= H; level++ {
+			c, err := Encode([]byte(input), level)
+			if err == ErrTooLong {
+				continue
+			}
+			if err != nil {
+				t.Fatal("Fail to encode: ", err)
+			}
+			decoded, err := decode(c)
+			if err != nil {
+				t.Fatalf("Fail to decode version %d level %d mask %d: %s", c.Version, level, c.Mask, err)
+			}
+			if !bytes.Equal(decoded, []byte(input)) {
+				t.Fatalf("Decoded data mismatch for version %d level %d", c.Version, level)
+			}
+			for y := 0; y < c.Size; y++ {
+				for x := 0; x < c.Size; x++ {
+					if c.function[y][x] != isFunction(c.Version, x, y) {
+						t.Fatalf("Function pattern mismatch at (%d, %d) for version %d", x, y, c.Version)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestAllVersions 验证每个版本、纠错等级在容量上限时都能正确编解码
+func TestAllVersions(t *testing.T) {
+	for version := 1; version <= MaxVersion; version++ {
+		for level := L; level <= H; level++ {
+			n := (blocks[version][level].dataCodewords()*8 - 4 - countBits(version)) / 8
+			input := bytes.Repeat([]byte{byte(version*4 + int(level))}, n)
+			c, err := Encode(input, level)
+			if err != nil {
+				t.Fatal("Fail to encode: ", err)
+			}
+			if c.Version != version {
+				t.Fatalf("Expected version %d for %d bytes at level %d, got %d", version, n, level, c.Version)
+			}
+			decoded, err := decode(c)
+			if err != nil || !bytes.Equal(decoded, input) {
+				t.Fatalf("Fail to decode version %d level %d: %v", version, level, err)
+			}
+		}
+	}
+
+	if _, err := Encode(make([]byte, 272), L); err != ErrTooLong {
+		t.Fatal("Data over capacity must be rejected, got: ", err)
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" 1-M 的数据码字和纠错码字
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if ec := reedSolomon(data, 10); !bytes.Equal(ec, expected) {
+		t.Fatal("Reed-Solomon mismatch: ", ec)
+	}
+}
+
+func TestFormatInfo(t *testing.T) {
+	for level, expected := range map[Level]int{
+		L: 0x77C4, // 111011111000100
+		M: 0x5412, // 101010000010010
+		Q: 0x355F, // 011010101011111
+		H: 0x1689, // 001011010001001
+	} {
+		if f := FormatInfo(level, 0); f != expected {
+			t.Fatalf("Format information of level %d mask 0 must be %015b, got %015b", level, expected, f)
+		}
+	}
+
+	c := newCode(7, L)
+	var info int
+	for i := 0; i < 18; i++ {
+		info |= bit(c.Black(c.Size-11+i%3, i/3)) << uint(i)
+	}
+	if info != 0x07C94 {
+		t.Fatalf("Version 7 information must be %018b, got %018b", 0x07C94, info)
+	}
+}
+
+func TestHalfBlocks(t *testing.T) {
+	c, err := Encode([]byte("hello"), M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := c.HalfBlocks()
+	width := c.Size + 2*QuietZone
+	if len(lines) != (width+1)/2 {
+		t.Fatal("Wrong number of lines: ", len(lines))
+	}
+	for y, line := range lines {
+		runes := []rune(line)
+		if len(runes) != width {
+			t.Fatal("Wrong line width: ", len(runes))
+		}
+		for x, r := range runes {
+			top := r == '█' || r == '▀'
+			bottom := r == '█' || r == '▄'
+			if top != c.Black(x-QuietZone, 2*y-QuietZone) || bottom != c.Black(x-QuietZone, 2*y+1-QuietZone) {
+				t.Fatalf("Half block mismatch at (%d, %d)", x, y)
+			}
+		}
+	}
+}
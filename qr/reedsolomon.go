@@ -0,0 +1,58 @@
+package qr
+
+// GF(256) 上的运算，本原多项式为 x^8 + x^4 + x^3 + x^2 + 1 (0x11D)，生成元为 2
+var (
+	gfExp [512]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+// generator 返回 n 个纠错码字的生成多项式 (x - 2^0)(x - 2^1)...(x - 2^(n-1)) 的系数，最高次项在前
+func generator(n int) []byte {
+	g := []byte{1}
+	for i := 0; i < n; i++ {
+		next := make([]byte, len(g)+1)
+		for j, c := range g {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, gfExp[i])
+		}
+		g = next
+	}
+	return g
+}
+
+// reedSolomon 返回 data 的 n 个纠错码字，即 data(x) * x^n 除以生成多项式的余数
+func reedSolomon(data []byte, n int) []byte {
+	g := generator(n)
+	rem := make([]byte, n)
+	for _, d := range data {
+		factor := d ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for i := 0; i < n; i++ {
+			rem[i] ^= gfMul(g[i+1], factor)
+		}
+	}
+	return rem
+}
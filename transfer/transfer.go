@@ -9,16 +9,24 @@ import (
 
 type Transfer struct {
 	conn       net.Conn
+	limits     message.Limits
 	closeCh    chan struct{}
 	mutex      *sync.Mutex
 	closed     bool
+	err        error
 	readQueue  chan *message.Message
 	writeQueue chan *message.Message
 }
 
 func NewTransfer(conn net.Conn) *Transfer {
+	return NewTransferWithLimits(conn, message.DefaultLimits)
+}
+
+// NewTransferWithLimits 使用指定的帧长度限制接收数据，收到不合法的帧时断开连接，原因可以通过 Err 获取
+func NewTransferWithLimits(conn net.Conn, limits message.Limits) *Transfer {
 	t := &Transfer{
 		conn:       conn,
+		limits:     limits,
 		closeCh:    make(chan struct{}),
 		closed:     false,
 		mutex:      &sync.Mutex{},
@@ -38,10 +46,15 @@ func NewTransfer(conn net.Conn) *Transfer {
 func (t *Transfer) read() {
 	for {
 		m := &message.Message{}
-		err := m.Unpack(t.conn)
+		err := m.UnpackWithLimits(t.conn, t.limits)
 		if err != nil {
-			t.Close()
-			log.Debug("接收数据失败，连接已被断开")
+			if IsFrameError(err) {
+				t.closeWithError(err)
+				log.Debugf("接收数据失败: %s，连接已被断开", FrameErrorText(err))
+			} else {
+				t.Close()
+				log.Debug("接收数据失败，连接已被断开")
+			}
 			break
 		}
 		t.readQueue <- m
@@ -52,6 +65,10 @@ func (t *Transfer) read() {
 func (t *Transfer) write() {
 	for {
 		m := <-t.writeQueue
+		if m == nil {
+			t.Close()
+			return
+		}
 		err := m.Pack(t.conn)
 		if err != nil {
 			t.Close()
@@ -65,20 +82,92 @@ func (t *Transfer) Receive() *message.Message {
 	return <-t.readQueue
 }
 
-func (t *Transfer) Send(m *message.Message) {
+// ReceiveUntilClose 等待下一帧，连接已断开且收到的帧都已取出时返回 false，不会像 Receive 一样在断开后一直阻塞
+func (t *Transfer) ReceiveUntilClose() (*message.Message, bool) {
+	select {
+	case m := <-t.readQueue:
+		return m, true
+	case <-t.closeCh:
+	}
+	// 断开前收到的帧仍然要交给调用方，例如对方发送 MTypeClose 后立即断开
+	select {
+	case m := <-t.readQueue:
+		return m, true
+	default:
+		return nil, false
+	}
+}
+
+// Send 把 m 放入发送队列。m 超过长度限制时返回 message.ErrFrameTooLarge，不发送也不断开连接，
+// 否则对方收到后会因为帧超过长度限制断开连接
+func (t *Transfer) Send(m *message.Message) error {
+	if err := t.limits.Check(m); err != nil {
+		return err
+	}
 	t.writeQueue <- m
+	return nil
+}
+
+// Limits 返回帧长度限制，接收和发送使用相同的限制
+func (t *Transfer) Limits() message.Limits {
+	return t.limits
+}
+
+// Idle 判断发送队列是否为空，可以丢弃的消息在队列不空时不发送，避免挤占聊天消息
+func (t *Transfer) Idle() bool {
+	return len(t.writeQueue) == 0
+}
+
+// SendAndClose 发送 m 后断开连接，用于发送带原因的 MTypeClose
+func (t *Transfer) SendAndClose(m *message.Message) {
+	t.writeQueue <- m
+	t.writeQueue <- nil
 }
 
 func (t *Transfer) Close() {
+	t.closeWithError(nil)
+}
+
+func (t *Transfer) closeWithError(err error) {
 	t.mutex.Lock()
 	if !t.closed {
 		t.conn.Close()
 		close(t.closeCh)
 		t.closed = true
+		t.err = err
 	}
 	t.mutex.Unlock()
 }
 
+// Err 返回因为收到不合法的帧而断开连接时的错误，其他原因断开或者连接未断开时返回 nil
+func (t *Transfer) Err() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+// IsFrameError 判断 err 是否是 message 包对不合法帧返回的错误
+func IsFrameError(err error) bool {
+	switch err {
+	case message.ErrFrameTooLarge, message.ErrUnknownType, message.ErrTruncated:
+		return true
+	}
+	return false
+}
+
+// FrameErrorText 返回帧错误的说明
+func FrameErrorText(err error) string {
+	switch err {
+	case message.ErrFrameTooLarge:
+		return "数据帧超过长度限制"
+	case message.ErrUnknownType:
+		return "未知的数据帧类型"
+	case message.ErrTruncated:
+		return "数据帧不完整"
+	}
+	return err.Error()
+}
+
 func (t *Transfer) WaitClose() {
 	<-t.closeCh
 }
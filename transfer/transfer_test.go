@@ -0,0 +1,51 @@
+package transfer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"terminal-encrypt-chat/message"
+)
+
+// TestSend_FrameTooLarge 超过长度限制的帧在本地被拒绝，连接保持可用，之后的帧正常发送
+func TestSend_FrameTooLarge(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	limits := message.Limits{Control: 16, Data: 32}
+	tr := NewTransferWithLimits(local, limits)
+	defer tr.Close()
+
+	if err := tr.Send(message.NewMessage(message.MTypeData, make([]byte, 33))); err != message.ErrFrameTooLarge {
+		t.Fatal("Oversized data frame must be refused, got: ", err)
+	}
+	if err := tr.Send(message.NewMessage(message.MTypeSecret, make([]byte, 17))); err != message.ErrFrameTooLarge {
+		t.Fatal("Oversized control frame must be refused, got: ", err)
+	}
+	if err := tr.Send(message.NewMessage('x', nil)); err != message.ErrUnknownType {
+		t.Fatal("Unknown frame type must be refused, got: ", err)
+	}
+
+	content := bytes.Repeat([]byte{1}, 32)
+	if err := tr.Send(message.NewMessage(message.MTypeData, content)); err != nil {
+		t.Fatal("Frame within the limit must be sent, got: ", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	m := &message.Message{}
+	if err := m.UnpackWithLimits(remote, limits); err != nil {
+		t.Fatal("Fail to receive the frame after a refused one: ", err)
+	}
+	if m.MType != message.MTypeData || !bytes.Equal(m.Content, content) {
+		t.Fatal("Unexpected frame: ", m)
+	}
+
+	select {
+	case <-tr.closeCh:
+		t.Fatal("Refusing an oversized frame must not close the connection")
+	default:
+	}
+	if tr.Err() != nil {
+		t.Fatal("Unexpected error: ", tr.Err())
+	}
+}
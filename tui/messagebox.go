@@ -0,0 +1,235 @@
+package tui
+
+import (
+	"bytes"
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+	"strings"
+)
+
+// Status 是已发送消息的状态，显示在消息末尾
+type Status int
+
+const (
+	// StatusNone 不显示状态，用于收到的消息和对方不发送回执时
+	StatusNone Status = iota
+	StatusSending
+	StatusDelivered
+	StatusRead
+	// StatusFailed 表示对方解密失败
+	StatusFailed
+)
+
+// Precedes 判断状态能否从 s 变为 next。状态只会前进，迟到的回执不会覆盖已读；
+// 解密失败只在还没有送达时显示，之后收到的送达和已读回执经过认证，可以覆盖解密失败
+func (s Status) Precedes(next Status) bool {
+	if next == StatusFailed {
+		return s == StatusSending
+	}
+	return s < next || s == StatusFailed
+}
+
+var statusMarkers = map[Status]string{
+	StatusSending:   "…",
+	StatusDelivered: "✓",
+	StatusRead:      "✓✓",
+	StatusFailed:    "✗ 对方解密失败",
+}
+
+type statusUpdate struct {
+	id     string
+	status Status
+}
+
+// contentUpdate 替换一条消息的内容，deleted 为 true 时 text 是删除后显示的占位文字
+type contentUpdate struct {
+	id      string
+	text    []byte
+	deleted bool
+}
+
+// selectRequest 是按键对选中消息的操作，由处理输出的协程执行，避免与追加、删除消息同时修改消息区
+type selectRequest struct {
+	op selectOp
+	// taken 不为 nil 时返回选中的消息 id 并取消选中
+	taken chan string
+}
+
+type selectOp int
+
+const (
+	selectPrevious selectOp = iota
+	selectNext
+	selectReference
+	selectTake
+)
+
+const editedMarker = "(已编辑)"
+
+// record 是消息区中的一行，fg 和 bg 为 0 时使用默认颜色。
+// id 不为空的是聊天消息，可以更新状态、编辑和删除，也可以用上下方向键选中。
+// ref 不为空的是对另一条消息的回复，显示时在上方多一行引用
+type record struct {
+	text    []byte
+	fg      termbox.Attribute
+	bg      termbox.Attribute
+	id      string
+	ref     string
+	status  Status
+	edited  bool
+	deleted bool
+}
+
+type MessageBox struct {
+	text    []record
+	maxLine int
+	// selected 是选中的消息的 id，没有选中时为空
+	selected string
+}
+
+func (mb *MessageBox) Append(text []byte) {
+	mb.appendRecord(record{text: text})
+}
+
+// appendRecord 追加一条记录，超过 maxLine 时丢弃最早的记录。
+// 选中的消息被丢弃后取消选中，避免回复一条已经看不到的消息
+func (mb *MessageBox) appendRecord(r record) {
+	mb.text = append(mb.text, r)
+	for len(mb.text) > 0 && mb.lines() > mb.maxLine {
+		mb.text = mb.text[1:]
+	}
+	if mb.index(mb.selected) < 0 {
+		mb.selected = ""
+	}
+}
+
+// lines 返回显示所有记录需要的行数，回复的引用占一行
+func (mb *MessageBox) lines() int {
+	n := len(mb.text)
+	for _, rec := range mb.text {
+		if rec.ref != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// snippet 返回 id 对应消息第一行的摘要，宽度不超过 width。
+// 引用在显示时读取原消息，原消息被编辑或删除后引用也随之改变，不会另外保存内容
+func (mb *MessageBox) snippet(id string, width int) string {
+	i := mb.index(id)
+	if i < 0 {
+		return "(引用的消息已不在消息区中)"
+	}
+	text := mb.text[i].text
+	if n := bytes.IndexByte(text, '\n'); n >= 0 {
+		text = text[:n]
+	}
+	return runewidth.Truncate(strings.Replace(string(text), "\t", " ", -1), width, "…")
+}
+
+// selectionHint 返回选中消息时分隔线上方的提示，此时输入的文字会作为对选中消息的回复发送
+func (mb *MessageBox) selectionHint(width int) string {
+	i := mb.index(mb.selected)
+	if i < 0 {
+		return ""
+	}
+	help := " (↓ 取消)"
+	if mb.text[i].ref != "" {
+		help = " (↓ 取消，Ctrl+G 跳到它引用的消息)"
+	}
+	label := "回复 "
+	return label + mb.snippet(mb.selected, width-runewidth.StringWidth(label+help)) + help
+}
+
+func (mb *MessageBox) handleSelect(r selectRequest) {
+	switch r.op {
+	case selectPrevious:
+		mb.moveSelection(-1)
+	case selectNext:
+		mb.moveSelection(1)
+	case selectReference:
+		mb.jumpToReference()
+	case selectTake:
+		r.taken <- mb.selected
+		mb.selected = ""
+	}
+}
+
+// jumpToReference 选中当前选中的回复所引用的消息
+func (mb *MessageBox) jumpToReference() {
+	i := mb.index(mb.selected)
+	if i >= 0 && mb.index(mb.text[i].ref) >= 0 {
+		mb.selected = mb.text[i].ref
+	}
+}
+
+// setStatus 更新 id 对应消息的状态，按 Precedes 的规则只会前进
+func (mb *MessageBox) setStatus(id string, status Status) {
+	for i := len(mb.text) - 1; i >= 0; i-- {
+		if mb.text[i].id == id {
+			if mb.text[i].status.Precedes(status) {
+				mb.text[i].status = status
+			}
+			return
+		}
+	}
+}
+
+// setContent 替换 id 对应消息的内容，旧内容清零后丢弃，不会留在内存中
+func (mb *MessageBox) setContent(u contentUpdate) {
+	for i := len(mb.text) - 1; i >= 0; i-- {
+		rec := &mb.text[i]
+		if rec.id != u.id {
+			continue
+		}
+		if rec.deleted {
+			return
+		}
+		for j := range rec.text {
+			rec.text[j] = 0
+		}
+		rec.text = u.text
+		if u.deleted {
+			rec.deleted = true
+			rec.edited = false
+			rec.status = StatusNone
+		} else {
+			rec.edited = true
+		}
+		return
+	}
+}
+
+// index 返回 id 对应消息在消息区中的位置，不存在时返回 -1
+func (mb *MessageBox) index(id string) int {
+	if id == "" {
+		return -1
+	}
+	for i := len(mb.text) - 1; i >= 0; i-- {
+		if mb.text[i].id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// moveSelection 选中上一条(step 为 -1)或下一条聊天消息，越过最后一条时取消选中
+func (mb *MessageBox) moveSelection(step int) {
+	i := mb.index(mb.selected)
+	if i < 0 {
+		if step > 0 {
+			return
+		}
+		i = len(mb.text)
+	}
+	for i += step; i >= 0 && i < len(mb.text); i += step {
+		if mb.text[i].id != "" {
+			mb.selected = mb.text[i].id
+			return
+		}
+	}
+	if step > 0 {
+		mb.selected = ""
+	}
+}
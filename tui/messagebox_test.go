@@ -0,0 +1,193 @@
+package tui
+
+import (
+	"bytes"
+	"github.com/mattn/go-runewidth"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestMessageBox_EditDelete 编辑后记录标记为已编辑，旧内容被清零；删除后清除已编辑标记和状态，之后不能再编辑
+func TestMessageBox_EditDelete(t *testing.T) {
+	mb := &MessageBox{maxLine: 10}
+	old := []byte("> hello")
+	mb.appendRecord(record{text: old, id: "a", status: StatusDelivered})
+	mb.appendRecord(record{text: []byte("> other"), id: "b"})
+
+	mb.setContent(contentUpdate{id: "a", text: []byte("> changed")})
+	rec := mb.text[0]
+	if !rec.edited || string(rec.text) != "> changed" {
+		t.Fatalf("Edited record must be marked as edited, got %q (edited %v)", rec.text, rec.edited)
+	}
+	if rec.status != StatusDelivered {
+		t.Fatal("Editing must keep the status, got: ", rec.status)
+	}
+	if !bytes.Equal(old, make([]byte, len(old))) {
+		t.Fatal("Old content must be zeroed")
+	}
+	if mb.text[1].edited {
+		t.Fatal("Only the edited record must be marked")
+	}
+
+	mb.setContent(contentUpdate{id: "a", text: []byte("> (消息已删除)"), deleted: true})
+	rec = mb.text[0]
+	if rec.edited || !rec.deleted || rec.status != StatusNone {
+		t.Fatalf("Deleted record must drop the edited marker and status, got edited %v, status %v", rec.edited, rec.status)
+	}
+	mb.setContent(contentUpdate{id: "a", text: []byte("> again")})
+	if rec := mb.text[0]; rec.edited || string(rec.text) != "> (消息已删除)" {
+		t.Fatalf("Deleted record must not be edited again, got %q", rec.text)
+	}
+
+	mb.setContent(contentUpdate{id: "unknown", text: []byte("> forged")})
+	if string(mb.text[1].text) != "> other" || mb.text[1].edited {
+		t.Fatal("Update of an unknown id must be ignored")
+	}
+}
+
+// takeSelection 取出选中的消息 id 并取消选中，与按回车提交时相同
+func takeSelection(mb *MessageBox) string {
+	taken := make(chan string, 1)
+	mb.handleSelect(selectRequest{op: selectTake, taken: taken})
+	return <-taken
+}
+
+// TestMessageBox_Selection 上下方向键在聊天消息之间移动选中，跳过普通输出，越过最后一条时取消选中。
+// 选中后收到的新消息排在后面，向下移动时依次经过
+func TestMessageBox_Selection(t *testing.T) {
+	mb := &MessageBox{maxLine: 10}
+	mb.appendRecord(record{text: []byte("> a"), id: "a"})
+	mb.Append([]byte("log"))
+	mb.appendRecord(record{text: []byte("< b"), id: "b"})
+
+	mb.handleSelect(selectRequest{op: selectNext})
+	if mb.selected != "" {
+		t.Fatal("Down without a selection must not select, got: ", mb.selected)
+	}
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	if mb.selected != "a" {
+		t.Fatal("Selection must skip records without an id, got: ", mb.selected)
+	}
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	if mb.selected != "a" {
+		t.Fatal("Up at the first message must keep the selection, got: ", mb.selected)
+	}
+
+	mb.appendRecord(record{text: []byte("< c"), id: "c"})
+	mb.Append([]byte("log"))
+	mb.appendRecord(record{text: []byte("< d"), id: "d"})
+	if mb.selected != "a" {
+		t.Fatal("Incoming messages must not move the selection, got: ", mb.selected)
+	}
+	for _, expected := range []string{"b", "c", "d", ""} {
+		mb.handleSelect(selectRequest{op: selectNext})
+		if mb.selected != expected {
+			t.Fatalf("Expected selection %q, got %q", expected, mb.selected)
+		}
+	}
+
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	if id := takeSelection(mb); id != "d" || mb.selected != "" {
+		t.Fatalf("Take must return the selection and clear it, got %q, left %q", id, mb.selected)
+	}
+}
+
+// TestMessageBox_SelectionScrolledOut 选中的消息滚出消息区后取消选中
+func TestMessageBox_SelectionScrolledOut(t *testing.T) {
+	mb := &MessageBox{maxLine: 3}
+	mb.appendRecord(record{text: []byte("> a"), id: "a"})
+	mb.appendRecord(record{text: []byte("> b"), id: "b"})
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	mb.appendRecord(record{text: []byte("< c"), id: "c"})
+	if mb.selected != "a" {
+		t.Fatal("Selection must stay while the message is shown, got: ", mb.selected)
+	}
+	mb.appendRecord(record{text: []byte("< d"), id: "d", ref: "b"})
+	if mb.index("a") >= 0 || mb.selected != "" {
+		t.Fatalf("Selection of a scrolled out message must be cleared, got %q", mb.selected)
+	}
+	if id := takeSelection(mb); id != "" {
+		t.Fatal("Take must not return a scrolled out message, got: ", id)
+	}
+}
+
+// TestMessageBox_EmptySelection 消息区为空或没有聊天消息时选择操作不做任何事
+func TestMessageBox_EmptySelection(t *testing.T) {
+	mb := &MessageBox{maxLine: 10}
+	for _, op := range []selectOp{selectPrevious, selectNext, selectReference} {
+		mb.handleSelect(selectRequest{op: op})
+	}
+	if id := takeSelection(mb); id != "" {
+		t.Fatal("Take from an empty box must return nothing, got: ", id)
+	}
+	if hint := mb.selectionHint(80); hint != "" {
+		t.Fatal("Empty box must have no selection hint, got: ", hint)
+	}
+
+	mb.Append([]byte("log"))
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	if id := takeSelection(mb); id != "" {
+		t.Fatal("Records without an id must not be selected, got: ", id)
+	}
+}
+
+// TestMessageBox_Reference Ctrl+G 从回复跳到它引用的消息，引用的消息已不在消息区时保持选中
+func TestMessageBox_Reference(t *testing.T) {
+	mb := &MessageBox{maxLine: 10}
+	mb.appendRecord(record{text: []byte("> a"), id: "a"})
+	mb.appendRecord(record{text: []byte("< b"), id: "b", ref: "a"})
+	mb.appendRecord(record{text: []byte("< c"), id: "c", ref: "gone"})
+
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	mb.handleSelect(selectRequest{op: selectReference})
+	if mb.selected != "c" {
+		t.Fatal("Reference to a missing message must keep the selection, got: ", mb.selected)
+	}
+	mb.handleSelect(selectRequest{op: selectPrevious})
+	mb.handleSelect(selectRequest{op: selectReference})
+	if mb.selected != "a" {
+		t.Fatal("Selection must jump to the referenced message, got: ", mb.selected)
+	}
+}
+
+// TestMessageBox_Snippet 引用摘要只取第一行，按显示宽度截断，不会截断在多字节字符中间
+func TestMessageBox_Snippet(t *testing.T) {
+	mb := &MessageBox{maxLine: 10}
+	cases := []struct {
+		text  string
+		width int
+	}{
+		{"> hello", 20},
+		{"> 你好，世界", 6},
+		{"> 你好，世界", 7},
+		{"> 😀😀😀😀", 5},
+		{"> héllo wörld", 8},
+		{"> 第一行\n第二行", 20},
+		{"> a\tb", 20},
+	}
+	for i, c := range cases {
+		id := string(rune('a' + i))
+		mb.appendRecord(record{text: []byte(c.text), id: id})
+		snippet := mb.snippet(id, c.width)
+		if !utf8.ValidString(snippet) {
+			t.Fatalf("Snippet of %q is not valid UTF-8: %q", c.text, snippet)
+		}
+		if w := runewidth.StringWidth(snippet); w > c.width {
+			t.Fatalf("Snippet %q of %q is %d wide, expected at most %d", snippet, c.text, w, c.width)
+		}
+		line := strings.Replace(strings.SplitN(c.text, "\n", 2)[0], "\t", " ", -1)
+		if !strings.HasPrefix(line, strings.TrimSuffix(snippet, "…")) {
+			t.Fatalf("Snippet %q is not a prefix of %q", snippet, line)
+		}
+		if runewidth.StringWidth(line) <= c.width && snippet != line {
+			t.Fatalf("Snippet of %q must not be truncated, got %q", line, snippet)
+		}
+	}
+
+	if snippet := mb.snippet("gone", 80); snippet != "(引用的消息已不在消息区中)" {
+		t.Fatal("Missing message must have a placeholder snippet, got: ", snippet)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/mattn/go-runewidth"
 	"github.com/nsf/termbox-go"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"time"
 	"unicode/utf8"
 )
@@ -15,11 +16,25 @@ var (
 	termH        int
 	colorDefault termbox.Attribute
 	inputBox     = &InputBox{}
+	// inputMutex 保护 inputBox，按键在一个协程中编辑，界面在处理输出的协程中绘制
+	inputMutex   = &sync.Mutex{}
 	messageBox   = &MessageBox{}
 	eventChan    = make(chan termbox.Event)
-	inputChan    = make(chan []byte)
+	inputChan    = make(chan Input)
 	outputChan   = make(chan []byte)
-	inputCtlChan = make(chan bool, 1)
+	blockChan    = make(chan []string)
+	messageChan  = make(chan record)
+	updateChan   = make(chan statusUpdate)
+	contentChan  = make(chan contentUpdate)
+	selectChan   = make(chan selectRequest)
+	redrawChan   = make(chan struct{}, 1)
+	statusChan   = make(chan string)
+	activityChan = make(chan struct{}, 1)
+	editChan     = make(chan bool, 1)
+	hintChan     = make(chan string)
+	inputCtlChan = make(chan inputMode, 1)
+	status       string
+	hint         string
 )
 
 const (
@@ -27,6 +42,15 @@ const (
 	tabstopLength                = 8
 )
 
+type inputMode int
+
+const (
+	inputOff inputMode = iota
+	inputOn
+	// inputHidden 用于输入口令，输入的内容不显示
+	inputHidden
+)
+
 func tbPrint(x, y int, fg, bg termbox.Attribute, msg string) {
 	for _, c := range msg {
 		termbox.SetCell(x, y, c, fg, bg)
@@ -91,6 +115,7 @@ type InputBox struct {
 	cursorBoffset int // cursor offset in bytes
 	cursorVoffset int // visual cursor offset in termbox cells
 	cursorCoffset int // cursor offset in unicode code points
+	hidden        bool
 }
 
 func (ib *InputBox) Clear() {
@@ -105,6 +130,9 @@ func (ib *InputBox) Draw(x, y, w, h int) {
 	ib.AdjustVOffset(w)
 
 	fill(x, y, w, h, termbox.Cell{Ch: ' '})
+	if ib.hidden {
+		return
+	}
 
 	t := ib.text
 	lx := 0
@@ -242,26 +270,32 @@ func (ib *InputBox) InsertRune(r rune) {
 }
 
 func (ib *InputBox) CursorX() int {
+	if ib.hidden {
+		return 0
+	}
 	return ib.cursorVoffset - ib.lineVoffset
 }
 
-type MessageBox struct {
-	text    [][]byte
-	maxLine int
-}
-
 func (mb *MessageBox) Draw(x int, y int, w int, h int) {
 	records := mb.text
 	if len(mb.text) == 0 {
 		return
 	}
-	const coldef = termbox.ColorDefault
 	rx := 0
 	ry := y
 
-	for _, record := range records {
+	for _, rec := range records {
+		fg, bg := rec.fg, rec.bg
+		if rec.id != "" && rec.id == mb.selected {
+			fg |= termbox.AttrReverse
+		}
+		record := rec.text
 		rx = 0
 		ry += 1
+		if rec.ref != "" {
+			tbPrint(x+2, ry, colorDefault, colorDefault, "│ "+mb.snippet(rec.ref, w-4))
+			ry += 1
+		}
 		for len(record) > 0 {
 			// 换行
 			if rx >= w {
@@ -278,7 +312,7 @@ func (mb *MessageBox) Draw(x int, y int, w int, h int) {
 					}
 
 					if rx >= 0 {
-						termbox.SetCell(x+rx, ry, ' ', coldef, coldef)
+						termbox.SetCell(x+rx, ry, ' ', fg, bg)
 					}
 				}
 			} else if r == '\n' {
@@ -286,13 +320,24 @@ func (mb *MessageBox) Draw(x int, y int, w int, h int) {
 				ry += 1
 			} else {
 				if rx >= 0 {
-					termbox.SetCell(x+rx, ry, r, coldef, coldef)
+					termbox.SetCell(x+rx, ry, r, fg, bg)
 				}
 				rx += runewidth.RuneWidth(r)
 			}
 		next:
 			record = record[size:]
 		}
+		if rec.edited {
+			tbPrint(x+rx+1, ry, colorDefault, colorDefault, editedMarker)
+			rx += runewidth.StringWidth(editedMarker) + 1
+		}
+		if marker, ok := statusMarkers[rec.status]; ok {
+			markerFg := colorDefault
+			if rec.status == StatusFailed {
+				markerFg = termbox.ColorRed
+			}
+			tbPrint(x+rx+1, ry, markerFg, colorDefault, marker)
+		}
 	}
 }
 
@@ -301,14 +346,6 @@ func (mb *MessageBox) AppendAndRedraw(text []byte) {
 	redrawAll()
 }
 
-func (mb *MessageBox) Append(text []byte) {
-	mb.text = append(mb.text, text)
-	l := len(mb.text)
-	if l > mb.maxLine {
-		mb.text = mb.text[l-mb.maxLine:]
-	}
-}
-
 func redrawPrepare() {
 	colorDefault = termbox.ColorDefault
 	termbox.Clear(colorDefault, colorDefault)
@@ -332,17 +369,33 @@ func redrawAll() {
 	inputY := termH - 2
 
 	fill(inputX, inputY-1, termW, 1, termbox.Cell{Ch: '─'})
+	if status != "" {
+		tbPrint(inputX+2, inputY-1, colorDefault, colorDefault, " "+status+" ")
+	}
+	if s := messageBox.selectionHint(termW - 2); s != "" {
+		tbPrint(inputX+1, inputY-2, termbox.ColorYellow, colorDefault, s)
+	} else if hint != "" {
+		tbPrint(inputX+1, inputY-2, termbox.ColorCyan, colorDefault, hint)
+	}
 
-	messageBox.maxLine = inputY - 3
+	messageBox.maxLine = inputY - 4
 	messageBox.Draw(termX, termY, termW, termH)
+	inputMutex.Lock()
 	inputBox.Draw(inputX, inputY, termW, 1)
-
 	termbox.SetCursor(inputX+inputBox.CursorX(), inputY)
+	inputMutex.Unlock()
 
 	termbox.Flush()
 }
 
-func New() (chan []byte, chan []byte, error) {
+// Input 是用户按回车提交的一行输入
+type Input struct {
+	Text []byte
+	// Selected 是提交时选中的消息 id，没有选中时为空
+	Selected string
+}
+
+func New() (chan Input, chan []byte, error) {
 	err := termbox.Init()
 	if err != nil {
 		return nil, nil, err
@@ -353,20 +406,113 @@ func New() (chan []byte, chan []byte, error) {
 
 	// 输出显示
 	go func() {
-		for o := range outputChan {
-			messageBox.AppendAndRedraw(o)
+		for {
+			select {
+			case o := <-outputChan:
+				messageBox.AppendAndRedraw(o)
+			case lines := <-blockChan:
+				for _, line := range lines {
+					messageBox.appendRecord(record{text: []byte(line), fg: termbox.ColorBlack, bg: termbox.ColorWhite})
+				}
+				redrawAll()
+			case r := <-messageChan:
+				messageBox.appendRecord(r)
+				redrawAll()
+			case u := <-updateChan:
+				messageBox.setStatus(u.id, u.status)
+				redrawAll()
+			case u := <-contentChan:
+				messageBox.setContent(u)
+				redrawAll()
+			case r := <-selectChan:
+				messageBox.handleSelect(r)
+				redrawAll()
+			case s := <-statusChan:
+				status = s
+				redrawAll()
+			case s := <-hintChan:
+				hint = s
+				redrawAll()
+			case <-redrawChan:
+				redrawAll()
+			}
 		}
 	}()
 
 	return inputChan, outputChan, nil
 }
 
+// SetStatus 设置显示在输入框上方分隔线中的状态文字
+func SetStatus(s string) {
+	statusChan <- s
+}
+
+// ShowBlock 在消息区以黑色前景、白色背景显示多行文字，不受终端配色影响，用于显示二维码
+func ShowBlock(lines []string) {
+	blockChan <- lines
+}
+
+// AppendMessage 在消息区显示一条聊天消息，之后可以用 SetMessageStatus 按 id 更新状态
+func AppendMessage(id string, text []byte, status Status) {
+	messageChan <- record{text: text, id: id, status: status}
+}
+
+// AppendReply 显示一条回复，上方引用 ref 对应消息的第一行
+func AppendReply(id string, ref string, text []byte, status Status) {
+	messageChan <- record{text: text, id: id, ref: ref, status: status}
+}
+
+// SetMessageStatus 更新 id 对应消息的状态，消息已经滚出消息区时忽略
+func SetMessageStatus(id string, status Status) {
+	updateChan <- statusUpdate{id: id, status: status}
+}
+
+// Activity 在用户输入时收到通知，表示用户正在看着聊天界面，输入口令时不通知
+func Activity() <-chan struct{} {
+	return activityChan
+}
+
+// EditMessage 把 id 对应消息的内容替换为 text 并标记为已编辑，旧内容会被清零
+func EditMessage(id string, text []byte) {
+	contentChan <- contentUpdate{id: id, text: text}
+}
+
+// DeleteMessage 删除 id 对应的消息，在原位置显示 placeholder，旧内容会被清零
+func DeleteMessage(id string, placeholder []byte) {
+	contentChan <- contentUpdate{id: id, text: placeholder, deleted: true}
+}
+
+// SetHint 设置分隔线上方一行的提示，例如对方正在输入，为空时不显示
+func SetHint(s string) {
+	hintChan <- s
+}
+
+// Edits 在输入框的内容改变时收到通知，值表示输入框中是否有文字。
+// 只保留最新的一次通知，输入口令时不通知
+func Edits() <-chan bool {
+	return editChan
+}
+
+// notifyEdit 通知输入框内容的改变，替换掉还没有被取走的旧通知
+func notifyEdit(nonEmpty bool) {
+	select {
+	case <-editChan:
+	default:
+	}
+	editChan <- nonEmpty
+}
+
 func StartInput() {
-	inputCtlChan <- true
+	inputCtlChan <- inputOn
+}
+
+// StartHiddenInput 开始输入但不显示输入的内容，用于输入口令
+func StartHiddenInput() {
+	inputCtlChan <- inputHidden
 }
 
 func StopInput() {
-	inputCtlChan <- false
+	inputCtlChan <- inputOff
 }
 
 func Quit() {
@@ -376,6 +522,54 @@ func Quit() {
 	}
 }
 
+// editInput 按键编辑输入框，返回按回车提交的文字和输入框中的文字是否改变，调用方需要持有 inputMutex
+func editInput(ev termbox.Event) (submit []byte, changed bool) {
+	length := len(inputBox.text)
+	switch ev.Key {
+	case termbox.KeyArrowLeft, termbox.KeyCtrlB:
+		inputBox.MoveCursorOneRuneBackward()
+	case termbox.KeyArrowRight, termbox.KeyCtrlF:
+		inputBox.MoveCursorOneRuneForward()
+	case termbox.KeyBackspace, termbox.KeyBackspace2:
+		inputBox.DeleteRuneBackward()
+	case termbox.KeyDelete, termbox.KeyCtrlD:
+		inputBox.DeleteRuneForward()
+	case termbox.KeyTab:
+		inputBox.InsertRune('\t')
+	case termbox.KeySpace:
+		inputBox.InsertRune(' ')
+	case termbox.KeyCtrlK:
+		inputBox.DeleteTheRestOfTheLine()
+	case termbox.KeyHome, termbox.KeyCtrlA:
+		inputBox.MoveCursorToBeginningOfTheLine()
+	case termbox.KeyEnd, termbox.KeyCtrlE:
+		inputBox.MoveCursorToEndOfTheLine()
+	case termbox.KeyEnter:
+		submit = inputBox.text
+		inputBox.Clear()
+	default:
+		if ev.Ch != 0 {
+			inputBox.InsertRune(ev.Ch)
+		}
+	}
+	return submit, len(inputBox.text) != length
+}
+
+// selectKeys 是选择消息的按键，选中的消息由处理输出的协程维护
+var selectKeys = map[termbox.Key]selectOp{
+	termbox.KeyArrowUp:   selectPrevious,
+	termbox.KeyArrowDown: selectNext,
+	termbox.KeyCtrlG:     selectReference,
+}
+
+// requestRedraw 请处理输出的协程重绘界面，消息区只在那个协程中读写
+func requestRedraw() {
+	select {
+	case redrawChan <- struct{}{}:
+	default:
+	}
+}
+
 func Start() {
 
 	go func() {
@@ -383,60 +577,52 @@ func Start() {
 		for {
 			select {
 			case ctl := <-inputCtlChan:
-				isInput = ctl
+				isInput = ctl != inputOff
+				inputMutex.Lock()
+				inputBox.hidden = ctl == inputHidden
 				inputBox.Clear()
+				inputMutex.Unlock()
 			case ev := <-eventChan:
-				switch ev.Type {
-				case termbox.EventKey:
-					if isInput {
-						switch ev.Key {
-						case termbox.KeyEsc, termbox.KeyCtrlC:
-							Quit()
-							return
-						case termbox.KeyArrowLeft, termbox.KeyCtrlB:
-							inputBox.MoveCursorOneRuneBackward()
-						case termbox.KeyArrowRight, termbox.KeyCtrlF:
-							inputBox.MoveCursorOneRuneForward()
-						case termbox.KeyBackspace, termbox.KeyBackspace2:
-							inputBox.DeleteRuneBackward()
-						case termbox.KeyDelete, termbox.KeyCtrlD:
-							inputBox.DeleteRuneForward()
-						case termbox.KeyTab:
-							inputBox.InsertRune('\t')
-						case termbox.KeySpace:
-							inputBox.InsertRune(' ')
-						case termbox.KeyCtrlK:
-							inputBox.DeleteTheRestOfTheLine()
-						case termbox.KeyHome, termbox.KeyCtrlA:
-							inputBox.MoveCursorToBeginningOfTheLine()
-						case termbox.KeyEnd, termbox.KeyCtrlE:
-							inputBox.MoveCursorToEndOfTheLine()
-						case termbox.KeyEnter:
-							if len(inputBox.text) > 0 {
-								text := inputBox.text
-								inputChan <- text
-								inputBox.Clear()
-							}
-							continue
-						default:
-							if ev.Ch != 0 {
-								inputBox.InsertRune(ev.Ch)
-							}
-						}
-					} else {
-						switch ev.Key {
-						case termbox.KeyEsc, termbox.KeyCtrlC:
-							Quit()
-							return
-						}
+				if ev.Type != termbox.EventKey {
+					break
+				}
+				if ev.Key == termbox.KeyEsc || ev.Key == termbox.KeyCtrlC {
+					Quit()
+					return
+				}
+				if !isInput {
+					break
+				}
+
+				inputMutex.Lock()
+				hidden := inputBox.hidden
+				inputMutex.Unlock()
+				if !hidden {
+					select {
+					case activityChan <- struct{}{}:
+					default:
 					}
+				}
+				if op, ok := selectKeys[ev.Key]; ok {
+					selectChan <- selectRequest{op: op}
+					continue
+				}
 
-				case termbox.EventError:
-					//panic(ev.Err)
+				inputMutex.Lock()
+				submit, changed := editInput(ev)
+				nonEmpty := len(inputBox.text) > 0
+				inputMutex.Unlock()
+				if len(submit) > 0 {
+					taken := make(chan string, 1)
+					selectChan <- selectRequest{op: selectTake, taken: taken}
+					inputChan <- Input{Text: submit, Selected: <-taken}
+				}
+				if changed && !hidden {
+					notifyEdit(nonEmpty)
 				}
 			}
 
-			redrawAll()
+			requestRedraw()
 		}
 	}()
 